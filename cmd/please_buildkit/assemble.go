@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/VJftw/please-buildkit/pkg/tracing"
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func AssembleCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "assemble",
+		Usage: "Assembles an image from a base image and files without BuildKit",
+		Description: `
+This command builds an image directly by appending a single, deterministic
+layer of the given 'src' files onto a base image and updating its config. No
+container engine or BuildKit daemon is required, so it is suitable for images
+which do not need any 'RUN' steps, e.g. distroless images.
+
+The base image is either a registry reference or an OCI image layout prefixed
+with 'oci-layout://'. Each 'src' is copied to 'dest_dir'/<src>. If 'entrypoint'
+is not given, or is empty, the first executable 'src' is used as the
+entrypoint. As with 'ENTRYPOINT' in a Dockerfile, setting the entrypoint resets
+the base image's cmd.
+
+The image is created now, unless 'reproducible' is set, in which case it is
+created at SOURCE_DATE_EPOCH, as with the 'build' command.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "image_out",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "fqn_tags_file",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:     "base",
+				Usage:    "base image reference, or oci-layout://<path>",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "platform",
+				Usage: "platform of the base image to use, defaults to linux on the host's architecture",
+				Value: "linux/" + runtime.GOARCH,
+			},
+			&cli.StringSliceFlag{
+				Name:  "src",
+				Usage: "file to add to the image",
+			},
+			&cli.StringFlag{
+				Name:  "dest_dir",
+				Usage: "directory in the image to add files to",
+				Value: "/app",
+			},
+			&cli.StringFlag{
+				Name:  "entrypoint",
+				Usage: "entrypoint as a JSON array",
+			},
+			&cli.StringFlag{
+				Name:  "cmd",
+				Usage: "cmd as a JSON array",
+			},
+			&cli.StringFlag{
+				Name: "user",
+			},
+			&cli.StringFlag{
+				Name: "workdir",
+			},
+			&cli.StringSliceFlag{
+				Name:  "env",
+				Usage: "environment variable in the form KEY=VALUE",
+			},
+			&cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "label in the form KEY=VALUE",
+			},
+			&cli.BoolFlag{
+				Name:  "reproducible",
+				Usage: "create the image at SOURCE_DATE_EPOCH rather than now",
+			},
+			&cli.Int64Flag{
+				Name:    "source_date_epoch",
+				Usage:   "unix timestamp to use for reproducible builds",
+				EnvVars: []string{"SOURCE_DATE_EPOCH"},
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			fqnTags, err := readFqnTags(cCtx.String("fqn_tags_file"))
+			if err != nil {
+				return err
+			}
+
+			opts, err := assembleOptsFromFlags(cCtx)
+			if err != nil {
+				return err
+			}
+
+			platform, err := v1.ParsePlatform(cCtx.String("platform"))
+			if err != nil {
+				return fmt.Errorf("invalid platform: %w", err)
+			}
+
+			ctx, span := tracing.Tracer().Start(cCtx.Context, "pull base image")
+			base, err := image.LoadBaseImage(ctx, cCtx.String("base"), *platform,
+				remote.WithAuthFromKeychain(authn.DefaultKeychain),
+			)
+			tracing.End(span, err)
+			if err != nil {
+				return fmt.Errorf("could not load base image: %w", err)
+			}
+
+			img, err := image.Assemble(base, opts)
+			if err != nil {
+				return err
+			}
+
+			outImagePath := cCtx.String("image_out")
+			if err := image.WriteDockerArchive(outImagePath, img, fqnTags); err != nil {
+				return err
+			}
+
+			log.Info().
+				Str("out", outImagePath).
+				Msg("assembled image")
+
+			return nil
+		},
+	}
+}
+
+func assembleOptsFromFlags(cCtx *cli.Context) (*image.AssembleOpts, error) {
+	opts := &image.AssembleOpts{
+		User:       cCtx.String("user"),
+		WorkingDir: cCtx.String("workdir"),
+		Env:        cCtx.StringSlice("env"),
+		Labels:     map[string]string{},
+		Created:    time.Now().UTC(),
+	}
+	if cCtx.Bool("reproducible") {
+		opts.Created = time.Unix(cCtx.Int64("source_date_epoch"), 0).UTC()
+	}
+
+	for _, src := range cCtx.StringSlice("src") {
+		opts.Files = append(opts.Files, image.AssembleFile{
+			Src:  src,
+			Dest: path.Join(cCtx.String("dest_dir"), src),
+		})
+	}
+
+	for _, kv := range cCtx.StringSlice("label") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label '%s', must be in the form KEY=VALUE", kv)
+		}
+		opts.Labels[k] = v
+	}
+
+	for _, kv := range opts.Env {
+		if !strings.Contains(kv, "=") {
+			return nil, fmt.Errorf("invalid env '%s', must be in the form KEY=VALUE", kv)
+		}
+	}
+
+	if v := cCtx.String("cmd"); v != "" {
+		if err := json.Unmarshal([]byte(v), &opts.Cmd); err != nil {
+			return nil, fmt.Errorf("invalid cmd '%s': %w", v, err)
+		}
+	}
+
+	if v := cCtx.String("entrypoint"); v != "" {
+		if err := json.Unmarshal([]byte(v), &opts.Entrypoint); err != nil {
+			return nil, fmt.Errorf("invalid entrypoint '%s': %w", v, err)
+		}
+	}
+
+	if len(opts.Entrypoint) == 0 {
+		for _, f := range opts.Files {
+			info, err := os.Stat(f.Src)
+			if err != nil {
+				return nil, err
+			}
+			if info.Mode().Perm()&0o111 != 0 {
+				opts.Entrypoint = []string{f.Dest}
+				break
+			}
+		}
+	}
+
+	return opts, nil
+}
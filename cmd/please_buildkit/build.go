@@ -3,14 +3,23 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/VJftw/please-buildkit/pkg/buildcontext"
+	"github.com/VJftw/please-buildkit/pkg/buildkitd"
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/VJftw/please-buildkit/pkg/progress"
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/VJftw/please-buildkit/pkg/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func BuildCommand() *cli.Command {
@@ -20,109 +29,770 @@ func BuildCommand() *cli.Command {
 		Description: `
 This command builds a docker image directly with the given parameters as Please
 > 17.0.0 does not support Please workers anymore.
+
+BuildKit may optionally generate SBOM and SLSA provenance attestations of the
+image via 'sbom' and 'provenance'. These are written as newline delimited in-toto
+statements to 'sbom_out' and 'provenance_out' respectively. Their subject is the
+digest of the built docker image tarball, i.e. of the image as it is pushed,
+rather than of the OCI image BuildKit exported.
+
+Only the given 'src' files and directories are sent to BuildKit as the build
+context. Files matching a '<dockerfile>.dockerignore', or else a
+'.dockerignore', next to the Dockerfile are excluded. As srcs keep their paths
+relative to the root of the repository, so do the patterns.
+
+Build progress is streamed to stderr according to 'progress': 'plain' prints
+each step's logs with timings and cache hits, 'tty' renders an interactive
+display, 'json' emits newline delimited events and 'quiet' only prints the
+tail of the log if the build fails. As logs are also written to stderr, 'json'
+events are written to stdout, or to 'progress_out' if it is set.
+
+With 'reproducible', SOURCE_DATE_EPOCH is passed to the build and BuildKit
+rewrites the timestamps of files in new layers to it, so that building
+identical inputs results in an identical image digest.
+
+With 'stats_out', the durations of each phase of the build, e.g. pulling the
+buildkitd image or solving, and how many steps were cached are written as JSON.
+See 'stats' to aggregate these.
 `,
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:     "image_out",
 				Required: true,
 			},
-			&cli.StringFlag{
-				Name:     "fqn_tags_file",
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:     "dockerfile",
-				Required: true,
-			},
-			&cli.StringFlag{
-				Name:  "buildctl_binary",
-				Value: "buildctl",
-			},
-			&cli.DurationFlag{
-				Name:  "buildkitd_timeout",
-				Value: 5 * time.Second,
-			},
-			&cli.StringFlag{
-				Name:  "docker_binary",
-				Value: "docker",
+			&cli.BoolFlag{
+				Name:  "sbom",
+				Usage: "generate an SBOM attestation of the image",
 			},
 			&cli.StringFlag{
-				Name:  "docker_image",
-				Value: "moby/buildkit:master",
+				Name:  "sbom_out",
+				Usage: "path to write the SBOM attestation to",
 			},
 			&cli.StringFlag{
-				Name:  "rootless_docker_binary",
-				Value: "docker",
+				Name:  "provenance",
+				Usage: "generate a SLSA provenance attestation of the image with the given mode (min|max)",
 			},
 			&cli.StringFlag{
-				Name:  "rootless_docker_image",
-				Value: "moby/buildkit:master-rootless",
+				Name:  "provenance_out",
+				Usage: "path to write the SLSA provenance attestation to",
 			},
-			&cli.StringFlag{
-				Name:  "podman_binary",
-				Value: "podman",
+			&cli.BoolFlag{
+				Name:  "reproducible",
+				Usage: "build the image reproducibly with SOURCE_DATE_EPOCH",
 			},
 			&cli.StringFlag{
-				Name:  "podman_image",
-				Value: "docker.io/moby/buildkit:master",
+				Name:  "stats_out",
+				Usage: "optional path to write the build's timing and cache statistics to",
 			},
-		},
+		}, buildFlags()...),
 		Action: func(cCtx *cli.Context) error {
-
-			buildkitdAddr, closeFn, err := StartBuildkitdWorker(cCtx)
+			attestOpts, err := attestationOptsFromFlags(cCtx)
 			if err != nil {
 				return err
 			}
-			defer closeFn()
-
-			tmpDir := os.TempDir()
 
-			fqnTagsFileContents, err := os.ReadFile(cCtx.String("fqn_tags_file"))
+			b, err := newBuilder(cCtx)
 			if err != nil {
-				return fmt.Errorf("could not read '%s': %w", cCtx.String("fqn_tags_file"), err)
+				return err
 			}
-			fqnTags := strings.FieldsFunc(string(fqnTagsFileContents), func(c rune) bool {
-				return c == '\n'
-			})
+			defer b.Close()
 
-			if err := os.MkdirAll(filepath.Join(tmpDir, "dockerfile"), 0755); err != nil {
-				return fmt.Errorf("could not create 'dockerfile' dir: %w", err)
-			}
+			recorder := stats.NewRecorder()
+			cCtx.Context = stats.WithRecorder(cCtx.Context, recorder)
 
-			if err := os.Rename(
-				filepath.Join(tmpDir, cCtx.String("dockerfile")),
-				filepath.Join(tmpDir, "dockerfile/Dockerfile"),
-			); err != nil {
-				return fmt.Errorf("could not move dockerfile: %w", err)
+			worker, endpoint, closeFn, err := StartBuildkitdWorker(cCtx)
+			if err != nil {
+				return err
 			}
+			defer closeFn()
+			b.worker = worker
+			b.endpoint = endpoint
+			b.attestOpts = attestOpts
+			b.reproducible = cCtx.Bool("reproducible")
+			b.cache = cCtx.Bool("buildkitd_state")
 
 			outImagePath := cCtx.String("image_out")
-			cmd := exec.CommandContext(cCtx.Context,
-				cCtx.String("buildctl_binary"),
-				[]string{
-					"build",
-					"--frontend=dockerfile.v0",
-					"--no-cache",
-					"--trace", filepath.Join(tmpDir, "buildctl.trace"),
-					"--local", fmt.Sprintf("context=%s", tmpDir),
-					"--local", fmt.Sprintf("dockerfile=%s", filepath.Join(tmpDir, "dockerfile")),
-					"--output", fmt.Sprintf("type=docker,\"name=%s\",dest=%s", strings.Join(fqnTags, ","), outImagePath),
-				}...)
-
-			var stderr bytes.Buffer
-			cmd.Stderr = &stderr
-			cmd.Env = append(os.Environ(), []string{
-				"BUILDKIT_HOST=" + buildkitdAddr,
-			}...)
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("could not run '%s': %w\n%s", strings.Join(cmd.Args, " "), err, stderr.String())
+			if len(attestOpts) == 0 {
+				if err := b.build(cCtx, "docker", outImagePath); err != nil {
+					return err
+				}
+			} else {
+				// the docker exporter does not support attestations, so we
+				// export an OCI layout and convert it afterwards.
+				ociPath := filepath.Join(b.workDir, "image.oci.tar")
+				if err := b.build(cCtx, "oci", ociPath); err != nil {
+					return err
+				}
+
+				if err := convertAttestedImage(cCtx, ociPath, outImagePath, b.fqnTags); err != nil {
+					return err
+				}
 			}
 
 			log.Info().
 				Str("out", outImagePath).
 				Msg("built image")
 
+			if statsOut := cCtx.String("stats_out"); statsOut != "" {
+				if err := recorder.Report().Write(statsOut); err != nil {
+					return fmt.Errorf("could not write build stats: %w", err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// progressModes are the supported values of the 'progress' flag.
+var progressModes = []string{"plain", "tty", "json", "quiet"}
+
+func validateProgress(mode string) error {
+	for _, m := range progressModes {
+		if m == mode {
 			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid progress '%s', must be one of: %s", mode, strings.Join(progressModes, ", "))
+}
+
+// buildLogTailLines is the number of lines of the build log which are
+// included in the error when a build fails.
+const buildLogTailLines = 100
+
+// buildFlags returns the flags which are common to commands that build
+// images with BuildKit.
+func buildFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "fqn_tags_file",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "dockerfile",
+			Required: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "src",
+			Usage: "file or directory to add to the build context",
+		},
+		&cli.StringSliceFlag{
+			Name:  "deps_image",
+			Usage: "image tar or OCI layout to make available as a named build context, in the form NAME=PATH",
+		},
+		&cli.StringFlag{
+			Name:    "progress",
+			Usage:   fmt.Sprintf("build progress output to stderr (%s)", strings.Join(progressModes, "|")),
+			Value:   "plain",
+			EnvVars: []string{"PLEASE_BUILDKIT_PROGRESS"},
+		},
+		&cli.StringFlag{
+			Name:    "progress_out",
+			Usage:   "path to write 'json' progress events to, defaults to stdout",
+			EnvVars: []string{"PLEASE_BUILDKIT_PROGRESS_OUT"},
+		},
+		&cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "platform to build the image for, e.g. linux/arm64, which buildkitd must have a worker for. Defaults to buildkitd's platform",
+		},
+		&cli.Int64Flag{
+			Name:    "source_date_epoch",
+			Usage:   "unix timestamp to use for reproducible builds",
+			EnvVars: []string{"SOURCE_DATE_EPOCH"},
+		},
+	}, buildkitdFlags()...)
+}
+
+// buildkitdFlags returns the flags which configure how buildkitd is run.
+func buildkitdFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "buildctl_binary",
+			Value: "buildctl",
+		},
+		&cli.DurationFlag{
+			Name:  "buildkitd_timeout",
+			Value: 5 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_pull_policy",
+			Usage:   "when to pull the buildkitd image: always, if-not-present or never",
+			Value:   buildkitd.PullPolicyAlways,
+			EnvVars: []string{"PLEASE_BUILDKIT_PULL_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:  "buildkitd_image_tar",
+			Usage: "optional tarball of the buildkitd image to load instead of pulling it, e.g. for air-gapped hosts",
+		},
+		&cli.StringFlag{
+			Name:  "buildkitd_image_digest",
+			Usage: "config or manifest digest, e.g. sha256:..., which 'buildkitd_image_tar' must have, unless the provider's image is pinned by digest",
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_config",
+			Usage:   "optional buildkitd.toml to configure buildkitd with, e.g. registry mirrors or GC policy",
+			EnvVars: []string{"PLEASE_BUILDKIT_BUILDKITD_CONFIG"},
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_registry_mirror",
+			Usage: "registry mirror to add to the buildkitd configuration, in the form REGISTRY=MIRROR, e.g. docker.io=mirror.gcr.io",
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_insecure_registry",
+			Usage: "registry to allow buildkitd to access over plain HTTP, e.g. localhost:5000",
+		},
+		&cli.IntFlag{
+			Name:  "buildkitd_max_parallelism",
+			Usage: "maximum number of build steps buildkitd runs in parallel. Defaults to 'buildkitd_cpus', rounded up",
+		},
+		&cli.Float64Flag{
+			Name:  "buildkitd_cpus",
+			Usage: "number of CPUs buildkitd may use, e.g. 1.5, 0 is unlimited",
+		},
+		&cli.StringFlag{
+			Name:  "buildkitd_memory",
+			Usage: "memory buildkitd may use, e.g. 512m or 4g, unlimited if empty",
+		},
+		&cli.Int64Flag{
+			Name:  "buildkitd_pids_limit",
+			Usage: "maximum number of processes buildkitd may run, 0 is unlimited. Kubernetes configures this on the kubelet instead",
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_mount",
+			Usage: "path on the host to mount into buildkitd's container, in the form SOURCE:TARGET[:ro], e.g. a CA bundle. Relative sources are relative to the workspace. Kubernetes only supports read-only files",
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_env",
+			Usage: "environment variable to set for buildkitd, in the form KEY=VALUE, e.g. HTTPS_PROXY=http://proxy:3128",
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_dns",
+			Usage: "DNS server for buildkitd to use instead of the container engine's default",
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_dns_search",
+			Usage: "DNS search domain for buildkitd to use",
+		},
+		&cli.StringSliceFlag{
+			Name:  "buildkitd_dns_option",
+			Usage: "DNS resolver option for buildkitd to use, e.g. ndots:2",
+		},
+		&cli.StringFlag{
+			Name:  "buildkitd_snapshotter",
+			Usage: "snapshotter for buildkitd to use, e.g. overlayfs or native, which its worker must report",
+		},
+		&cli.IntFlag{
+			Name:  "buildkitd_log_lines",
+			Usage: "number of last lines of buildkitd's logs to print when it fails to start or a build fails, 0 disables them",
+			Value: 50,
+		},
+		&cli.DurationFlag{
+			Name:  "buildkitd_stop_timeout",
+			Usage: "how long to wait for buildkitd to stop before giving up, e.g. after the build is interrupted",
+			Value: buildkitd.DefaultStopTimeout,
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_transport",
+			Usage:   "how buildkitd is exposed to the host: 'tcp' publishes it with mutual TLS on a port chosen by the container engine bound to 127.0.0.1, 'unix' binds a unix socket on a shared volume in $XDG_RUNTIME_DIR, or /tmp",
+			Value:   buildkitd.TransportTCP,
+			EnvVars: []string{"PLEASE_BUILDKIT_TRANSPORT"},
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_addr",
+			Usage:   "address of an externally managed buildkitd to use instead of starting one, e.g. tcp://buildkitd.example.com:1234",
+			EnvVars: []string{"PLEASE_BUILDKIT_BUILDKITD_ADDR"},
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_tlscacert",
+			Usage:   "CA certificate to verify the externally managed buildkitd with, see 'buildkitd_addr'",
+			EnvVars: []string{"PLEASE_BUILDKIT_BUILDKITD_TLSCACERT"},
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_tlscert",
+			Usage:   "client certificate to connect to the externally managed buildkitd with, see 'buildkitd_addr'",
+			EnvVars: []string{"PLEASE_BUILDKIT_BUILDKITD_TLSCERT"},
 		},
+		&cli.StringFlag{
+			Name:    "buildkitd_tlskey",
+			Usage:   "client key to connect to the externally managed buildkitd with, see 'buildkitd_addr'",
+			EnvVars: []string{"PLEASE_BUILDKIT_BUILDKITD_TLSKEY"},
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_tlsservername",
+			Usage:   "name to verify the certificate of the externally managed buildkitd with instead of its host, see 'buildkitd_addr'",
+			EnvVars: []string{"PLEASE_BUILDKIT_BUILDKITD_TLSSERVERNAME"},
+		},
+		&cli.BoolFlag{
+			Name:    "buildkitd_gc",
+			Usage:   "remove buildkitd containers left behind by crashed or killed builds before starting buildkitd, see 'gc'",
+			EnvVars: []string{"PLEASE_BUILDKIT_GC"},
+		},
+		&cli.StringFlag{
+			Name:  "docker_image",
+			Value: "moby/buildkit:master",
+		},
+		&cli.StringFlag{
+			Name:  "rootless_docker_image",
+			Value: "moby/buildkit:master-rootless",
+		},
+		&cli.StringFlag{
+			Name:  "podman_image",
+			Value: "docker.io/moby/buildkit:master",
+		},
+		&cli.StringFlag{
+			Name:  "nerdctl_image",
+			Value: "moby/buildkit:master",
+		},
+		&cli.StringFlag{
+			Name:  "nerdctl_rootless_image",
+			Usage: "image to run when containerd is rootless",
+			Value: "moby/buildkit:master-rootless",
+		},
+		&cli.StringFlag{
+			Name:    "kubernetes_namespace",
+			Usage:   "namespace to run buildkitd in as a rootless pod, using the current kubeconfig or in-cluster configuration. Kubernetes is only used when this is set",
+			EnvVars: []string{"PLEASE_BUILDKIT_KUBERNETES_NAMESPACE"},
+		},
+		&cli.StringFlag{
+			Name:  "kubernetes_image",
+			Value: "moby/buildkit:master-rootless",
+		},
+		&cli.StringFlag{
+			Name:    "kubernetes_connect",
+			Usage:   fmt.Sprintf("how to connect to the buildkitd pod (%s): 'pod-ip' requires running in the cluster", strings.Join(buildkitd.KubernetesConnects, "|")),
+			Value:   buildkitd.KubernetesConnectPortForward,
+			EnvVars: []string{"PLEASE_BUILDKIT_KUBERNETES_CONNECT"},
+		},
+		&cli.StringFlag{
+			Name:    "kubernetes_state_claim",
+			Usage:   "optional PersistentVolumeClaim to keep buildkitd's state in, which should only be used by one build at a time",
+			EnvVars: []string{"PLEASE_BUILDKIT_KUBERNETES_STATE_CLAIM"},
+		},
+		&cli.DurationFlag{
+			Name:  "kubernetes_ready_timeout",
+			Usage: "how long to wait for the buildkitd pod to become ready, e.g. while its image is pulled",
+			Value: buildkitd.DefaultKubernetesReadyTimeout,
+		},
+		&cli.StringFlag{
+			Name:    "podman_storage_dir",
+			Usage:   "directory to use as podman's storage instead of a new one per build, e.g. to reuse the buildkitd image between builds. Per-build storage is kept in $XDG_DATA_HOME/please-buildkit/podman/<workspace hash> rather than plz-out, as rootless storage left behind is owned by subordinate IDs which `plz clean` cannot remove",
+			EnvVars: []string{"PLEASE_BUILDKIT_PODMAN_STORAGE_DIR"},
+		},
+		&cli.StringFlag{
+			Name:    "podman_storage_cleanup",
+			Usage:   fmt.Sprintf("when to remove podman's storage after buildkitd stops (%s): 'auto' only removes the storage of a single build", strings.Join(buildkitd.PodmanCleanups, "|")),
+			Value:   buildkitd.PodmanCleanupAuto,
+			EnvVars: []string{"PLEASE_BUILDKIT_PODMAN_STORAGE_CLEANUP"},
+		},
+		&cli.BoolFlag{
+			Name:    "buildkitd_state",
+			Usage:   "keep buildkitd's state, e.g. its build cache and cache mounts, between builds of the workspace. Builds which run while another build of the workspace is using the state run without it",
+			EnvVars: []string{"PLEASE_BUILDKIT_STATE"},
+		},
+		&cli.StringFlag{
+			Name:    "buildkitd_state_dir",
+			Usage:   "directory to keep the locks of buildkitd's state, and the state itself for podman, in. Defaults to plz-out/please-buildkit/state in the workspace",
+			EnvVars: []string{"PLEASE_BUILDKIT_STATE_DIR"},
+		},
+		&cli.Int64Flag{
+			Name:  "buildkitd_state_keep_storage",
+			Usage: "megabytes of buildkitd's state to keep when garbage collecting it, 0 uses buildkitd's default policy",
+		},
+		workspaceFlag(),
+	}, engineBinaryFlags()...)
+}
+
+// workspaceFlag returns the flag for the Please workspace which buildkitd's
+// files, e.g. its state, are kept in.
+func workspaceFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "workspace",
+		Usage:   "root of the Please workspace which buildkitd's state and storage belong to. Defaults to the workspace containing the working directory",
+		EnvVars: []string{"PLEASE_BUILDKIT_WORKSPACE"},
 	}
 }
+
+// engineBinaryFlags returns the flags for the container engine binaries which
+// the buildkitd providers use.
+func engineBinaryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "docker_binary",
+			Value: "docker",
+		},
+		&cli.StringFlag{
+			Name:  "rootless_docker_binary",
+			Value: "docker",
+		},
+		&cli.StringFlag{
+			Name:  "podman_binary",
+			Value: "podman",
+		},
+		&cli.StringFlag{
+			Name:  "nerdctl_binary",
+			Value: "nerdctl",
+		},
+	}
+}
+
+// builder builds images from a prepared build context with buildctl.
+type builder struct {
+	buildctlBinary  string
+	worker          *buildkitd.Worker
+	endpoint        *buildkitd.Endpoint
+	workDir         string
+	contextDir      string
+	dockerfileDir   string
+	dockerfile      string
+	fqnTags         []string
+	depsImageArgs   []string
+	attestOpts      []string
+	reproducible    bool
+	platforms       []string
+	sourceDateEpoch int64
+	progress        string
+	progressOut     string
+	// cache is whether the build may reuse buildkitd's build cache, which is
+	// only kept between builds with the persistent state.
+	cache bool
+	// logLines is the number of lines of buildkitd's logs to dump when the
+	// build fails.
+	logLines int
+}
+
+// newBuilder prepares a build context from the declared srcs, which are
+// relative to the current temporary directory that Please populates with the
+// build's srcs, and returns a builder for it. The srcs are left untouched.
+func newBuilder(cCtx *cli.Context) (*builder, error) {
+	if err := validateProgress(cCtx.String("progress")); err != nil {
+		return nil, err
+	}
+
+	fqnTags, err := readFqnTags(cCtx.String("fqn_tags_file"))
+	if err != nil {
+		return nil, err
+	}
+
+	srcRoot := os.TempDir()
+	workDir, err := os.MkdirTemp(srcRoot, "please_buildkit-")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &builder{
+		buildctlBinary:  cCtx.String("buildctl_binary"),
+		workDir:         workDir,
+		contextDir:      filepath.Join(workDir, "context"),
+		dockerfileDir:   filepath.Join(workDir, "dockerfile"),
+		dockerfile:      filepath.Clean(cCtx.String("dockerfile")),
+		fqnTags:         fqnTags,
+		platforms:       cCtx.StringSlice("platform"),
+		sourceDateEpoch: cCtx.Int64("source_date_epoch"),
+		progress:        cCtx.String("progress"),
+		progressOut:     cCtx.String("progress_out"),
+		logLines:        cCtx.Int("buildkitd_log_lines"),
+	}
+
+	if err := b.prepare(srcRoot, cCtx.StringSlice("src"), cCtx.StringSlice("deps_image")); err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *builder) prepare(srcRoot string, srcs []string, depsImages []string) error {
+	if _, err := buildcontext.Create(b.dockerfileDir, srcRoot, []string{b.dockerfile}, nil); err != nil {
+		return fmt.Errorf("could not add dockerfile: %w", err)
+	}
+
+	excludes, ignoreFile, err := buildcontext.LoadIgnorePatterns(srcRoot, b.dockerfile)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.contextDir, 0o755); err != nil {
+		return err
+	}
+
+	stats, err := buildcontext.Create(b.contextDir, srcRoot, srcs, excludes)
+	if err != nil {
+		return fmt.Errorf("could not create build context: %w", err)
+	}
+
+	log.Info().
+		Int("files", stats.Files).
+		Int("dirs", stats.Dirs).
+		Int("excluded", stats.Excluded).
+		Str("size", image.HumanSize(stats.Bytes)).
+		Str("dockerignore", ignoreFile).
+		Msg("created build context")
+
+	b.depsImageArgs, err = prepareDepsImages(depsImages, filepath.Join(b.workDir, "deps_images"))
+
+	return err
+}
+
+// Close removes the builder's working files.
+func (b *builder) Close() error {
+	return os.RemoveAll(b.workDir)
+}
+
+// prepareDepsImages writes each of the given NAME=PATH images to an OCI
+// layout in the given directory and returns the buildctl arguments which make
+// them available as named build contexts, so that `FROM NAME` resolves to the
+// local image rather than a registry.
+func prepareDepsImages(depsImages []string, dir string) ([]string, error) {
+	args := []string{}
+	for i, kv := range depsImages {
+		contextName, path, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid deps image '%s', must be in the form NAME=PATH", kv)
+		}
+
+		archive, err := image.OpenArchive(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open deps image '%s': %w", contextName, err)
+		}
+		defer archive.Close()
+
+		digest, err := archive.Image.Digest()
+		if err != nil {
+			return nil, fmt.Errorf("could not get digest of deps image '%s': %w", contextName, err)
+		}
+
+		storeID := fmt.Sprintf("deps-%d", i)
+		layoutDir := filepath.Join(dir, storeID)
+		if err := image.WriteOCILayout(layoutDir, archive.Image); err != nil {
+			return nil, err
+		}
+
+		args = append(args,
+			"--oci-layout", fmt.Sprintf("%s=%s", storeID, layoutDir),
+			"--opt", fmt.Sprintf("context:%s=oci-layout://%s@%s", contextName, storeID, digest),
+		)
+
+		log.Debug().
+			Str("name", contextName).
+			Str("digest", digest.String()).
+			Msg("added deps image as named build context")
+	}
+
+	return args, nil
+}
+
+// build runs buildctl to build the image and export it with the given
+// exporter type to the given path.
+func (b *builder) build(cCtx *cli.Context, outputType string, outputPath string) (err error) {
+	ctx, span := tracing.Tracer().Start(cCtx.Context, "buildctl build", trace.WithAttributes(
+		attribute.String("buildkit.output.type", outputType),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	tracePath := filepath.Join(b.workDir, "buildctl.trace")
+	defer func() {
+		vertexes, err := readBuildTrace(tracePath)
+		if err != nil {
+			log.Debug().Err(err).Msg("could not read build trace")
+			return
+		}
+
+		tracing.RecordVertexes(ctx, vertexes)
+		if r := stats.FromContext(ctx); r != nil {
+			r.RecordVertexes(vertexes)
+		}
+	}()
+
+	output := fmt.Sprintf("type=%s,\"name=%s\",dest=%s", outputType, strings.Join(b.fqnTags, ","), outputPath)
+	if b.reproducible {
+		output += ",rewrite-timestamp=true"
+	}
+
+	args := append(b.endpoint.TLS.BuildctlArgs(), []string{
+		"build",
+		"--frontend=dockerfile.v0",
+		"--trace", tracePath,
+		"--local", fmt.Sprintf("context=%s", b.contextDir),
+		"--local", fmt.Sprintf("dockerfile=%s", b.dockerfileDir),
+		"--opt", fmt.Sprintf("filename=%s", filepath.ToSlash(b.dockerfile)),
+		"--output", output,
+	}...)
+	if !b.cache {
+		args = append(args, "--no-cache")
+	}
+	args = append(args, b.depsImageArgs...)
+	for _, opt := range b.attestOpts {
+		args = append(args, "--opt", opt)
+	}
+	if len(b.platforms) > 0 {
+		args = append(args, "--opt", "platform="+strings.Join(b.platforms, ","))
+	}
+	if b.reproducible {
+		args = append(args, "--opt", fmt.Sprintf("build-arg:SOURCE_DATE_EPOCH=%d", b.sourceDateEpoch))
+	}
+
+	buildctlProgress := b.progress
+	switch b.progress {
+	case "quiet":
+		buildctlProgress = "plain"
+	case "json":
+		buildctlProgress = "rawjson"
+	}
+	args = append(args, "--progress", buildctlProgress)
+
+	cmd := exec.CommandContext(ctx, b.buildctlBinary, args...)
+	cmd.Env = append(os.Environ(), []string{
+		"BUILDKIT_HOST=" + b.endpoint.Address,
+	}...)
+
+	// the full log is kept for the failure message.
+	var buildLog bytes.Buffer
+	switch b.progress {
+	case "plain":
+		cmd.Stderr = io.MultiWriter(os.Stderr, &buildLog)
+		err = cmd.Run()
+	case "tty":
+		// buildctl requires a console to render to, so the log cannot be
+		// kept.
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+	case "quiet":
+		cmd.Stderr = &buildLog
+		err = cmd.Run()
+	case "json":
+		err = runWithJSONProgress(cmd, b.progressOut, &buildLog)
+	}
+	if err != nil {
+		dumpBuildkitdLogs(b.worker, b.logLines)
+		return fmt.Errorf("could not run '%s': %w\n%s", strings.Join(cmd.Args, " "), err, progress.Tail(buildLog.String(), buildLogTailLines))
+	}
+
+	return nil
+}
+
+// readBuildTrace returns the vertexes of the given `buildctl --trace` file.
+func readBuildTrace(path string) ([]*progress.Vertex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return progress.ReadVertexes(f)
+}
+
+// runWithJSONProgress runs the given buildctl command, which must output
+// `rawjson` progress, and writes newline delimited progress events to the
+// given path, or stdout if it is empty, and a human-readable log to the given
+// writer. Events are not written to stderr as they could not be told apart
+// from logs.
+func runWithJSONProgress(cmd *exec.Cmd, eventsPath string, log io.Writer) error {
+	events := os.Stdout
+	if eventsPath != "" {
+		f, err := os.Create(eventsPath)
+		if err != nil {
+			return fmt.Errorf("could not create '%s': %w", eventsPath, err)
+		}
+		defer f.Close()
+		events = f
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if err := progress.ConvertRawJSON(stderr, events, log); err != nil {
+		_ = cmd.Wait()
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+// readFqnTags returns the newline delimited fully-qualified tags in the given
+// file.
+func readFqnTags(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read '%s': %w", path, err)
+	}
+
+	return strings.FieldsFunc(string(contents), func(c rune) bool {
+		return c == '\n'
+	}), nil
+}
+
+// attestationOptsFromFlags returns the BuildKit frontend options which
+// request the attestations given by the flags.
+func attestationOptsFromFlags(cCtx *cli.Context) ([]string, error) {
+	opts := []string{}
+
+	if cCtx.Bool("sbom") {
+		if cCtx.String("sbom_out") == "" {
+			return nil, fmt.Errorf("'sbom_out' is required with 'sbom'")
+		}
+		opts = append(opts, "attest:sbom=")
+	}
+
+	if mode := cCtx.String("provenance"); mode != "" {
+		if mode != "min" && mode != "max" {
+			return nil, fmt.Errorf("invalid provenance mode '%s', must be one of: min, max", mode)
+		}
+		if cCtx.String("provenance_out") == "" {
+			return nil, fmt.Errorf("'provenance_out' is required with 'provenance'")
+		}
+		opts = append(opts, fmt.Sprintf("attest:provenance=mode=%s", mode))
+	}
+
+	return opts, nil
+}
+
+// convertAttestedImage converts the given OCI layout tarball into a docker
+// image tarball and writes its attestations, which refer to the docker image,
+// to their configured outputs.
+func convertAttestedImage(cCtx *cli.Context, ociPath string, outImagePath string, fqnTags []string) error {
+	archive, err := image.OpenOCIArchive(ociPath)
+	if err != nil {
+		return fmt.Errorf("could not open built image: %w", err)
+	}
+	defer archive.Close()
+
+	if err := archive.WriteDockerArchive(outImagePath, fqnTags); err != nil {
+		return err
+	}
+
+	sboms := []*image.Attestation{}
+	provenances := []*image.Attestation{}
+	for _, a := range archive.Attestations {
+		switch {
+		case a.IsSBOM():
+			sboms = append(sboms, a)
+		case a.IsProvenance():
+			provenances = append(provenances, a)
+		default:
+			log.Warn().Str("predicateType", a.PredicateType).Msg("ignoring unknown attestation")
+		}
+	}
+
+	if cCtx.Bool("sbom") {
+		if err := image.WriteAttestations(cCtx.String("sbom_out"), sboms); err != nil {
+			return err
+		}
+		log.Info().Str("out", cCtx.String("sbom_out")).Int("statements", len(sboms)).Msg("wrote sbom")
+	}
+
+	if cCtx.String("provenance") != "" {
+		if err := image.WriteAttestations(cCtx.String("provenance_out"), provenances); err != nil {
+			return err
+		}
+		log.Info().Str("out", cCtx.String("provenance_out")).Int("statements", len(provenances)).Msg("wrote provenance")
+	}
+
+	return nil
+}
@@ -1,74 +1,471 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/VJftw/please-buildkit/pkg/buildkitd"
-	"github.com/avast/retry-go/v4"
+	"github.com/VJftw/please-buildkit/pkg/progress"
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/VJftw/please-buildkit/pkg/tracing"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-func StartBuildkitdWorker(cCtx *cli.Context) (string, func(), error) {
+// StartBuildkitdWorker starts buildkitd with the first supported provider, or
+// connects to an externally managed one if 'buildkitd_addr' is set, and
+// returns its worker, how to connect to it and a function which stops it.
+func StartBuildkitdWorker(cCtx *cli.Context) (*buildkitd.Worker, *buildkitd.Endpoint, func(), error) {
+	if cCtx.String("buildkitd_addr") != "" {
+		return startRemoteBuildkitdWorker(cCtx)
+	}
+
+	var state *buildkitd.State
+	if cCtx.Bool("buildkitd_state") {
+		var err error
+		state, err = lockBuildkitdState(cCtx)
+		if errors.Is(err, buildkitd.ErrStateInUse) {
+			log.Warn().Err(err).Msg("running buildkitd without persistent state")
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return startBuildkitdWorkerWithState(cCtx, state)
+}
+
+// startBuildkitdWorkerWithState starts buildkitd like StartBuildkitdWorker
+// with the given state, if any, which is unlocked when buildkitd is stopped.
+func startBuildkitdWorkerWithState(cCtx *cli.Context, state *buildkitd.State) (*buildkitd.Worker, *buildkitd.Endpoint, func(), error) {
+	configFile, removeConfigFile, err := buildkitdConfigFile(cCtx, state != nil)
+	if err != nil {
+		state.Unlock()
+		return nil, nil, nil, err
+	}
+
+	worker, endpoint, stop, err := startBuildkitdWorker(cCtx, configFile, state)
+	if err != nil {
+		removeConfigFile()
+		state.Unlock()
+		return nil, nil, nil, err
+	}
+
+	return worker, endpoint, func() {
+		stop()
+		removeConfigFile()
+		state.Unlock()
+	}, nil
+}
+
+// startRemoteBuildkitdWorker connects to the externally managed buildkitd at
+// 'buildkitd_addr' with the user-supplied TLS credentials, if any. The
+// settings of buildkitd, e.g. its state, are left to whoever manages it.
+func startRemoteBuildkitdWorker(cCtx *cli.Context) (*buildkitd.Worker, *buildkitd.Endpoint, func(), error) {
+	var tls *buildkitd.TLSCredentials
+	paths := []string{cCtx.String("buildkitd_tlscacert"), cCtx.String("buildkitd_tlscert"), cCtx.String("buildkitd_tlskey")}
+	if paths[0] != "" || paths[1] != "" || paths[2] != "" {
+		if (paths[1] == "") != (paths[2] == "") {
+			return nil, nil, nil, fmt.Errorf("both --buildkitd_tlscert and --buildkitd_tlskey are required for client certificates")
+		}
+		for i, path := range paths {
+			if path == "" {
+				continue
+			}
+			var err error
+			paths[i], err = filepath.Abs(path)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		tls = &buildkitd.TLSCredentials{
+			CACert:     paths[0],
+			Cert:       paths[1],
+			Key:        paths[2],
+			ServerName: cCtx.String("buildkitd_tlsservername"),
+		}
+	}
+
+	provider := buildkitd.NewRemoteProvider(&buildkitd.RemoteProviderOpts{
+		Address: cCtx.String("buildkitd_addr"),
+		TLS:     tls,
+	})
+	if err := provider.IsSupported(cCtx.Context); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return waitForBuildkitdWorker(cCtx, provider)
+}
+
+// resolveWorkspace returns the root of the Please workspace given by
+// 'workspace', or else the one containing the working directory.
+func resolveWorkspace(cCtx *cli.Context) (string, error) {
+	if workspace := cCtx.String("workspace"); workspace != "" {
+		return filepath.Abs(workspace)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	workspace, err := buildkitd.FindWorkspace(wd)
+	if err != nil {
+		return "", fmt.Errorf("%w, use --workspace to set it", err)
+	}
+
+	return workspace, nil
+}
+
+// lockBuildkitdState locks the persistent buildkitd state of the workspace.
+func lockBuildkitdState(cCtx *cli.Context) (*buildkitd.State, error) {
+	workspace, err := resolveWorkspace(cCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	stateDir := cCtx.String("buildkitd_state_dir")
+	if stateDir == "" {
+		stateDir = buildkitd.DefaultStateDir(workspace)
+	}
+
+	state, err := buildkitd.LockState(workspace, stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock buildkitd state of '%s': %w", workspace, err)
+	}
+	log.Info().Str("workspace", workspace).Msgf("using buildkitd state '%s'", state.Name())
+
+	return state, nil
+}
+
+func startBuildkitdWorker(cCtx *cli.Context, configFile string, state *buildkitd.State) (*buildkitd.Worker, *buildkitd.Endpoint, func(), error) {
+	transport := cCtx.String("buildkitd_transport")
+	pullPolicy := cCtx.String("buildkitd_pull_policy")
+	imageTar := cCtx.String("buildkitd_image_tar")
+	imageDigest := cCtx.String("buildkitd_image_digest")
+	runtime, err := buildkitdRuntimeOpts(cCtx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the workspace is only required by some providers, which fail to start
+	// without it.
+	workspace, err := resolveWorkspace(cCtx)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not find workspace")
+	}
+
+	providers := []buildkitd.Provider{}
+	if namespace := cCtx.String("kubernetes_namespace"); namespace != "" {
+		provider, err := kubernetesProvider(cCtx, namespace, configFile, runtime)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		providers = append(providers, provider)
+	}
+
 	chainProvider := buildkitd.NewChainProvider(
 		&buildkitd.ChainProviderOpts{},
-		buildkitd.NewPodmanProvider(&buildkitd.PodmanProviderOpts{
-			Binary: cCtx.String("podman_binary"),
-			Image:  cCtx.String("podman_image"),
-		}),
-		buildkitd.NewRootlessDockerProvider(&buildkitd.RootlessDockerProviderOpts{
-			Binary: cCtx.String("rootless_docker_binary"),
-			Image:  cCtx.String("rootless_docker_image"),
-		}),
-		buildkitd.NewRootDockerProvider(&buildkitd.RootDockerProviderOpts{
-			Binary: cCtx.String("docker_binary"),
-			Image:  cCtx.String("docker_image"),
-		}),
+		append(providers,
+			buildkitd.NewPodmanProvider(&buildkitd.PodmanProviderOpts{
+				Binary:         cCtx.String("podman_binary"),
+				Image:          cCtx.String("podman_image"),
+				Transport:      transport,
+				ConfigFile:     configFile,
+				PullPolicy:     pullPolicy,
+				ImageTar:       imageTar,
+				ImageDigest:    imageDigest,
+				State:          state,
+				Runtime:        runtime,
+				StorageDir:     cCtx.String("podman_storage_dir"),
+				StorageCleanup: cCtx.String("podman_storage_cleanup"),
+				Workspace:      workspace,
+			}),
+			buildkitd.NewRootlessDockerProvider(&buildkitd.RootlessDockerProviderOpts{
+				Binary:      cCtx.String("rootless_docker_binary"),
+				Image:       cCtx.String("rootless_docker_image"),
+				Transport:   transport,
+				ConfigFile:  configFile,
+				PullPolicy:  pullPolicy,
+				ImageTar:    imageTar,
+				ImageDigest: imageDigest,
+				State:       state,
+				Runtime:     runtime,
+			}),
+			buildkitd.NewRootDockerProvider(&buildkitd.RootDockerProviderOpts{
+				Binary:      cCtx.String("docker_binary"),
+				Image:       cCtx.String("docker_image"),
+				Transport:   transport,
+				ConfigFile:  configFile,
+				PullPolicy:  pullPolicy,
+				ImageTar:    imageTar,
+				ImageDigest: imageDigest,
+				State:       state,
+				Runtime:     runtime,
+			}),
+			buildkitd.NewNerdctlProvider(&buildkitd.NerdctlProviderOpts{
+				Binary:        cCtx.String("nerdctl_binary"),
+				Image:         cCtx.String("nerdctl_image"),
+				RootlessImage: cCtx.String("nerdctl_rootless_image"),
+				Transport:     transport,
+				ConfigFile:    configFile,
+				PullPolicy:    pullPolicy,
+				ImageTar:      imageTar,
+				ImageDigest:   imageDigest,
+				State:         state,
+				Runtime:       runtime,
+			}),
+		)...,
 	)
 
-	if err := chainProvider.IsSupported(cCtx.Context); err != nil {
-		return "", nil, fmt.Errorf("no supported buildkitd providers: %w", err)
+	recordIsSupported := stats.Start(cCtx.Context, stats.PhaseIsSupported)
+	err = chainProvider.IsSupported(cCtx.Context)
+	recordIsSupported()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("no supported buildkitd providers: %w", err)
 	}
 
-	address := ""
-	if err := retry.Do(func() error {
-		l, err := net.Listen("tcp", ":0")
+	if cCtx.Bool("buildkitd_gc") {
+		// containers which are still in use are never reaped, so failing to
+		// reap the others should not fail the build.
+		reaped, err := reapContainers(cCtx, &buildkitd.GCOpts{})
+		for _, r := range reaped {
+			log.Info().Str("reason", r.Reason).Msgf("removed orphaned '%s' container", r.Name)
+		}
 		if err != nil {
-			return fmt.Errorf("could not get an available TCP port")
+			log.Warn().Err(err).Msg("could not remove orphaned buildkitd containers")
 		}
+	}
+
+	return waitForBuildkitdWorker(cCtx, chainProvider)
+}
 
-		address = fmt.Sprintf("tcp://0.0.0.0:%d", l.Addr().(*net.TCPAddr).Port)
-		if err := l.Close(); err != nil {
-			return err
+// waitForBuildkitdWorker starts buildkitd with the given supported provider
+// and waits for it to have workers.
+func waitForBuildkitdWorker(cCtx *cli.Context, provider buildkitd.Provider) (*buildkitd.Worker, *buildkitd.Endpoint, func(), error) {
+	tracer := tracing.Tracer()
+	worker := buildkitd.NewWorker(provider, cCtx.Duration("buildkitd_stop_timeout"))
+	stop := func() {
+		ctx, span := tracer.Start(cCtx.Context, "buildkitd stop")
+		err := worker.Stop(ctx)
+		tracing.End(span, err)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not stop provider")
 		}
+	}
 
-		if err := chainProvider.Start(cCtx.Context, address); err != nil {
-			return fmt.Errorf("could not start buildkitd provider: %w", err)
+	ctx, span := tracer.Start(cCtx.Context, "buildkitd start")
+	endpoint, err := worker.Start(ctx)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not start buildkitd provider: %w", err)
+	}
+
+	info := worker.Info()
+	log.Info().
+		Str("provider", info.Name).
+		Str("engine_version", info.EngineVersion).
+		Bool("rootless", info.Rootless).
+		Strs("platforms", info.Platforms).
+		Str("image_digest", info.ImageDigest).
+		Str("address", endpoint.Address).
+		Msg("started buildkitd")
+
+	ctx, span = tracer.Start(cCtx.Context, "buildkitd wait for workers")
+	recordWait := stats.Start(cCtx.Context, stats.PhaseWaitForWorkers)
+	_, err = buildkitd.WaitForBuildKitWorkers(ctx, worker, endpoint, &buildkitd.WaitOpts{
+		BuildctlBinary: cCtx.String("buildctl_binary"),
+		Timeout:        cCtx.Duration("buildkitd_timeout"),
+		Platforms:      cCtx.StringSlice("platform"),
+		Snapshotter:    cCtx.String("buildkitd_snapshotter"),
+	})
+	recordWait()
+	tracing.End(span, err)
+	if err != nil {
+		dumpBuildkitdLogs(worker, cCtx.Int("buildkitd_log_lines"))
+		stop()
+		return nil, nil, nil, fmt.Errorf("could not wait for buildkitd workers: %w", err)
+	}
+
+	return worker, endpoint, stop, nil
+}
+
+// buildkitdLogsTimeout is how long to wait for the logs of buildkitd, which are
+// only dumped when something has already gone wrong.
+const buildkitdLogsTimeout = 10 * time.Second
+
+// dumpBuildkitdLogs writes the given number of last lines of the logs of
+// buildkitd to stderr, e.g. to explain why a build failed. It must be called
+// before buildkitd is stopped, as providers may remove its logs. The logs are
+// still fetched when the build was cancelled, as that is often when they are
+// most useful.
+func dumpBuildkitdLogs(worker *buildkitd.Worker, lines int) {
+	if lines <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), buildkitdLogsTimeout)
+	defer cancel()
+
+	logs, err := worker.Logs(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not get buildkitd logs")
+		return
+	}
+	if len(logs) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "--- buildkitd logs (%s) ---\n%s\n---\n", worker.Info().Name, progress.Tail(string(logs), lines))
+}
+
+// kubernetesProvider returns the Kubernetes provider for the given namespace,
+// configured by the current kubeconfig, or the in-cluster configuration.
+func kubernetesProvider(cCtx *cli.Context, namespace string, configFile string, runtime *buildkitd.RuntimeOpts) (*buildkitd.KubernetesProvider, error) {
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("could not load kubernetes config: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not create kubernetes client: %w", err)
+	}
+
+	return buildkitd.NewKubernetesProvider(&buildkitd.KubernetesProviderOpts{
+		Client:       client,
+		RESTConfig:   restConfig,
+		Namespace:    namespace,
+		Image:        cCtx.String("kubernetes_image"),
+		Connect:      cCtx.String("kubernetes_connect"),
+		ConfigFile:   configFile,
+		StateClaim:   cCtx.String("kubernetes_state_claim"),
+		ReadyTimeout: cCtx.Duration("kubernetes_ready_timeout"),
+		Runtime:      runtime,
+	}), nil
+}
+
+// buildkitdRuntimeOpts returns the resource limits and runtime options of
+// buildkitd from the flags.
+func buildkitdRuntimeOpts(cCtx *cli.Context) (*buildkitd.RuntimeOpts, error) {
+	opts := &buildkitd.RuntimeOpts{
+		CPUs:           cCtx.Float64("buildkitd_cpus"),
+		PidsLimit:      cCtx.Int64("buildkitd_pids_limit"),
+		MaxParallelism: cCtx.Int("buildkitd_max_parallelism"),
+		Env:            cCtx.StringSlice("buildkitd_env"),
+		DNS:            cCtx.StringSlice("buildkitd_dns"),
+		DNSSearch:      cCtx.StringSlice("buildkitd_dns_search"),
+		DNSOptions:     cCtx.StringSlice("buildkitd_dns_option"),
+	}
+
+	if memory := cCtx.String("buildkitd_memory"); memory != "" {
+		var err error
+		opts.Memory, err = buildkitd.ParseMemory(memory)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		return nil
-	},
-		retry.Attempts(10),
-		retry.DelayType(retry.BackOffDelay),
-		retry.Context(cCtx.Context),
-		retry.OnRetry(func(n uint, err error) {
-			log.Warn().Msgf("retrying buildkitd worker start")
-		})); err != nil {
-		return "", nil, err
+	// relative mount sources are relative to the workspace rather than the
+	// build's sandbox.
+	workspace, err := resolveWorkspace(cCtx)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not resolve workspace for buildkitd mounts")
+	}
+	for _, m := range cCtx.StringSlice("buildkitd_mount") {
+		mount, err := buildkitd.ParseMount(m, workspace)
+		if err != nil {
+			return nil, err
+		}
+		opts.Mounts = append(opts.Mounts, mount)
 	}
 
-	if err := buildkitd.WaitForBuildKitWorkers(
-		cCtx.String("buildctl_binary"),
-		address,
-		cCtx.Duration("buildkitd_timeout"),
-	); err != nil {
-		return "", nil, fmt.Errorf("could not wait for buildkitd workers: %w", err)
+	for _, env := range opts.Env {
+		if key, _, ok := strings.Cut(env, "="); !ok || key == "" {
+			return nil, fmt.Errorf("invalid buildkitd env '%s', must be in the form KEY=VALUE", env)
+		}
 	}
 
-	return address, func() {
-		if err := chainProvider.Stop(cCtx.Context); err != nil {
-			log.Error().Err(err).Msgf("could not stop provider")
+	return opts, nil
+}
+
+// buildkitdConfigFile returns the path of the buildkitd.toml to configure
+// buildkitd with, if any, and a function which removes it if it was
+// generated. The given 'buildkitd_config' is used as is, unless settings are
+// also given via flags, in which case they are merged into a generated copy.
+// The garbage collection settings of the state only apply when it is used.
+func buildkitdConfigFile(cCtx *cli.Context, withState bool) (string, func(), error) {
+	noop := func() {}
+
+	path := cCtx.String("buildkitd_config")
+	if path != "" {
+		var err error
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return "", nil, err
 		}
-	}, nil
+	}
+
+	mirrors := cCtx.StringSlice("buildkitd_registry_mirror")
+	insecureRegistries := cCtx.StringSlice("buildkitd_insecure_registry")
+	snapshotter := cCtx.String("buildkitd_snapshotter")
+	var keepStorage int64
+	if withState {
+		keepStorage = cCtx.Int64("buildkitd_state_keep_storage")
+	}
+	if len(mirrors) == 0 && len(insecureRegistries) == 0 && keepStorage == 0 && snapshotter == "" {
+		return path, noop, nil
+	}
+
+	config := buildkitd.NewConfigBuilder()
+	if path != "" {
+		var err error
+		config, err = buildkitd.LoadConfigFile(path)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	for _, m := range mirrors {
+		registry, mirror, ok := strings.Cut(m, "=")
+		if !ok || registry == "" || mirror == "" {
+			return "", nil, fmt.Errorf("invalid registry mirror '%s', must be in the form REGISTRY=MIRROR", m)
+		}
+		config.WithMirrors(registry, mirror)
+	}
+	for _, registry := range insecureRegistries {
+		config.WithInsecureRegistry(registry)
+	}
+	if keepStorage > 0 {
+		config.WithGCKeepStorage(keepStorage)
+	}
+	if snapshotter != "" {
+		config.WithSnapshotter(snapshotter)
+	}
+
+	dir, err := os.MkdirTemp("", "please_buildkit-config-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warn().Err(err).Msgf("could not remove '%s'", dir)
+		}
+	}
+
+	generated := filepath.Join(dir, "buildkitd.toml")
+	if err := config.WriteFile(generated); err != nil {
+		remove()
+		return "", nil, fmt.Errorf("could not write buildkitd config: %w", err)
+	}
+	log.Debug().Str("path", generated).Msg("generated buildkitd config")
+
+	return generated, remove, nil
 }
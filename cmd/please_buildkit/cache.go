@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+func CacheCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "Inspects and trims the persistent buildkitd state of the workspace",
+		Description: `
+These commands start buildkitd with the persistent state of the workspace (see
+'build --buildkitd_state') to report or trim the disk usage of its build cache
+and cache mounts. They fail if a build is using the state.
+`,
+		Subcommands: []*cli.Command{
+			{
+				Name:  "du",
+				Usage: "Reports the disk usage of the build cache",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "verbose",
+						Usage: "list each cache record",
+					},
+				}, buildkitdFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					args := []string{"du"}
+					if cCtx.Bool("verbose") {
+						args = append(args, "--verbose")
+					}
+
+					return runBuildctlWithState(cCtx, args...)
+				},
+			},
+			{
+				Name:  "prune",
+				Usage: "Removes the build cache",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "also remove the cache which is still referenced, e.g. of the base images",
+					},
+					&cli.DurationFlag{
+						Name:  "keep_duration",
+						Usage: "keep the cache which was used more recently than this, e.g. '72h'",
+					},
+					&cli.Int64Flag{
+						Name:  "keep_storage",
+						Usage: "megabytes of the most recently used cache to keep",
+					},
+				}, buildkitdFlags()...),
+				Action: func(cCtx *cli.Context) error {
+					args := []string{"prune"}
+					if cCtx.Bool("all") {
+						args = append(args, "--all")
+					}
+					if d := cCtx.Duration("keep_duration"); d > 0 {
+						args = append(args, "--keep-duration", d.String())
+					}
+					if mb := cCtx.Int64("keep_storage"); mb > 0 {
+						args = append(args, "--keep-storage", strconv.FormatInt(mb, 10))
+					}
+
+					return runBuildctlWithState(cCtx, args...)
+				},
+			},
+		},
+	}
+}
+
+// runBuildctlWithState runs buildctl with the given arguments against
+// buildkitd started with the persistent state of the workspace.
+func runBuildctlWithState(cCtx *cli.Context, args ...string) error {
+	state, err := lockBuildkitdState(cCtx)
+	if err != nil {
+		return err
+	}
+
+	_, endpoint, closeFn, err := startBuildkitdWorkerWithState(cCtx, state)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+
+	cmd := exec.CommandContext(cCtx.Context, cCtx.String("buildctl_binary"), append(endpoint.TLS.BuildctlArgs(), args...)...)
+	cmd.Env = append(os.Environ(), "BUILDKIT_HOST="+endpoint.Address)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not run '%s': %w", strings.Join(cmd.Args, " "), err)
+	}
+
+	return nil
+}
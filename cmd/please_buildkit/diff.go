@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/urfave/cli/v2"
+)
+
+func DiffCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "diff",
+		Usage:     "Compares two image tars or OCI layouts",
+		ArgsUsage: "<a> <b>",
+		Description: `
+This command compares the config fields and layer digests of the given images,
+then walks their layer filesystems (applying whiteouts) to report the files
+which were added, removed or modified between them, with their size deltas.
+
+If '--size_threshold' is given, the command exits with a non-zero exit code
+when image <b> is larger than image <a> by more than the threshold, e.g.
+'10MiB' or '5%'.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text|json)",
+				Value: "text",
+			},
+			&cli.StringFlag{
+				Name:  "size_threshold",
+				Usage: "maximum allowed size increase in bytes, with an optional unit (e.g. 10MiB), or as a percentage (e.g. 5%)",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 2 {
+				return fmt.Errorf("exactly 2 image paths are required")
+			}
+
+			archiveA, err := image.OpenArchive(cCtx.Args().Get(0))
+			if err != nil {
+				return fmt.Errorf("could not open image a: %w", err)
+			}
+			defer archiveA.Close()
+
+			archiveB, err := image.OpenArchive(cCtx.Args().Get(1))
+			if err != nil {
+				return fmt.Errorf("could not open image b: %w", err)
+			}
+			defer archiveB.Close()
+
+			diff, err := image.Diff(archiveA.Image, archiveB.Image)
+			if err != nil {
+				return fmt.Errorf("could not diff images: %w", err)
+			}
+
+			switch format := cCtx.String("format"); format {
+			case "text":
+				if err := diff.WriteText(os.Stdout); err != nil {
+					return err
+				}
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(diff); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("invalid format: %s", format)
+			}
+
+			if threshold := cCtx.String("size_threshold"); threshold != "" {
+				return diff.CheckSizeRegression(threshold)
+			}
+
+			return nil
+		},
+	}
+}
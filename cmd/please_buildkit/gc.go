@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/buildkitd"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func GCCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "gc",
+		Usage: "Removes buildkitd containers left behind by crashed or killed builds",
+		Description: `
+This command finds the buildkitd containers started by please_buildkit, which
+are labelled with the PID and host of the process which started them, and
+removes those whose process is gone. If '--max_age' is given, containers which
+were started longer ago than it are also removed, e.g. those started on other
+hosts sharing the container engine.
+
+The per-build podman storage (unless 'build --podman_storage_dir' is given) of
+processes which are gone is removed in the same way. It is kept per workspace
+in $XDG_DATA_HOME/please-buildkit/podman, so 'gc' must be run in, or given, the
+workspace.
+`,
+		Flags: append([]cli.Flag{
+			&cli.DurationFlag{
+				Name:  "max_age",
+				Usage: "age after which containers are removed even if their process is still running, e.g. '24h'",
+			},
+			&cli.BoolFlag{
+				Name:  "dry_run",
+				Usage: "list the containers which would be removed without removing them",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text|json)",
+				Value: "text",
+			},
+			workspaceFlag(),
+		}, engineBinaryFlags()...),
+		Action: func(cCtx *cli.Context) error {
+			format := cCtx.String("format")
+			if format != "text" && format != "json" {
+				return fmt.Errorf("invalid format: %s", format)
+			}
+
+			reaped, err := reapContainers(cCtx, &buildkitd.GCOpts{
+				MaxAge: cCtx.Duration("max_age"),
+				DryRun: cCtx.Bool("dry_run"),
+			})
+
+			if format == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if encErr := enc.Encode(reaped); encErr != nil {
+					return encErr
+				}
+			} else if writeErr := writeReaped(os.Stdout, reaped); writeErr != nil {
+				return writeErr
+			}
+
+			return err
+		},
+	}
+}
+
+// engineBinaries returns the distinct container engine binaries which the
+// buildkitd providers use.
+func engineBinaries(cCtx *cli.Context) []string {
+	binaries := []string{}
+	seen := map[string]struct{}{}
+	for _, flag := range []string{"podman_binary", "rootless_docker_binary", "docker_binary", "nerdctl_binary"} {
+		binary := cCtx.String(flag)
+		if _, ok := seen[binary]; ok || binary == "" {
+			continue
+		}
+		seen[binary] = struct{}{}
+		binaries = append(binaries, binary)
+	}
+
+	return binaries
+}
+
+// reapContainers garbage collects the buildkitd containers of each of the
+// container engines, and podman's per-build storage. Engines which are not
+// available are skipped.
+func reapContainers(cCtx *cli.Context, opts *buildkitd.GCOpts) ([]*buildkitd.Reaped, error) {
+	reaped := []*buildkitd.Reaped{}
+	var errs []error
+	for _, binary := range engineBinaries(cCtx) {
+		if _, err := exec.LookPath(binary); err != nil {
+			log.Debug().Err(err).Msgf("skipping '%s'", binary)
+			continue
+		}
+
+		r, err := buildkitd.GC(cCtx.Context, binary, opts)
+		reaped = append(reaped, r...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not garbage collect '%s' containers: %w", binary, err))
+		}
+	}
+
+	if podman := cCtx.String("podman_binary"); podman != "" {
+		if _, err := exec.LookPath(podman); err == nil {
+			if workspace, err := resolveWorkspace(cCtx); err != nil {
+				log.Warn().Err(err).Msg("skipping podman storage")
+			} else {
+				r, err := buildkitd.GCPodmanStorage(cCtx.Context, podman, workspace, opts)
+				reaped = append(reaped, r...)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("could not garbage collect podman storage: %w", err))
+				}
+			}
+		}
+	}
+
+	return reaped, errors.Join(errs...)
+}
+
+func writeReaped(w io.Writer, reaped []*buildkitd.Reaped) error {
+	if len(reaped) == 0 {
+		_, err := fmt.Fprintln(w, "no orphaned containers")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tOWNER\tSTARTED\tREASON")
+	for _, r := range reaped {
+		owner := "-"
+		if r.OwnerPID > 0 {
+			owner = fmt.Sprintf("%d@%s", r.OwnerPID, r.OwnerHost)
+		}
+		started := "-"
+		if !r.StartedAt.IsZero() {
+			started = r.StartedAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, owner, started, r.Reason)
+	}
+
+	return tw.Flush()
+}
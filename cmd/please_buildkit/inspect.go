@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/urfave/cli/v2"
+)
+
+func InspectCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "inspect",
+		Usage:     "Inspects the given image tar or OCI layout",
+		ArgsUsage: "<tar|oci-layout>",
+		Description: `
+This command prints the manifest, config, layers and repo tags of the given
+image without requiring a container engine. It reads the same formats that the
+'build' command writes, i.e. 'docker load' compatible tarballs, as well as OCI
+image layout directories and tarballs.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text|json|digest)",
+				Value: "text",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return fmt.Errorf("exactly 1 image path is required")
+			}
+
+			archive, err := image.OpenArchive(cCtx.Args().First())
+			if err != nil {
+				return fmt.Errorf("could not open image: %w", err)
+			}
+			defer archive.Close()
+
+			inspection, err := image.Inspect(archive.Image, archive.RepoTags)
+			if err != nil {
+				return fmt.Errorf("could not inspect image: %w", err)
+			}
+
+			switch format := cCtx.String("format"); format {
+			case "text":
+				return inspection.WriteText(os.Stdout)
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(inspection)
+			case "digest":
+				_, err := fmt.Fprintln(os.Stdout, inspection.Digest)
+				return err
+			default:
+				return fmt.Errorf("invalid format: %s", format)
+			}
+		},
+	}
+}
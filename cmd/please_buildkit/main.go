@@ -5,26 +5,46 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/VJftw/please-buildkit/pkg/buildkitd"
+	"github.com/VJftw/please-buildkit/pkg/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/urfave/cli/v2"
 )
 
+const (
+	tracingShutdownTimeout = 5 * time.Second
+	// killTimeout is how long buildkitd workers are given to be killed on a
+	// second stop signal.
+	killTimeout = 10 * time.Second
+)
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		c := make(chan os.Signal, 1)
+		c := make(chan os.Signal, 2)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 		sig := <-c
 		log.Info().Str("signal", sig.String()).Msg("received a stop signal, stopping...")
 		cancel()
+
+		// buildkitd workers are stopped gracefully once the build is
+		// cancelled, unless the user is no longer willing to wait.
+		sig = <-c
+		log.Warn().Str("signal", sig.String()).Msg("received a second stop signal, killing...")
+		killCtx, killCancel := context.WithTimeout(context.Background(), killTimeout)
+		buildkitd.KillAll(killCtx)
+		killCancel()
+		os.Exit(1)
 	}()
 
+	var finishTracing func(error)
 	app := &cli.App{
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -37,11 +57,29 @@ func main() {
 				Value:   "console",
 				EnvVars: []string{"LOG_FORMAT"},
 			},
+			&cli.StringFlag{
+				Name:  "otel_endpoint",
+				Usage: "OTLP/HTTP endpoint to export traces to, e.g. 'http://localhost:4318'. The OTEL_EXPORTER_OTLP_* environment variables are also supported",
+			},
+			&cli.StringFlag{
+				Name:    "traceparent",
+				Usage:   "W3C traceparent of a parent span, e.g. a CI pipeline's, to continue",
+				EnvVars: []string{"TRACEPARENT"},
+			},
 		},
 		Commands: []*cli.Command{
 			BuildCommand(),
+			AssembleCommand(),
 			PushCommand(),
 			ReplaceCommand(),
+			VerifyCommand(),
+			VerifyReproducibleCommand(),
+			InspectCommand(),
+			DiffCommand(),
+			TestCommand(),
+			StatsCommand(),
+			GCCommand(),
+			CacheCommand(),
 		},
 		Before: func(cCtx *cli.Context) error {
 			level, err := zerolog.ParseLevel(cCtx.String("log_level"))
@@ -60,11 +98,40 @@ func main() {
 				return fmt.Errorf("invalid format: %s", v)
 			}
 
-			return nil
+			finishTracing, err = startTracing(cCtx)
+			return err
 		},
 	}
 
-	if err := app.RunContext(ctx, os.Args); err != nil {
+	err := app.RunContext(ctx, os.Args)
+	if finishTracing != nil {
+		finishTracing(err)
+	}
+	if err != nil {
 		log.Fatal().Msgf("%s", err)
 	}
 }
+
+// startTracing sets up the export of traces and starts the root span of this
+// invocation, which all other spans are children of. The returned function
+// ends the root span and flushes the exported spans.
+func startTracing(cCtx *cli.Context) (func(error), error) {
+	shutdown, err := tracing.Setup(cCtx.Context, cCtx.String("otel_endpoint"))
+	if err != nil {
+		return nil, fmt.Errorf("could not set up tracing: %w", err)
+	}
+
+	ctx := tracing.ContextWithTraceParent(cCtx.Context, cCtx.String("traceparent"))
+	ctx, span := tracing.Tracer().Start(ctx, strings.TrimSpace("please_buildkit "+cCtx.Args().First()))
+	cCtx.Context = ctx
+
+	return func(err error) {
+		tracing.End(span, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("could not export traces")
+		}
+	}, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 
 	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/urfave/cli/v2"
 )
 
@@ -36,6 +38,16 @@ For example, given an image tar tagged with 'index.docker.io/my-repo:my-tag':
   	 Will push the image to "index.docker.io/my-repo:other-tag".
   4. ` + "`" + `$ push "localhost:5000"` + "`" + `:
      Will push the image to "localhost:5000/my-repo:my-tag".
+
+Images may optionally be signed when pushed by providing a 'signing_key' or a
+'signing_plugin'. This pushes cosign compatible signatures to
+'<repository>:sha256-<digest>.sig' next to each pushed image which may be
+verified with the 'verify' command.
+
+Attestations written by the 'build' command may be given via 'attestation_path'.
+These are attached to each pushed image as OCI referrers so that they are
+discoverable by downstream tooling. Each statement's subject must be the digest
+of the pushed image, otherwise the push fails.
 `,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -50,6 +62,25 @@ For example, given an image tar tagged with 'index.docker.io/my-repo:my-tag':
 				Name:     "fqn_tags_path",
 				Required: true,
 			},
+			&cli.StringFlag{
+				Name:    "signing_key",
+				Usage:   "path to a PEM encoded private key to sign pushed images with",
+				EnvVars: []string{"PLEASE_BUILDKIT_SIGNING_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "signing_key_password",
+				Usage:   "password for an encrypted cosign 'signing_key'",
+				EnvVars: []string{"COSIGN_PASSWORD"},
+			},
+			&cli.StringFlag{
+				Name:    "signing_plugin",
+				Usage:   "binary which implements '<binary> sign' and '<binary> public-key' to sign pushed images with",
+				EnvVars: []string{"PLEASE_BUILDKIT_SIGNING_PLUGIN"},
+			},
+			&cli.StringSliceFlag{
+				Name:  "attestation_path",
+				Usage: "path to newline delimited in-toto statements to attach to pushed images",
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
 			userProviderRepoTags := cCtx.Args().Slice()
@@ -61,11 +92,46 @@ For example, given an image tar tagged with 'index.docker.io/my-repo:my-tag':
 
 			imageRepoTagsToPush := image.TranslateUserProvidedRepoTags(imageTags, userProviderRepoTags)
 
+			signer, err := signerFromFlags(cCtx)
+			if err != nil {
+				return err
+			}
+
+			attestations := []*image.Attestation{}
+			for _, attestationPath := range cCtx.StringSlice("attestation_path") {
+				a, err := image.LoadAttestations(attestationPath)
+				if err != nil {
+					return fmt.Errorf("could not load attestations: %w", err)
+				}
+				attestations = append(attestations, a...)
+			}
+
 			imagePusher := image.NewPusher(&image.PusherOpts{
-				CraneTool: cCtx.String("crane_tool"),
+				CraneTool:    cCtx.String("crane_tool"),
+				Signer:       signer,
+				Attestations: attestations,
+				RemoteOptions: []remote.Option{
+					remote.WithAuthFromKeychain(authn.DefaultKeychain),
+				},
 			})
 
 			return imagePusher.PushTar(cCtx.Context, cCtx.String("img_tar_path"), imageRepoTagsToPush)
 		},
 	}
 }
+
+func signerFromFlags(cCtx *cli.Context) (image.Signer, error) {
+	switch {
+	case cCtx.String("signing_key") != "" && cCtx.String("signing_plugin") != "":
+		return nil, fmt.Errorf("only one of 'signing_key' or 'signing_plugin' may be set")
+	case cCtx.String("signing_key") != "":
+		return image.LoadKeySigner(
+			cCtx.String("signing_key"),
+			[]byte(cCtx.String("signing_key_password")),
+		)
+	case cCtx.String("signing_plugin") != "":
+		return image.NewPluginSigner(cCtx.String("signing_plugin")), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/urfave/cli/v2"
+)
+
+func StatsCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "stats",
+		Usage:     "Aggregates the timing and cache statistics of many builds",
+		ArgsUsage: "[dir]",
+		Description: `
+This command finds all of the build statistics reports ('*.stats.json', see
+'build --stats_out') in the given directory, 'plz-out' by default, and
+summarises the time spent in each phase of the builds, e.g. starting buildkitd
+versus pulling images versus solving, and how many steps were cached.
+
+Reports are only written by 'buildkit_image' targets with 'stats = True'.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text|json)",
+				Value: "text",
+			},
+			&cli.IntFlag{
+				Name:  "slowest",
+				Usage: "number of the slowest builds to list",
+				Value: 10,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			root := "plz-out"
+			if cCtx.NArg() > 0 {
+				root = cCtx.Args().First()
+			}
+
+			reports, err := stats.FindReports(root)
+			if err != nil {
+				return fmt.Errorf("could not find build stats: %w", err)
+			}
+
+			summary := stats.Aggregate(reports, cCtx.Int("slowest"))
+
+			switch format := cCtx.String("format"); format {
+			case "text":
+				return summary.WriteText(os.Stdout)
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(summary)
+			default:
+				return fmt.Errorf("invalid format: %s", format)
+			}
+		},
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/urfave/cli/v2"
+)
+
+func TestCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "test",
+		Usage:     "Runs structure tests against the given image tar or OCI layout",
+		ArgsUsage: "<tar|oci-layout>",
+		Description: `
+This command checks the given image against a YAML or JSON spec without
+requiring a container engine. The spec may assert that files exist with given
+permissions and owners, that file contents match regular expressions, the
+image's entrypoint, cmd, user, working dir, env and exposed ports, and a
+maximum image size, e.g.:
+
+  fileExistenceTests:
+    - path: /app/server
+      permissions: -rwxr-xr-x
+      uid: 0
+  fileContentTests:
+    - path: /etc/passwd
+      expectedContents: ["^root:"]
+  metadataTest:
+    entrypoint: ["/app/server"]
+    user: "65535"
+    env:
+      - key: PATH
+        value: ".*/usr/bin.*"
+        isRegex: true
+    exposedPorts: ["8080/tcp"]
+  maxSize: 50MiB
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "spec",
+				Usage:    "path to the YAML or JSON structure test spec",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "output format (text|json)",
+				Value: "text",
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() != 1 {
+				return fmt.Errorf("exactly 1 image path is required")
+			}
+
+			spec, err := image.LoadStructureTestSpec(cCtx.String("spec"))
+			if err != nil {
+				return fmt.Errorf("could not load spec: %w", err)
+			}
+
+			archive, err := image.OpenArchive(cCtx.Args().First())
+			if err != nil {
+				return fmt.Errorf("could not open image: %w", err)
+			}
+			defer archive.Close()
+
+			results, err := image.RunStructureTests(archive.Image, spec)
+			if err != nil {
+				return fmt.Errorf("could not run tests: %w", err)
+			}
+
+			switch format := cCtx.String("format"); format {
+			case "text":
+				if err := image.WriteStructureTestResults(os.Stdout, results); err != nil {
+					return err
+				}
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(results); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("invalid format: %s", format)
+			}
+
+			failed := 0
+			for _, r := range results {
+				if !r.Passed() {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d/%d tests failed", failed, len(results))
+			}
+
+			return nil
+		},
+	}
+}
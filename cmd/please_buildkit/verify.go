@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func VerifyCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "verify",
+		Usage:     "Verifies the signatures of the given image references",
+		ArgsUsage: "<reference>...",
+		Description: `
+This command verifies the cosign compatible signatures of the given image
+references against the given 'public_key'. These signatures are found at
+'<repository>:sha256-<digest>.sig' as pushed by the 'push' command.
+
+An error is returned if any of the given references do not have at least 1
+valid signature.
+`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "public_key",
+				Usage:    "path to a PEM encoded public key to verify signatures with",
+				Required: true,
+				EnvVars:  []string{"PLEASE_BUILDKIT_PUBLIC_KEY"},
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if cCtx.NArg() < 1 {
+				return fmt.Errorf("at least 1 image reference is required")
+			}
+
+			publicKeyPath := cCtx.String("public_key")
+			publicKeyBytes, err := os.ReadFile(publicKeyPath)
+			if err != nil {
+				return fmt.Errorf("could not read '%s': %w", publicKeyPath, err)
+			}
+
+			publicKey, err := image.ParsePublicKey(publicKeyBytes)
+			if err != nil {
+				return fmt.Errorf("could not parse '%s': %w", publicKeyPath, err)
+			}
+
+			for _, arg := range cCtx.Args().Slice() {
+				ref, err := name.ParseReference(arg)
+				if err != nil {
+					return fmt.Errorf("could not parse '%s': %w", arg, err)
+				}
+
+				payloads, err := image.VerifyImageSignatures(
+					cCtx.Context,
+					ref,
+					publicKey,
+					remote.WithAuthFromKeychain(authn.DefaultKeychain),
+				)
+				if err != nil {
+					return fmt.Errorf("could not verify '%s': %w", ref, err)
+				}
+
+				for _, payload := range payloads {
+					log.Info().
+						Str("reference", ref.String()).
+						Str("digest", payload.Critical.Image.DockerManifestDigest).
+						Msg("verified signature")
+				}
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func VerifyReproducibleCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "verify-reproducible",
+		Usage: "Builds a Docker Image twice and verifies that both builds are identical",
+		Description: `
+This command builds the image twice in reproducible mode (see 'build') and
+compares the digests of the results. If they differ, the differences between
+the two builds are printed and the command exits with a non-zero exit code.
+`,
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "image_out",
+				Usage: "optional path to write the first build to",
+			},
+		}, buildFlags()...),
+		Action: func(cCtx *cli.Context) error {
+			b, err := newBuilder(cCtx)
+			if err != nil {
+				return err
+			}
+			defer b.Close()
+			b.reproducible = true
+
+			worker, endpoint, closeFn, err := StartBuildkitdWorker(cCtx)
+			if err != nil {
+				return err
+			}
+			defer closeFn()
+			b.worker = worker
+			b.endpoint = endpoint
+
+			paths := []string{
+				filepath.Join(b.workDir, "a.tar"),
+				filepath.Join(b.workDir, "b.tar"),
+			}
+			if outImagePath := cCtx.String("image_out"); outImagePath != "" {
+				paths[0] = outImagePath
+			}
+			archives := make([]*image.Archive, len(paths))
+			for i, path := range paths {
+				if err := b.build(cCtx, "docker", path); err != nil {
+					return err
+				}
+
+				archives[i], err = image.OpenArchive(path)
+				if err != nil {
+					return fmt.Errorf("could not open build %d: %w", i+1, err)
+				}
+				defer archives[i].Close()
+			}
+
+			digestA, err := archives[0].Image.Digest()
+			if err != nil {
+				return err
+			}
+			digestB, err := archives[1].Image.Digest()
+			if err != nil {
+				return err
+			}
+
+			if digestA != digestB {
+				diff, err := image.Diff(archives[0].Image, archives[1].Image)
+				if err != nil {
+					return fmt.Errorf("could not diff builds: %w", err)
+				}
+				if err := diff.WriteText(os.Stdout); err != nil {
+					return err
+				}
+
+				return fmt.Errorf("builds are not reproducible: %s != %s", digestA, digestB)
+			}
+
+			log.Info().
+				Str("digest", digestA.String()).
+				Msg("builds are reproducible")
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,182 @@
+package buildcontext
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/moby/patternmatcher"
+	"github.com/moby/patternmatcher/ignorefile"
+)
+
+const dockerignoreFile = ".dockerignore"
+
+// Stats represents statistics about a build context.
+type Stats struct {
+	Files    int
+	Dirs     int
+	Bytes    int64
+	Excluded int
+}
+
+// LoadIgnorePatterns returns the exclude patterns which apply to the build
+// context at the given root for the given Dockerfile, which is relative to the
+// root. As srcs keep their paths relative to the root of the repository, the
+// ignore files are found next to the Dockerfile, i.e. in its package: a
+// `<Dockerfile>.dockerignore` takes precedence over a `.dockerignore`, like
+// BuildKit. Patterns are relative to the root of the context. The path of the
+// ignore file which was used is returned, or an empty string if there is none.
+func LoadIgnorePatterns(root string, dockerfile string) ([]string, string, error) {
+	candidates := []string{
+		filepath.Join(root, dockerfile+dockerignoreFile),
+		filepath.Join(root, filepath.Dir(dockerfile), dockerignoreFile),
+	}
+
+	for _, path := range candidates {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+
+		patterns, err := ignorefile.ReadAll(f)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not read '%s': %w", path, err)
+		}
+
+		return patterns, path, nil
+	}
+
+	return nil, "", nil
+}
+
+// Create populates the given directory with the given srcs, which are paths
+// relative to the given root, excluding any which match the given patterns.
+// Directories are added recursively and symlinks are resolved, as Please may
+// stage srcs as symlinks to outside of the context. Files are hard-linked
+// where possible, falling back to copying, so that the srcs are never
+// modified.
+func Create(dir string, root string, srcs []string, excludes []string) (*Stats, error) {
+	pm, err := patternmatcher.New(excludes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude patterns: %w", err)
+	}
+
+	c := &creator{dir: dir, root: root, pm: pm, stats: &Stats{}}
+	for _, src := range srcs {
+		if err := c.add(filepath.Clean(src)); err != nil {
+			return nil, fmt.Errorf("could not add '%s': %w", src, err)
+		}
+	}
+
+	return c.stats, nil
+}
+
+type creator struct {
+	dir   string
+	root  string
+	pm    *patternmatcher.PatternMatcher
+	stats *Stats
+}
+
+func (c *creator) add(rel string) error {
+	src := filepath.Join(c.root, rel)
+	dest := filepath.Join(c.dir, rel)
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	excluded, err := c.pm.MatchesOrParentMatches(filepath.ToSlash(rel))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if excluded {
+			c.stats.Excluded++
+		} else {
+			if err := os.MkdirAll(dest, 0o755); err != nil {
+				return err
+			}
+			c.stats.Dirs++
+		}
+
+		// children of excluded directories are still walked as exclusions
+		// may be negated for them.
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := c.add(filepath.Join(rel, e.Name())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case excluded:
+		c.stats.Excluded++
+		return nil
+	case info.Mode().IsRegular():
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return err
+		}
+
+		resolved, err := filepath.EvalSymlinks(src)
+		if err != nil {
+			return err
+		}
+
+		added, err := linkOrCopy(dest, resolved, info.Mode())
+		if err != nil {
+			return err
+		}
+		if added {
+			c.stats.Files++
+			c.stats.Bytes += info.Size()
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported file type '%s' of '%s'", info.Mode().Type(), rel)
+}
+
+// linkOrCopy hard-links, or copies, the given src to the given dest. It
+// returns false if the dest already exists, e.g. from overlapping srcs.
+func linkOrCopy(dest string, src string, mode fs.FileMode) (bool, error) {
+	if _, err := os.Lstat(dest); err == nil {
+		return false, nil
+	}
+
+	if err := os.Link(src, dest); err == nil {
+		return true, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return false, err
+	}
+
+	return true, out.Close()
+}
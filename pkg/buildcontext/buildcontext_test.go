@@ -0,0 +1,126 @@
+package buildcontext_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/buildcontext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	for path, contents := range files {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+	}
+}
+
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+
+	files := []string{}
+	require.NoError(t, filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	}))
+	sort.Strings(files)
+
+	return files
+}
+
+func TestLoadIgnorePatterns(t *testing.T) {
+	root := t.TempDir()
+
+	patterns, path, err := buildcontext.LoadIgnorePatterns(root, "pkg/Dockerfile")
+	require.NoError(t, err)
+	assert.Empty(t, patterns)
+	assert.Empty(t, path)
+
+	// only the ignore files in the Dockerfile's package apply.
+	writeFiles(t, root, map[string]string{
+		".dockerignore": "*.go\n",
+	})
+	patterns, path, err = buildcontext.LoadIgnorePatterns(root, "pkg/Dockerfile")
+	require.NoError(t, err)
+	assert.Empty(t, patterns)
+	assert.Empty(t, path)
+
+	writeFiles(t, root, map[string]string{
+		"pkg/.dockerignore": "pkg/*.md\n",
+	})
+	patterns, path, err = buildcontext.LoadIgnorePatterns(root, "pkg/Dockerfile")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pkg/*.md"}, patterns)
+	assert.Equal(t, filepath.Join(root, "pkg/.dockerignore"), path)
+
+	writeFiles(t, root, map[string]string{
+		"pkg/Dockerfile.dockerignore": "# comment\npkg/tmp\n!pkg/tmp/keep\n",
+	})
+	patterns, path, err = buildcontext.LoadIgnorePatterns(root, "pkg/Dockerfile")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pkg/tmp", "!pkg/tmp/keep"}, patterns)
+	assert.Equal(t, filepath.Join(root, "pkg/Dockerfile.dockerignore"), path)
+}
+
+func TestCreate(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"pkg/main.go":      "package main",
+		"pkg/README.md":    "# readme",
+		"pkg/tmp/cache":    "cache",
+		"pkg/tmp/keep":     "keep",
+		"pkg/undeclared":   "undeclared",
+		"other/data.txt":   "data",
+		"outside/real.txt": "real",
+	})
+	require.NoError(t, os.Symlink(filepath.Join(root, "outside/real.txt"), filepath.Join(root, "other/link.txt")))
+
+	dir := t.TempDir()
+	stats, err := buildcontext.Create(dir, root, []string{
+		"pkg/main.go",
+		"pkg/README.md",
+		"pkg/tmp",
+		"other",
+	}, []string{"**/*.md", "pkg/tmp", "!pkg/tmp/keep"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"other/data.txt",
+		"other/link.txt",
+		"pkg/main.go",
+		"pkg/tmp/keep",
+	}, listFiles(t, dir))
+
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, int64(len("data")+len("real")+len("package main")+len("keep")), stats.Bytes)
+	assert.Equal(t, 3, stats.Excluded)
+
+	// symlinks are resolved.
+	info, err := os.Lstat(filepath.Join(dir, "other/link.txt"))
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+
+	// srcs are left untouched.
+	contents, err := os.ReadFile(filepath.Join(root, "pkg/main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package main", string(contents))
+}
+
+func TestCreateMissingSrc(t *testing.T) {
+	_, err := buildcontext.Create(t.TempDir(), t.TempDir(), []string{"missing"}, nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,151 @@
+package buildkitd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// containerConfigPath is where the buildkitd configuration is mounted inside
+// of the container.
+const containerConfigPath = "/etc/buildkit/buildkitd.toml"
+
+// ConfigBuilder builds a `buildkitd.toml`, optionally on top of an existing
+// one, from common settings. See
+// https://github.com/moby/buildkit/blob/master/docs/buildkitd.toml.md.
+type ConfigBuilder struct {
+	config map[string]any
+}
+
+// NewConfigBuilder returns a new ConfigBuilder for an empty configuration.
+func NewConfigBuilder() *ConfigBuilder {
+	return &ConfigBuilder{config: map[string]any{}}
+}
+
+// LoadConfigFile returns a new ConfigBuilder for the configuration in the
+// given `buildkitd.toml`. Settings which are not supported by the builder are
+// kept as they are.
+func LoadConfigFile(path string) (*ConfigBuilder, error) {
+	b := NewConfigBuilder()
+	if _, err := toml.DecodeFile(path, &b.config); err != nil {
+		return nil, fmt.Errorf("could not decode '%s': %w", path, err)
+	}
+
+	return b, nil
+}
+
+// WithDebug enables debug logging of buildkitd.
+func (b *ConfigBuilder) WithDebug() *ConfigBuilder {
+	b.config["debug"] = true
+	return b
+}
+
+// WithMirrors adds the given mirrors of the given registry, e.g. `docker.io`.
+func (b *ConfigBuilder) WithMirrors(registry string, mirrors ...string) *ConfigBuilder {
+	r := b.table("registry", registry)
+	existing, _ := r["mirrors"].([]any)
+	for _, m := range mirrors {
+		existing = append(existing, m)
+	}
+	r["mirrors"] = existing
+
+	return b
+}
+
+// WithInsecureRegistry allows the given registry, e.g. `localhost:5000`, to
+// be accessed over plain HTTP or with an untrusted certificate.
+func (b *ConfigBuilder) WithInsecureRegistry(registry string) *ConfigBuilder {
+	r := b.table("registry", registry)
+	r["http"] = true
+	r["insecure"] = true
+
+	return b
+}
+
+// WithMaxParallelism limits the number of build steps which are run in
+// parallel.
+func (b *ConfigBuilder) WithMaxParallelism(n int) *ConfigBuilder {
+	b.table("worker", "oci")["max-parallelism"] = n
+	return b
+}
+
+// WithGCKeepStorage enables garbage collection of the build cache of the
+// worker, keeping up to the given number of megabytes.
+func (b *ConfigBuilder) WithGCKeepStorage(megabytes int64) *ConfigBuilder {
+	w := b.table("worker", "oci")
+	w["gc"] = true
+	w["gckeepstorage"] = megabytes
+
+	return b
+}
+
+// WithSnapshotter sets the snapshotter of the worker, e.g. `overlayfs` or
+// `native`.
+func (b *ConfigBuilder) WithSnapshotter(snapshotter string) *ConfigBuilder {
+	b.table("worker", "oci")["snapshotter"] = snapshotter
+	return b
+}
+
+// Build returns the configuration as TOML.
+func (b *ConfigBuilder) Build() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(b.config); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// WriteFile writes the configuration as TOML to the given path. It is made
+// readable by all users so that buildkitd containers which do not run as the
+// current user can read it.
+func (b *ConfigBuilder) WriteFile(path string) error {
+	config, err := b.Build()
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, config, 0o644); err != nil {
+		return err
+	}
+
+	return os.Chmod(path, 0o644)
+}
+
+// table returns the nested table at the given keys, creating it if
+// necessary.
+func (b *ConfigBuilder) table(keys ...string) map[string]any {
+	t := b.config
+	for _, k := range keys {
+		next, ok := t[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			t[k] = next
+		}
+		t = next
+	}
+
+	return t
+}
+
+// configRunArgs returns the arguments to `<engine> run` which mount the given
+// configuration file into the container, if any.
+func configRunArgs(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	return []string{"--volume", fmt.Sprintf("%s:%s:ro", path, containerConfigPath)}
+}
+
+// configBuildkitdArgs returns the arguments to buildkitd which make it use
+// the mounted configuration file, if any.
+func configBuildkitdArgs(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	return []string{"--config", containerConfigPath}
+}
@@ -0,0 +1,101 @@
+package buildkitd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigBuilder(t *testing.T) {
+	config, err := NewConfigBuilder().
+		WithDebug().
+		WithMirrors("docker.io", "mirror.gcr.io").
+		WithMirrors("docker.io", "mirror.example.com").
+		WithInsecureRegistry("localhost:5000").
+		WithMaxParallelism(4).
+		WithGCKeepStorage(10000).
+		WithSnapshotter("native").
+		Build()
+	require.NoError(t, err)
+
+	decoded := map[string]any{}
+	_, err = toml.Decode(string(config), &decoded)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"debug": true,
+		"registry": map[string]any{
+			"docker.io": map[string]any{
+				"mirrors": []any{"mirror.gcr.io", "mirror.example.com"},
+			},
+			"localhost:5000": map[string]any{
+				"http":     true,
+				"insecure": true,
+			},
+		},
+		"worker": map[string]any{
+			"oci": map[string]any{
+				"max-parallelism": int64(4),
+				"gc":              true,
+				"gckeepstorage":   int64(10000),
+				"snapshotter":     "native",
+			},
+		},
+	}, decoded)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buildkitd.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+[worker.oci]
+  gc = false
+
+[worker.containerd]
+  enabled = false
+
+[registry."docker.io"]
+  mirrors = ["mirror.gcr.io"]
+`), 0o600))
+
+	b, err := LoadConfigFile(path)
+	require.NoError(t, err)
+
+	generated := filepath.Join(dir, "generated.toml")
+	require.NoError(t, b.WithMirrors("docker.io", "mirror.example.com").WithMaxParallelism(2).WriteFile(generated))
+
+	info, err := os.Stat(generated)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+
+	decoded := map[string]any{}
+	_, err = toml.DecodeFile(generated, &decoded)
+	require.NoError(t, err)
+
+	// settings which the builder does not support are kept.
+	assert.Equal(t, map[string]any{"enabled": false}, decoded["worker"].(map[string]any)["containerd"])
+	assert.Equal(t, map[string]any{"gc": false, "max-parallelism": int64(2)}, decoded["worker"].(map[string]any)["oci"])
+	assert.Equal(t,
+		[]any{"mirror.gcr.io", "mirror.example.com"},
+		decoded["registry"].(map[string]any)["docker.io"].(map[string]any)["mirrors"],
+	)
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buildkitd.toml")
+	require.NoError(t, os.WriteFile(path, []byte("debug = "), 0o600))
+
+	_, err := LoadConfigFile(path)
+	assert.Error(t, err)
+}
+
+func TestConfigArgs(t *testing.T) {
+	assert.Empty(t, configRunArgs(""))
+	assert.Empty(t, configBuildkitdArgs(""))
+
+	assert.Equal(t, []string{"--volume", "/tmp/buildkitd.toml:/etc/buildkit/buildkitd.toml:ro"}, configRunArgs("/tmp/buildkitd.toml"))
+	assert.Equal(t, []string{"--config", "/etc/buildkit/buildkitd.toml"}, configBuildkitdArgs("/tmp/buildkitd.toml"))
+}
@@ -0,0 +1,50 @@
+package buildkitd
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// containerEngine runs the CLI of a container engine, e.g. docker or podman.
+type containerEngine struct {
+	binary string
+	// globalArgs are given before the subcommand of every command, e.g.
+	// podman's storage options.
+	globalArgs []string
+}
+
+// command returns the command to run the given subcommand and arguments with.
+func (e *containerEngine) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, e.binary, append(append([]string{}, e.globalArgs...), args...)...)
+}
+
+// describe fills in the details of the given info which the engine knows
+// about buildkitd run from the given image. The engine's version is the
+// output of the given subcommand and arguments. This is best effort, so
+// details which cannot be determined are left empty.
+func (e *containerEngine) describe(ctx context.Context, info *ProviderInfo, imageRef string, versionArgs ...string) {
+	versionCmd := e.command(ctx, versionArgs...)
+	if out, err := versionCmd.CombinedOutput(); err != nil {
+		log.Debug().Err(err).Strs("cmd", versionCmd.Args).Msgf("could not get engine version: %s", out)
+	} else {
+		info.EngineVersion = strings.TrimSpace(string(out))
+	}
+
+	details, err := inspectImage(ctx, e, imageRef)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not inspect buildkitd image")
+		return
+	}
+	// prefer the registry's manifest digest, as Kubernetes reports, over the
+	// engine's image ID, which is only used for images loaded from tarballs.
+	info.ImageDigest = details.RepoDigest
+	if info.ImageDigest == "" {
+		info.ImageDigest = "sha256:" + details.ID
+	}
+	if details.Platform != "" {
+		info.Platforms = []string{details.Platform}
+	}
+}
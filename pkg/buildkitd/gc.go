@@ -0,0 +1,233 @@
+package buildkitd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The labels which every container started by a provider is labelled with,
+// so that containers left behind by crashed or killed builds can be found and
+// reaped by GC.
+const (
+	labelPrefix = "dev.vjftw.please-buildkit."
+	// LabelSessionID is the ID of the please_buildkit process which started
+	// the container.
+	LabelSessionID = labelPrefix + "session-id"
+	// LabelOwnerPID is the PID of the please_buildkit process which started
+	// the container.
+	LabelOwnerPID = labelPrefix + "owner-pid"
+	// LabelOwnerHost is the hostname of the host which the owner runs on, as
+	// its PID is meaningless on other hosts sharing the container engine.
+	LabelOwnerHost = labelPrefix + "owner-host"
+	// LabelStartedAt is when the container was started, in RFC 3339 format.
+	LabelStartedAt = labelPrefix + "started-at"
+)
+
+var (
+	sessionIDOnce sync.Once
+	sessionID     string
+)
+
+// SessionID returns the ID of this please_buildkit process.
+func SessionID() string {
+	sessionIDOnce.Do(func() {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			// the session ID is only informational, so fall back to the PID.
+			sessionID = strconv.Itoa(os.Getpid())
+			return
+		}
+		sessionID = hex.EncodeToString(b)
+	})
+
+	return sessionID
+}
+
+// labelRunArgs returns the arguments to label a container run by this
+// process with.
+func labelRunArgs() []string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Debug().Err(err).Msg("could not get hostname, not labelling container with it")
+	}
+
+	labels := []string{
+		LabelSessionID + "=" + SessionID(),
+		LabelOwnerPID + "=" + strconv.Itoa(os.Getpid()),
+		LabelStartedAt + "=" + time.Now().UTC().Format(time.RFC3339),
+	}
+	if hostname != "" {
+		labels = append(labels, LabelOwnerHost+"="+hostname)
+	}
+
+	args := make([]string, 0, 2*len(labels))
+	for _, label := range labels {
+		args = append(args, "--label", label)
+	}
+
+	return args
+}
+
+// Container represents a container started by a provider.
+type Container struct {
+	Name      string    `json:"name"`
+	SessionID string    `json:"session_id"`
+	OwnerPID  int       `json:"owner_pid,omitempty"`
+	OwnerHost string    `json:"owner_host,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+// newContainer returns the container with the given name and labels. Missing
+// or malformed labels are left as their zero values.
+func newContainer(name string, labels map[string]string) *Container {
+	c := &Container{
+		Name:      name,
+		SessionID: labels[LabelSessionID],
+		OwnerHost: labels[LabelOwnerHost],
+	}
+
+	if pid, err := strconv.Atoi(labels[LabelOwnerPID]); err == nil {
+		c.OwnerPID = pid
+	}
+	if startedAt, err := time.Parse(time.RFC3339, labels[LabelStartedAt]); err == nil {
+		c.StartedAt = startedAt
+	}
+
+	return c
+}
+
+// ListContainers returns the containers started by a provider, including
+// stopped ones, which the given container engine knows about.
+func ListContainers(ctx context.Context, binary string) ([]*Container, error) {
+	return listContainers(ctx, &containerEngine{binary: binary})
+}
+
+func listContainers(ctx context.Context, engine *containerEngine) ([]*Container, error) {
+	psCmd := engine.command(ctx,
+		"ps", "--all",
+		"--filter", "label="+LabelSessionID,
+		"--format", "{{.Names}}",
+	)
+	psOut, err := psCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not run '%s': %w", strings.Join(psCmd.Args, " "), err)
+	}
+
+	containers := []*Container{}
+	for _, name := range strings.Fields(string(psOut)) {
+		inspectCmd := engine.command(ctx,
+			"inspect", "--format", "{{json .Config.Labels}}", name,
+		)
+		inspectOut, err := inspectCmd.Output()
+		if err != nil {
+			// the container may have been removed since it was listed.
+			log.Debug().Err(err).Msgf("could not inspect '%s' container", name)
+			continue
+		}
+
+		labels := map[string]string{}
+		if err := json.Unmarshal(inspectOut, &labels); err != nil {
+			return nil, fmt.Errorf("could not parse labels of '%s' container: %w", name, err)
+		}
+
+		containers = append(containers, newContainer(name, labels))
+	}
+
+	return containers, nil
+}
+
+// GCOpts represents the options for GC.
+type GCOpts struct {
+	// MaxAge is the age after which containers are reaped regardless of
+	// whether their owner is still running, or 0 to only reap containers whose
+	// owner is gone.
+	MaxAge time.Duration
+	// DryRun lists the containers which would be reaped without removing
+	// them.
+	DryRun bool
+}
+
+// Reaped represents a container which has been reaped by GC.
+type Reaped struct {
+	*Container
+	Reason string `json:"reason"`
+}
+
+// GC removes the containers started by a provider which have been left behind
+// by a crashed or killed please_buildkit process, i.e. whose owner is gone or
+// which are older than the maximum age. It returns the containers which were
+// reaped.
+func GC(ctx context.Context, binary string, opts *GCOpts) ([]*Reaped, error) {
+	engine := &containerEngine{binary: binary}
+	containers, err := listContainers(ctx, engine)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Debug().Err(err).Msg("could not get hostname, only reaping containers by age")
+	}
+
+	reaped := []*Reaped{}
+	var errs []error
+	for _, c := range containers {
+		reason, ok := c.orphaned(time.Now(), opts.MaxAge, hostname, processExists)
+		if !ok {
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := killContainer(ctx, engine, c.Name); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		reaped = append(reaped, &Reaped{Container: c, Reason: reason})
+	}
+
+	return reaped, errors.Join(errs...)
+}
+
+// orphaned returns why the container should be reaped, if it should be. The
+// owner PID is only checked when the owner runs on the given host. A reused
+// PID keeps the container alive until it exceeds the maximum age.
+func (c *Container) orphaned(
+	now time.Time,
+	maxAge time.Duration,
+	hostname string,
+	exists func(pid int) bool,
+) (string, bool) {
+	if hostname != "" && c.OwnerHost == hostname && c.OwnerPID > 0 && !exists(c.OwnerPID) {
+		return fmt.Sprintf("owner process %d is gone", c.OwnerPID), true
+	}
+
+	if maxAge > 0 && !c.StartedAt.IsZero() {
+		if age := now.Sub(c.StartedAt); age > maxAge {
+			return fmt.Sprintf("started %s ago, exceeding the maximum age of %s", age.Round(time.Second), maxAge), true
+		}
+	}
+
+	return "", false
+}
+
+// processExists returns whether a process with the given PID exists on this
+// host.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,143 @@
+package buildkitd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerOrphaned(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	exists := func(pid int) bool { return pid == 1 }
+
+	tests := []struct {
+		name       string
+		container  *Container
+		maxAge     time.Duration
+		wantReason string
+	}{
+		{
+			name:      "owner running",
+			container: &Container{OwnerPID: 1, OwnerHost: "host", StartedAt: now.Add(-48 * time.Hour)},
+		},
+		{
+			name:       "owner gone",
+			container:  &Container{OwnerPID: 2, OwnerHost: "host", StartedAt: now},
+			wantReason: "owner process 2 is gone",
+		},
+		{
+			name:      "owner on another host",
+			container: &Container{OwnerPID: 2, OwnerHost: "other", StartedAt: now},
+		},
+		{
+			name:       "older than max age",
+			container:  &Container{OwnerPID: 1, OwnerHost: "host", StartedAt: now.Add(-2 * time.Hour)},
+			maxAge:     time.Hour,
+			wantReason: "started 2h0m0s ago, exceeding the maximum age of 1h0m0s",
+		},
+		{
+			name:       "older than max age on another host",
+			container:  &Container{OwnerPID: 2, OwnerHost: "other", StartedAt: now.Add(-2 * time.Hour)},
+			maxAge:     time.Hour,
+			wantReason: "started 2h0m0s ago, exceeding the maximum age of 1h0m0s",
+		},
+		{
+			name:      "younger than max age",
+			container: &Container{OwnerPID: 1, OwnerHost: "host", StartedAt: now.Add(-30 * time.Minute)},
+			maxAge:    time.Hour,
+		},
+		{
+			name:      "missing labels",
+			container: &Container{},
+			maxAge:    time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, ok := tt.container.orphaned(now, tt.maxAge, "host", exists)
+			assert.Equal(t, tt.wantReason != "", ok)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func TestLabelRunArgs(t *testing.T) {
+	args := labelRunArgs()
+
+	labels := map[string]string{}
+	for i := 0; i < len(args); i += 2 {
+		require.Equal(t, "--label", args[i])
+		k, v, ok := strings.Cut(args[i+1], "=")
+		require.True(t, ok)
+		labels[k] = v
+	}
+
+	c := newContainer("please-buildkit-test", labels)
+	assert.Equal(t, SessionID(), c.SessionID)
+	assert.Equal(t, os.Getpid(), c.OwnerPID)
+	assert.WithinDuration(t, time.Now(), c.StartedAt, time.Minute)
+}
+
+func TestGC(t *testing.T) {
+	engine := newFakeEngine(t)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	// a process which has exited and been waited for is gone.
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	gonePID := exited.ProcessState.Pid()
+
+	addContainer := func(name string, pid int) {
+		labels, err := json.Marshal(map[string]string{
+			LabelSessionID: "session-" + name,
+			LabelOwnerPID:  strconv.Itoa(pid),
+			LabelOwnerHost: hostname,
+			LabelStartedAt: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(engine.dir, "labels-"+name), labels, 0o644))
+
+		f, err := os.OpenFile(filepath.Join(engine.dir, "containers"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.WriteString(name + "\n")
+		require.NoError(t, err)
+	}
+	addContainer("please-buildkit-orphaned", gonePID)
+	addContainer("please-buildkit-running", os.Getpid())
+
+	t.Run("dry run", func(t *testing.T) {
+		reaped, err := GC(context.Background(), engine.binary, &GCOpts{DryRun: true})
+		require.NoError(t, err)
+		require.Len(t, reaped, 1)
+		assert.Equal(t, "please-buildkit-orphaned", reaped[0].Name)
+		assert.NotContains(t, engine.calls(t), "rm --force please-buildkit-orphaned")
+	})
+
+	t.Run("owner gone", func(t *testing.T) {
+		reaped, err := GC(context.Background(), engine.binary, &GCOpts{})
+		require.NoError(t, err)
+		require.Len(t, reaped, 1)
+		assert.Equal(t, "please-buildkit-orphaned", reaped[0].Name)
+		assert.Contains(t, engine.calls(t), "rm --force please-buildkit-orphaned")
+		assert.NotContains(t, engine.calls(t), "rm --force please-buildkit-running")
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		reaped, err := GC(context.Background(), engine.binary, &GCOpts{MaxAge: time.Second})
+		require.NoError(t, err)
+		assert.Len(t, reaped, 2)
+		assert.Contains(t, engine.calls(t), "rm --force please-buildkit-running")
+	})
+}
@@ -0,0 +1,190 @@
+package buildkitd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/rs/zerolog/log"
+)
+
+// Pull policies for the buildkitd image.
+const (
+	// PullPolicyAlways pulls the image before every start.
+	PullPolicyAlways = "always"
+	// PullPolicyIfNotPresent only pulls the image if the engine does not
+	// already have it.
+	PullPolicyIfNotPresent = "if-not-present"
+	// PullPolicyNever never pulls the image, which the engine must already
+	// have, e.g. on air-gapped hosts.
+	PullPolicyNever = "never"
+)
+
+// PullPolicies are all of the supported pull policies.
+var PullPolicies = []string{PullPolicyAlways, PullPolicyIfNotPresent, PullPolicyNever}
+
+// prepareImage makes the given buildkitd image available to the given
+// container engine according to the given pull policy and returns the
+// reference to run it by. If an image tarball is given, it is loaded instead
+// of pulling the image. The tarball must contain the image with the given
+// digest, or else the digest the reference is pinned to, e.g.
+// `moby/buildkit@sha256:...`, and the image the engine loaded is verified to
+// be the one in the tarball.
+func prepareImage(
+	ctx context.Context,
+	engine *containerEngine,
+	ref string,
+	pullPolicy string,
+	imageTar string,
+	digest string,
+) (string, error) {
+	switch pullPolicy {
+	case "", PullPolicyAlways, PullPolicyIfNotPresent, PullPolicyNever:
+	default:
+		return "", fmt.Errorf("invalid pull policy '%s', must be one of: %s", pullPolicy, strings.Join(PullPolicies, ", "))
+	}
+
+	defer stats.Start(ctx, stats.PhaseImagePull)()
+
+	if imageTar != "" {
+		if _, pinned, ok := strings.Cut(ref, "@"); ok && digest == "" {
+			digest = pinned
+		}
+
+		return loadImage(ctx, engine, pullPolicy, imageTar, digest)
+	}
+
+	if pullPolicy == PullPolicyIfNotPresent || pullPolicy == PullPolicyNever {
+		if _, err := inspectImageID(ctx, engine, ref); err == nil {
+			log.Info().Msgf("using present image '%s'", ref)
+			return ref, nil
+		} else if pullPolicy == PullPolicyNever {
+			return "", fmt.Errorf("image '%s' is not present and the pull policy is '%s': %w", ref, PullPolicyNever, err)
+		}
+	}
+
+	log.Info().Msgf("pulling image '%s'", ref)
+	pullCmd := engine.command(ctx, "pull", ref)
+	if out, err := pullCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("could not run '%s': %w\n%s", strings.Join(pullCmd.Args, " "), err, out)
+	}
+
+	return ref, nil
+}
+
+// loadImage loads the given image tarball into the given container engine,
+// unless it is already present and the pull policy allows it to be reused,
+// and returns its image ID to run it by. The image in the tarball must have
+// the given config or manifest digest.
+func loadImage(ctx context.Context, engine *containerEngine, pullPolicy string, imageTar string, digest string) (string, error) {
+	if digest == "" {
+		return "", fmt.Errorf("a digest is required to verify buildkitd image tarball '%s', set one or pin the image by digest", imageTar)
+	}
+	expected, err := v1.NewHash(digest)
+	if err != nil {
+		return "", fmt.Errorf("invalid buildkitd image digest '%s': %w", digest, err)
+	}
+
+	archive, err := image.OpenArchive(imageTar)
+	if err != nil {
+		return "", fmt.Errorf("could not open buildkitd image tarball: %w", err)
+	}
+	defer archive.Close()
+
+	// engines identify images by the digest of their config.
+	configName, err := archive.Image.ConfigName()
+	if err != nil {
+		return "", err
+	}
+	id := configName.Hex
+
+	// the manifest digest only matches the registry's if the tarball kept the
+	// original manifest, e.g. an OCI layout, so either digest is accepted.
+	manifestDigest, err := archive.Image.Digest()
+	if err != nil {
+		return "", err
+	}
+	if expected != configName && expected != manifestDigest {
+		return "", fmt.Errorf("buildkitd image tarball '%s' has config digest '%s' and manifest digest '%s', expected '%s'",
+			imageTar, configName, manifestDigest, expected)
+	}
+
+	if pullPolicy == PullPolicyIfNotPresent {
+		if _, err := inspectImageID(ctx, engine, id); err == nil {
+			log.Info().Msgf("using present image '%s'", id)
+			return id, nil
+		}
+	}
+
+	log.Info().Msgf("loading image '%s'", imageTar)
+	loadCmd := engine.command(ctx, "load", "--input", imageTar)
+	if out, err := loadCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("could not run '%s': %w\n%s", strings.Join(loadCmd.Args, " "), err, out)
+	}
+
+	// images are content addressed, so the engine only has an image with the
+	// expected ID if it loaded the image in the tarball.
+	if _, err := inspectImageID(ctx, engine, id); err != nil {
+		return "", fmt.Errorf("could not verify loaded image '%s' has ID '%s': %w", imageTar, id, err)
+	}
+
+	return id, nil
+}
+
+// inspectImageID returns the hex image ID of the given image in the given
+// container engine, or an error if it is not present.
+func inspectImageID(ctx context.Context, engine *containerEngine, ref string) (string, error) {
+	inspectCmd := engine.command(ctx, "image", "inspect", "--format", "{{.Id}}", ref)
+	out, err := inspectCmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("could not run '%s': %w\n%s", strings.Join(inspectCmd.Args, " "), err, out)
+	}
+
+	// docker prefixes image IDs with their algorithm, podman does not.
+	return strings.TrimPrefix(strings.TrimSpace(string(out)), "sha256:"), nil
+}
+
+// imageDetails are the details of an image in a container engine.
+type imageDetails struct {
+	// ID is the hex image ID.
+	ID string
+	// Platform is the platform of the image, e.g. `linux/amd64`, if known.
+	Platform string
+	// RepoDigest is the manifest digest of the image in the registry it was
+	// pulled from, e.g. `sha256:...`, if known. Images loaded from tarballs
+	// have none.
+	RepoDigest string
+}
+
+// inspectImage returns the details of the given image in the given container
+// engine, or an error if it is not present.
+func inspectImage(ctx context.Context, engine *containerEngine, ref string) (*imageDetails, error) {
+	// RepoDigests are ranged over as indexing them fails for images without
+	// any.
+	inspectCmd := engine.command(ctx, "image", "inspect", "--format", "{{.Id}} {{.Os}}/{{.Architecture}} {{range .RepoDigests}}{{.}} {{end}}", ref)
+	out, err := inspectCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("could not run '%s': %w\n%s", strings.Join(inspectCmd.Args, " "), err, out)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("could not parse output of '%s': %s", strings.Join(inspectCmd.Args, " "), out)
+	}
+
+	details := &imageDetails{ID: strings.TrimPrefix(fields[0], "sha256:")}
+	if len(fields) > 1 && fields[1] != "/" {
+		details.Platform = fields[1]
+	}
+	// repo digests are e.g. `docker.io/moby/buildkit@sha256:...`.
+	if len(fields) > 2 {
+		if _, digest, ok := strings.Cut(fields[2], "@"); ok {
+			details.RepoDigest = digest
+		}
+	}
+
+	return details, nil
+}
@@ -0,0 +1,339 @@
+package buildkitd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEngineScript is a stand-in for a container engine which records its
+// calls and tracks which images, containers and volumes it has in files in
+// $FAKE_ENGINE_DIR. Podman's storage options are ignored. The subcommand
+// named by $FAKE_ENGINE_FAIL fails, `run` blocks for $FAKE_ENGINE_RUN_SLEEP
+// seconds, if set, rather than starting a container, `stop` sleeps for
+// $FAKE_ENGINE_STOP_SLEEP seconds, `info` reports a rootless engine if
+// $FAKE_ENGINE_ROOTLESS is set and images have the repo digests in
+// $FAKE_ENGINE_REPO_DIGESTS.
+// Containers are running unless their state is written to state-<name>.
+const fakeEngineScript = `#!/bin/sh
+echo "$*" >> "$FAKE_ENGINE_DIR/calls"
+while [ "$1" = "--root" ] || [ "$1" = "--runroot" ]; do
+	shift 2
+done
+if [ "$1" = "$FAKE_ENGINE_FAIL" ]; then
+	echo "Error: $1 failed" >&2
+	exit 1
+fi
+case "$1" in
+pull)
+	echo "$2" >> "$FAKE_ENGINE_DIR/images"
+	;;
+load)
+	echo "$FAKE_ENGINE_LOAD_ID" >> "$FAKE_ENGINE_DIR/images"
+	;;
+image)
+	ref="$5"
+	if grep -qx "$ref" "$FAKE_ENGINE_DIR/images" 2>/dev/null; then
+		case "$4" in
+		*Os*) echo "sha256:$ref linux/amd64 $FAKE_ENGINE_REPO_DIGESTS" ;;
+		*) echo "sha256:$ref" ;;
+		esac
+		exit 0
+	fi
+	echo "Error: No such image: $ref" >&2
+	exit 1
+	;;
+run)
+	if [ -n "$FAKE_ENGINE_RUN_SLEEP" ]; then
+		exec sleep "$FAKE_ENGINE_RUN_SLEEP"
+	fi
+	echo "0123456789abcdef"
+	;;
+port)
+	echo "127.0.0.1:49153"
+	;;
+logs)
+	echo "buildkitd logs of $2"
+	;;
+version)
+	echo "24.0.5"
+	;;
+info)
+	echo "name=seccomp,profile=default"
+	if [ -n "$FAKE_ENGINE_ROOTLESS" ]; then
+		echo "name=rootless"
+	fi
+	;;
+unshare)
+	shift
+	exec "$@"
+	;;
+volume)
+	if [ "$2" = "create" ]; then
+		echo "$5" >> "$FAKE_ENGINE_DIR/volumes"
+		exit 0
+	fi
+	grep -qx "$3" "$FAKE_ENGINE_DIR/volumes" 2>/dev/null
+	;;
+ps)
+	cat "$FAKE_ENGINE_DIR/containers" 2>/dev/null
+	;;
+inspect)
+	case "$3" in
+	*State*) cat "$FAKE_ENGINE_DIR/state-$4" 2>/dev/null || echo "running 0" ;;
+	*) cat "$FAKE_ENGINE_DIR/labels-$4" ;;
+	esac
+	;;
+stop)
+	exec sleep "${FAKE_ENGINE_STOP_SLEEP:-0}"
+	;;
+esac
+`
+
+type fakeEngine struct {
+	binary string
+	dir    string
+}
+
+func newFakeEngine(t *testing.T, images ...string) *fakeEngine {
+	t.Helper()
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "engine")
+	require.NoError(t, os.WriteFile(binary, []byte(fakeEngineScript), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "images"), []byte(strings.Join(images, "\n")+"\n"), 0o644))
+	t.Setenv("FAKE_ENGINE_DIR", dir)
+
+	return &fakeEngine{binary: binary, dir: dir}
+}
+
+func (e *fakeEngine) containerEngine() *containerEngine {
+	return &containerEngine{binary: e.binary}
+}
+
+func (e *fakeEngine) calls(t *testing.T) []string {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join(e.dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+const testImage = "moby/buildkit:master"
+
+func TestPrepareImagePullPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		policy    string
+		present   bool
+		wantCalls []string
+		wantErr   bool
+	}{
+		{
+			name:      "always pulls",
+			policy:    PullPolicyAlways,
+			present:   true,
+			wantCalls: []string{"pull " + testImage},
+		},
+		{
+			name:      "default pulls",
+			policy:    "",
+			wantCalls: []string{"pull " + testImage},
+		},
+		{
+			name:      "if-not-present uses present image",
+			policy:    PullPolicyIfNotPresent,
+			present:   true,
+			wantCalls: []string{"image inspect --format {{.Id}} " + testImage},
+		},
+		{
+			name:      "if-not-present pulls missing image",
+			policy:    PullPolicyIfNotPresent,
+			wantCalls: []string{"image inspect --format {{.Id}} " + testImage, "pull " + testImage},
+		},
+		{
+			name:      "never uses present image",
+			policy:    PullPolicyNever,
+			present:   true,
+			wantCalls: []string{"image inspect --format {{.Id}} " + testImage},
+		},
+		{
+			name:      "never fails for missing image",
+			policy:    PullPolicyNever,
+			wantCalls: []string{"image inspect --format {{.Id}} " + testImage},
+			wantErr:   true,
+		},
+		{
+			name:    "invalid",
+			policy:  "sometimes",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			images := []string{}
+			if tt.present {
+				images = append(images, testImage)
+			}
+			engine := newFakeEngine(t, images...)
+
+			ref, err := prepareImage(ctx, engine.containerEngine(), testImage, tt.policy, "", "")
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testImage, ref)
+			}
+			assert.Equal(t, tt.wantCalls, engine.calls(t))
+		})
+	}
+}
+
+func TestPrepareImageTar(t *testing.T) {
+	ctx := context.Background()
+
+	img, err := random.Image(64, 1)
+	require.NoError(t, err)
+	configName, err := img.ConfigName()
+	require.NoError(t, err)
+	id := configName.Hex
+	digest := configName.String()
+	manifestDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	imageTar := filepath.Join(t.TempDir(), "buildkit.tar")
+	require.NoError(t, tarball.WriteToFile(imageTar, name.MustParseReference(testImage), img))
+
+	t.Run("loads and verifies", func(t *testing.T) {
+		engine := newFakeEngine(t)
+		t.Setenv("FAKE_ENGINE_LOAD_ID", id)
+
+		ref, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, imageTar, digest)
+		require.NoError(t, err)
+		assert.Equal(t, id, ref)
+		assert.Equal(t, []string{
+			"load --input " + imageTar,
+			"image inspect --format {{.Id}} " + id,
+		}, engine.calls(t))
+	})
+
+	t.Run("manifest digest", func(t *testing.T) {
+		engine := newFakeEngine(t)
+		t.Setenv("FAKE_ENGINE_LOAD_ID", id)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, imageTar, manifestDigest.String())
+		require.NoError(t, err)
+	})
+
+	t.Run("digest of pinned image", func(t *testing.T) {
+		engine := newFakeEngine(t)
+		t.Setenv("FAKE_ENGINE_LOAD_ID", id)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), "moby/buildkit@"+manifestDigest.String(), PullPolicyAlways, imageTar, "")
+		require.NoError(t, err)
+	})
+
+	t.Run("if-not-present uses present image", func(t *testing.T) {
+		engine := newFakeEngine(t, id)
+
+		ref, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyIfNotPresent, imageTar, digest)
+		require.NoError(t, err)
+		assert.Equal(t, id, ref)
+		assert.Equal(t, []string{"image inspect --format {{.Id}} " + id}, engine.calls(t))
+	})
+
+	t.Run("never still loads", func(t *testing.T) {
+		engine := newFakeEngine(t)
+		t.Setenv("FAKE_ENGINE_LOAD_ID", id)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyNever, imageTar, digest)
+		require.NoError(t, err)
+	})
+
+	t.Run("other image in tarball", func(t *testing.T) {
+		engine := newFakeEngine(t)
+		t.Setenv("FAKE_ENGINE_LOAD_ID", id)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, imageTar, "sha256:"+strings.Repeat("0", 64))
+		assert.ErrorContains(t, err, "expected 'sha256:"+strings.Repeat("0", 64)+"'")
+		assert.Empty(t, engine.calls(t))
+	})
+
+	t.Run("no digest", func(t *testing.T) {
+		engine := newFakeEngine(t)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, imageTar, "")
+		assert.ErrorContains(t, err, "a digest is required")
+		assert.Empty(t, engine.calls(t))
+	})
+
+	t.Run("invalid digest", func(t *testing.T) {
+		engine := newFakeEngine(t)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, imageTar, id)
+		assert.ErrorContains(t, err, "invalid buildkitd image digest")
+	})
+
+	t.Run("loaded image mismatch", func(t *testing.T) {
+		engine := newFakeEngine(t)
+		t.Setenv("FAKE_ENGINE_LOAD_ID", strings.Repeat("0", 64))
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, imageTar, digest)
+		assert.ErrorContains(t, err, "could not verify loaded image")
+	})
+
+	t.Run("missing tarball", func(t *testing.T) {
+		engine := newFakeEngine(t)
+
+		_, err := prepareImage(ctx, engine.containerEngine(), testImage, PullPolicyAlways, filepath.Join(t.TempDir(), "missing.tar"), digest)
+		assert.Error(t, err)
+		assert.Empty(t, engine.calls(t))
+	})
+}
+
+func TestContainerEngineDescribe(t *testing.T) {
+	tests := []struct {
+		name        string
+		repoDigests string
+		wantDigest  string
+	}{
+		{
+			name:        "pulled image reports the registry digest",
+			repoDigests: "docker.io/moby/buildkit@sha256:0123 docker.io/moby/buildkit@sha256:4567",
+			wantDigest:  "sha256:0123",
+		},
+		{
+			name:       "loaded image reports the image ID",
+			wantDigest: "sha256:" + testImage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, testImage)
+			t.Setenv("FAKE_ENGINE_REPO_DIGESTS", tt.repoDigests)
+
+			info := &ProviderInfo{}
+			engine.containerEngine().describe(context.Background(), info, testImage, "version")
+			assert.Equal(t, &ProviderInfo{
+				EngineVersion: "24.0.5",
+				Platforms:     []string{"linux/amd64"},
+				ImageDigest:   tt.wantDigest,
+			}, info)
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package buildkitd
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Transports that providers can expose buildkitd over.
+const (
+	// TransportTCP publishes buildkitd on a host port chosen by the container
+	// engine, bound to 127.0.0.1.
+	TransportTCP = "tcp"
+	// TransportUnix binds buildkitd to a unix socket on a volume shared with
+	// the host.
+	TransportUnix = "unix"
+)
+
+// Transports are all of the supported transports.
+var Transports = []string{TransportTCP, TransportUnix}
+
+const (
+	// containerPort is the port buildkitd listens on inside of its container
+	// for TransportTCP.
+	containerPort = "1234"
+	// containerSocketDir is where the host's socket directory is mounted
+	// inside of the container for TransportUnix.
+	containerSocketDir = "/run/please-buildkit"
+	socketName         = "buildkitd.sock"
+	// containerTLSDir is where the server's TLS credentials are mounted
+	// inside of the container for TransportTCP.
+	containerTLSDir = "/run/please-buildkit-tls"
+	// maxSocketPathLen is the longest unix socket path that fits in
+	// `sun_path`, which is 108 bytes on Linux and 104 bytes on macOS,
+	// including its terminating NUL.
+	maxSocketPathLen = 103
+)
+
+// tlsHosts are the hosts the server certificate of buildkitd is valid for.
+var tlsHosts = []string{"127.0.0.1", "::1", "localhost"}
+
+// listener configures how buildkitd listens in its container and how it is
+// reached from the host. buildkitd is only reachable over TCP with mutual TLS
+// using credentials which are generated for each listener.
+type listener struct {
+	transport string
+	// dir is a private directory for the socket or TLS credentials. Unix
+	// socket paths are limited to ~100 characters, so it is kept short, see
+	// listenerBaseDir.
+	dir    string
+	server *TLSCredentials
+	client *TLSCredentials
+}
+
+// newListener returns a listener for the given transport.
+func newListener(transport string) (*listener, error) {
+	switch transport {
+	case TransportTCP, TransportUnix:
+	default:
+		return nil, fmt.Errorf("invalid transport '%s', must be one of: %s", transport, strings.Join(Transports, ", "))
+	}
+
+	dir, err := os.MkdirTemp(listenerBaseDir(), "pbk-")
+	if err != nil {
+		return nil, err
+	}
+	l := &listener{transport: transport, dir: dir}
+
+	if socket := filepath.Join(dir, socketName); transport == TransportUnix && len(socket) > maxSocketPathLen {
+		l.Close()
+		return nil, fmt.Errorf("unix socket path '%s' is longer than %d characters, set XDG_RUNTIME_DIR to a shorter directory or use the '%s' transport",
+			socket, maxSocketPathLen, TransportTCP)
+	}
+
+	if transport == TransportTCP {
+		l.server, l.client, err = GenerateTLSCredentials(dir, tlsHosts)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("could not generate TLS credentials: %w", err)
+		}
+	}
+
+	return l, nil
+}
+
+// listenerBaseDir returns the directory to create listeners' private
+// directories in. $TMPDIR is avoided as Please sets it to the deeply nested
+// directory of the build action, which is too long for unix socket paths.
+func listenerBaseDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+
+	return "/tmp"
+}
+
+// runArgs returns the arguments to `<engine> run` which expose buildkitd to
+// the host.
+func (l *listener) runArgs() []string {
+	if l.transport == TransportUnix {
+		return []string{"--volume", fmt.Sprintf("%s:%s", l.dir, containerSocketDir)}
+	}
+
+	args := []string{"--publish", fmt.Sprintf("127.0.0.1::%s", containerPort)}
+	// only the server's files are mounted, not the client's key.
+	for _, path := range []string{l.server.CACert, l.server.Cert, l.server.Key} {
+		args = append(args, "--volume", fmt.Sprintf("%s:%s:ro", path, containerTLSPath(path)))
+	}
+
+	return args
+}
+
+// buildkitdArgs returns the arguments to buildkitd which make it listen on
+// the transport.
+func (l *listener) buildkitdArgs() []string {
+	if l.transport == TransportUnix {
+		return []string{
+			"--addr", fmt.Sprintf("unix://%s/%s", containerSocketDir, socketName),
+			// the socket is created by root in the container, so it is made
+			// accessible to the host user's group.
+			"--group", fmt.Sprintf("%d", os.Getgid()),
+		}
+	}
+
+	args := []string{"--addr", fmt.Sprintf("tcp://0.0.0.0:%s", containerPort)}
+	return append(args, (&TLSCredentials{
+		CACert: containerTLSPath(l.server.CACert),
+		Cert:   containerTLSPath(l.server.Cert),
+		Key:    containerTLSPath(l.server.Key),
+	}).BuildkitdArgs()...)
+}
+
+// clientTLS returns the credentials to connect to buildkitd with, or nil if
+// none are required. It is safe to call on a nil listener.
+func (l *listener) clientTLS() *TLSCredentials {
+	if l == nil {
+		return nil
+	}
+
+	return l.client
+}
+
+// containerTLSPath returns the path of the given host TLS file inside of the
+// container.
+func containerTLSPath(path string) string {
+	return containerTLSDir + "/" + filepath.Base(path)
+}
+
+// address returns the address of buildkitd in the given container from the
+// host, e.g. `tcp://127.0.0.1:49153`.
+func (l *listener) address(ctx context.Context, engine *containerEngine, name string) (string, error) {
+	if l.transport == TransportUnix {
+		return fmt.Sprintf("unix://%s", filepath.Join(l.dir, socketName)), nil
+	}
+
+	portCmd := engine.command(ctx, "port", name, containerPort+"/tcp")
+	portOut, err := portCmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("could not run '%s': %w\n%s", strings.Join(portCmd.Args, " "), err, portOut)
+	}
+
+	hostPort, err := parsePortOutput(string(portOut))
+	if err != nil {
+		return "", err
+	}
+
+	return "tcp://" + hostPort, nil
+}
+
+// endpoint returns how to connect to buildkitd in the given container from
+// the host.
+func (l *listener) endpoint(ctx context.Context, engine *containerEngine, name string) (*Endpoint, error) {
+	address, err := l.address(ctx, engine, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Endpoint{Address: address, TLS: l.clientTLS(), Transport: l.transport}, nil
+}
+
+// Close removes any resources of the listener from the host. It is safe to
+// call on a nil listener, e.g. if the provider was never started.
+func (l *listener) Close() {
+	if l == nil {
+		return
+	}
+
+	if err := os.RemoveAll(l.dir); err != nil {
+		log.Warn().Err(err).Msgf("could not remove '%s'", l.dir)
+	}
+}
+
+// parsePortOutput returns the first host address in the output of `<engine>
+// port`, e.g. `127.0.0.1:49153`. Unspecified hosts are replaced with
+// 127.0.0.1.
+func parsePortOutput(out string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(line)
+		if err == nil {
+			_, err = strconv.ParseUint(port, 10, 16)
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not parse published port '%s': %w", line, err)
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+
+		return net.JoinHostPort(host, port), nil
+	}
+
+	return "", fmt.Errorf("no published port found")
+}
+
+// containerName returns a unique name for a buildkitd container.
+func containerName() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "please-buildkit-" + hex.EncodeToString(b), nil
+}
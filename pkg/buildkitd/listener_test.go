@@ -0,0 +1,96 @@
+package buildkitd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortOutput(t *testing.T) {
+	tests := []struct {
+		out  string
+		want string
+	}{
+		{out: "127.0.0.1:49153\n", want: "127.0.0.1:49153"},
+		{out: "0.0.0.0:49153\n[::]:49153\n", want: "127.0.0.1:49153"},
+		{out: "\n[::]:49154\n", want: "127.0.0.1:49154"},
+	}
+	for _, tt := range tests {
+		got, err := parsePortOutput(tt.out)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+
+	_, err := parsePortOutput("")
+	assert.Error(t, err)
+	_, err = parsePortOutput("Error: no public port")
+	assert.Error(t, err)
+}
+
+func TestListener(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		l, err := newListener(TransportTCP)
+		require.NoError(t, err)
+		defer l.Close()
+
+		assert.Equal(t, []string{
+			"--publish", "127.0.0.1::1234",
+			"--volume", filepath.Join(l.dir, "ca.pem") + ":/run/please-buildkit-tls/ca.pem:ro",
+			"--volume", filepath.Join(l.dir, "server.pem") + ":/run/please-buildkit-tls/server.pem:ro",
+			"--volume", filepath.Join(l.dir, "server-key.pem") + ":/run/please-buildkit-tls/server-key.pem:ro",
+		}, l.runArgs())
+		assert.Equal(t, []string{
+			"--addr", "tcp://0.0.0.0:1234",
+			"--tlscacert", "/run/please-buildkit-tls/ca.pem",
+			"--tlscert", "/run/please-buildkit-tls/server.pem",
+			"--tlskey", "/run/please-buildkit-tls/server-key.pem",
+		}, l.buildkitdArgs())
+		assert.Equal(t, filepath.Join(l.dir, "client.pem"), l.clientTLS().Cert)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		runtimeDir := t.TempDir()
+		t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+		l, err := newListener(TransportUnix)
+		require.NoError(t, err)
+		assert.Equal(t, runtimeDir, filepath.Dir(l.dir))
+
+		assert.Equal(t, []string{"--volume", l.dir + ":/run/please-buildkit"}, l.runArgs())
+		assert.Contains(t, l.buildkitdArgs(), "unix:///run/please-buildkit/buildkitd.sock")
+		assert.Nil(t, l.clientTLS())
+
+		addr, err := l.address(context.Background(), &containerEngine{binary: "unused"}, "unused")
+		require.NoError(t, err)
+		assert.Equal(t, "unix://"+filepath.Join(l.dir, "buildkitd.sock"), addr)
+
+		l.Close()
+		_, err = os.Stat(l.dir)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("unix socket path too long", func(t *testing.T) {
+		runtimeDir := filepath.Join(t.TempDir(), strings.Repeat("a", maxSocketPathLen))
+		require.NoError(t, os.Mkdir(runtimeDir, 0o700))
+		t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+		_, err := newListener(TransportUnix)
+		assert.ErrorContains(t, err, "longer than")
+		entries, err := os.ReadDir(runtimeDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newListener("udp")
+		assert.Error(t, err)
+	})
+
+	// closing a listener of a provider which was never started is a no-op.
+	var l *listener
+	l.Close()
+}
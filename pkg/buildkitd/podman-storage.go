@@ -0,0 +1,250 @@
+package buildkitd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The cleanup policies for the storage of the podman provider.
+const (
+	// PodmanCleanupAuto removes per-session storage and keeps storage in a
+	// given directory.
+	PodmanCleanupAuto = "auto"
+	// PodmanCleanupAlways removes the storage when buildkitd is stopped.
+	PodmanCleanupAlways = "always"
+	// PodmanCleanupNever keeps the storage, e.g. to reuse the buildkitd image.
+	PodmanCleanupNever = "never"
+)
+
+// PodmanCleanups are all of the supported podman storage cleanup policies.
+var PodmanCleanups = []string{PodmanCleanupAuto, PodmanCleanupAlways, PodmanCleanupNever}
+
+// podmanOwnerFile is the file in per-session storage which records the
+// process that created it, so that GCPodmanStorage can find orphaned storage.
+const podmanOwnerFile = "owner.json"
+
+// PodmanSessionsDir returns the directory which per-session podman storage of
+// builds in the given workspace is created in, i.e.
+// $XDG_DATA_HOME/please-buildkit/podman/<workspace hash>. It is not kept in
+// the workspace's plz-out as rootless podman storage is owned by the user's
+// subordinate IDs, so `plz clean` could not remove it if it is left behind,
+// and overlay storage often fails on network or encrypted filesystems.
+func PodmanSessionsDir(workspace string) (string, error) {
+	dataDir, err := userDataDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find podman storage dir: %w", err)
+	}
+
+	return filepath.Join(dataDir, "please-buildkit", "podman", workspaceHash(workspace)), nil
+}
+
+// userDataDir returns $XDG_DATA_HOME, or its default in the user's home
+// directory. The home directory is looked up rather than taken from $HOME, as
+// each Please build action has its own temporary $HOME.
+func userDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("'%s' has no home directory, set XDG_DATA_HOME", u.Username)
+	}
+
+	return filepath.Join(u.HomeDir, ".local", "share"), nil
+}
+
+// podmanStorage is a storage root for podman which is separate from the
+// user's own, so that it can be removed without removing their images and
+// containers.
+type podmanStorage struct {
+	dir string
+	// session is whether dir was created for this session, rather than given.
+	session bool
+}
+
+// newPodmanStorage returns podman storage in the given directory, or in a new
+// per-session directory of the given workspace if none is given.
+func newPodmanStorage(dir string, workspace string) (*podmanStorage, error) {
+	if dir != "" {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("could not create podman storage dir: %w", err)
+		}
+
+		return &podmanStorage{dir: dir}, nil
+	}
+
+	if workspace == "" {
+		return nil, fmt.Errorf("a workspace is required for per-session podman storage")
+	}
+	sessionsDir, err := PodmanSessionsDir(workspace)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(sessionsDir, SessionID())
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create podman storage dir: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	owner, err := json.Marshal(&Container{
+		Name:      dir,
+		SessionID: SessionID(),
+		OwnerPID:  os.Getpid(),
+		OwnerHost: hostname,
+		StartedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, podmanOwnerFile), owner, 0o644); err != nil {
+		return nil, fmt.Errorf("could not write podman storage owner: %w", err)
+	}
+
+	return &podmanStorage{dir: dir, session: true}, nil
+}
+
+func (s *podmanStorage) root() string    { return filepath.Join(s.dir, "root") }
+func (s *podmanStorage) runRoot() string { return filepath.Join(s.dir, "runroot") }
+
+// globalArgs returns the podman arguments to use the storage with.
+func (s *podmanStorage) globalArgs() []string {
+	return []string{"--root", s.root(), "--runroot", s.runRoot()}
+}
+
+// cleanup removes the storage according to the given cleanup policy. Only
+// the storage which podman created is removed from a given directory.
+func (s *podmanStorage) cleanup(ctx context.Context, binary string, policy string) error {
+	if s == nil {
+		return nil
+	}
+
+	switch policy {
+	case PodmanCleanupNever:
+		return nil
+	case PodmanCleanupAlways:
+	default:
+		if !s.session {
+			return nil
+		}
+	}
+
+	log.Info().Msgf("removing podman storage '%s'", s.dir)
+	if err := removePodmanPaths(ctx, binary, s.root(), s.runRoot()); err != nil {
+		return err
+	}
+	if s.session {
+		return os.RemoveAll(s.dir)
+	}
+
+	return nil
+}
+
+// removePodmanPaths removes the given paths from podman storage. Rootless
+// podman storage is owned by the user's subordinate IDs, so it is removed
+// within podman's user namespace.
+func removePodmanPaths(ctx context.Context, binary string, paths ...string) error {
+	if os.Geteuid() == 0 {
+		var errs []error
+		for _, path := range paths {
+			errs = append(errs, os.RemoveAll(path))
+		}
+		return errors.Join(errs...)
+	}
+
+	rmCmd := exec.CommandContext(ctx, binary, append([]string{"unshare", "rm", "-rf"}, paths...)...)
+	if out, err := rmCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("could not run '%s': %w\n%s", strings.Join(rmCmd.Args, " "), err, out)
+	}
+
+	return nil
+}
+
+// GCPodmanStorage removes the per-session podman storage of the given
+// workspace, and any containers in it, which has been left behind by a crashed
+// or killed please_buildkit process, like GC. The reaped storage is named by
+// its directory.
+func GCPodmanStorage(ctx context.Context, binary string, workspace string, opts *GCOpts) ([]*Reaped, error) {
+	sessionsDir, err := PodmanSessionsDir(workspace)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(sessionsDir)
+	if os.IsNotExist(err) {
+		return []*Reaped{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Debug().Err(err).Msg("could not get hostname, only reaping podman storage by age")
+	}
+
+	reaped := []*Reaped{}
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == SessionID() {
+			continue
+		}
+
+		storage := &podmanStorage{dir: filepath.Join(sessionsDir, entry.Name()), session: true}
+		owner, err := readPodmanStorageOwner(storage.dir)
+		if err != nil {
+			log.Debug().Err(err).Msgf("skipping podman storage '%s'", storage.dir)
+			continue
+		}
+
+		reason, ok := owner.orphaned(time.Now(), opts.MaxAge, hostname, processExists)
+		if !ok {
+			continue
+		}
+
+		if !opts.DryRun {
+			engine := &containerEngine{binary: binary, globalArgs: storage.globalArgs()}
+			if out, err := engine.command(ctx, "rm", "--force", "--all").CombinedOutput(); err != nil {
+				log.Warn().Err(err).Msgf("could not remove containers in podman storage '%s': %s", storage.dir, out)
+			}
+			if err := storage.cleanup(ctx, binary, PodmanCleanupAlways); err != nil {
+				errs = append(errs, fmt.Errorf("could not remove podman storage '%s': %w", storage.dir, err))
+				continue
+			}
+		}
+
+		reaped = append(reaped, &Reaped{Container: owner, Reason: reason})
+	}
+
+	return reaped, errors.Join(errs...)
+}
+
+func readPodmanStorageOwner(dir string) (*Container, error) {
+	b, err := os.ReadFile(filepath.Join(dir, podmanOwnerFile))
+	if err != nil {
+		return nil, err
+	}
+
+	owner := &Container{}
+	if err := json.Unmarshal(b, owner); err != nil {
+		return nil, fmt.Errorf("could not parse podman storage owner: %w", err)
+	}
+	owner.Name = dir
+
+	return owner, nil
+}
@@ -0,0 +1,161 @@
+package buildkitd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPodmanProvider(t *testing.T, storageDir string, cleanup string) (*PodmanProvider, *fakeEngine) {
+	t.Helper()
+
+	engine := newFakeEngine(t, testImage)
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+
+	return NewPodmanProvider(&PodmanProviderOpts{
+		Binary:         engine.binary,
+		Image:          testImage,
+		Transport:      TransportTCP,
+		PullPolicy:     PullPolicyIfNotPresent,
+		StorageDir:     storageDir,
+		StorageCleanup: cleanup,
+		Workspace:      t.TempDir(),
+	}), engine
+}
+
+// writeStorageFile writes a file into the given podman storage, as if podman
+// had stored an image there.
+func writeStorageFile(t *testing.T, storage *podmanStorage) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(storage.root(), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(storage.root(), "image"), []byte("image"), 0o644))
+}
+
+func TestPodmanProviderSessionStorage(t *testing.T) {
+	p, engine := newTestPodmanProvider(t, "", "")
+
+	_, err := p.Start(context.Background())
+	require.NoError(t, err)
+
+	// the storage is kept outside of the workspace, where `plz clean` cannot
+	// remove it.
+	dir := filepath.Join(os.Getenv("XDG_DATA_HOME"), "please-buildkit", "podman", workspaceHash(p.opts.Workspace), SessionID())
+	assert.Equal(t, dir, p.storage.dir)
+	assert.NoDirExists(t, filepath.Join(p.opts.Workspace, "plz-out"))
+	assert.FileExists(t, filepath.Join(dir, podmanOwnerFile))
+	writeStorageFile(t, p.storage)
+
+	storageArgs := "--root " + filepath.Join(dir, "root") + " --runroot " + filepath.Join(dir, "runroot")
+	for _, call := range engine.calls(t) {
+		assert.True(t, strings.HasPrefix(call, storageArgs+" "), call)
+	}
+
+	require.NoError(t, p.Stop(context.Background()))
+	assert.Contains(t, engine.calls(t), storageArgs+" stop "+p.Name)
+	assert.NoDirExists(t, dir)
+}
+
+func TestPodmanProviderStorageDir(t *testing.T) {
+	tests := []struct {
+		cleanup     string
+		wantRemoved bool
+	}{
+		{cleanup: "", wantRemoved: false},
+		{cleanup: PodmanCleanupAuto, wantRemoved: false},
+		{cleanup: PodmanCleanupNever, wantRemoved: false},
+		{cleanup: PodmanCleanupAlways, wantRemoved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cleanup, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "unrelated"), []byte("keep"), 0o644))
+			p, _ := newTestPodmanProvider(t, dir, tt.cleanup)
+
+			_, err := p.Start(context.Background())
+			require.NoError(t, err)
+			writeStorageFile(t, p.storage)
+			require.NoError(t, p.Stop(context.Background()))
+
+			assert.FileExists(t, filepath.Join(dir, "unrelated"))
+			if tt.wantRemoved {
+				assert.NoDirExists(t, filepath.Join(dir, "root"))
+			} else {
+				assert.DirExists(t, filepath.Join(dir, "root"))
+			}
+		})
+	}
+}
+
+func TestPodmanProviderSessionStorageWithoutWorkspace(t *testing.T) {
+	p, engine := newTestPodmanProvider(t, "", "")
+	p.opts.Workspace = ""
+
+	_, err := p.Start(context.Background())
+	assert.ErrorContains(t, err, "workspace is required")
+	assert.Empty(t, engine.calls(t))
+}
+
+func TestPodmanProviderInvalidStorageCleanup(t *testing.T) {
+	p, engine := newTestPodmanProvider(t, "", "sometimes")
+
+	_, err := p.Start(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, engine.calls(t))
+}
+
+func TestGCPodmanStorage(t *testing.T) {
+	workspace := t.TempDir()
+	engine := newFakeEngine(t)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	sessionsDir, err := PodmanSessionsDir(workspace)
+	require.NoError(t, err)
+
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+
+	addSession := func(id string, pid int) string {
+		dir := filepath.Join(sessionsDir, id)
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		owner, err := json.Marshal(&Container{
+			SessionID: id,
+			OwnerPID:  pid,
+			OwnerHost: hostname,
+			StartedAt: time.Now().UTC(),
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, podmanOwnerFile), owner, 0o644))
+		writeStorageFile(t, &podmanStorage{dir: dir})
+
+		return dir
+	}
+	orphaned := addSession("orphaned", exited.ProcessState.Pid())
+	running := addSession("running", os.Getpid())
+	// the storage of this session is never reaped, even without an owner.
+	own := filepath.Join(sessionsDir, SessionID())
+	require.NoError(t, os.MkdirAll(own, 0o755))
+
+	reaped, err := GCPodmanStorage(context.Background(), engine.binary, workspace, &GCOpts{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, reaped, 1)
+	assert.Equal(t, orphaned, reaped[0].Name)
+	assert.DirExists(t, orphaned)
+
+	reaped, err = GCPodmanStorage(context.Background(), engine.binary, workspace, &GCOpts{})
+	require.NoError(t, err)
+	require.Len(t, reaped, 1)
+	assert.NoDirExists(t, orphaned)
+	assert.DirExists(t, running)
+	assert.DirExists(t, own)
+	assert.Contains(t, engine.calls(t), "--root "+filepath.Join(orphaned, "root")+" --runroot "+filepath.Join(orphaned, "runroot")+" rm --force --all")
+}
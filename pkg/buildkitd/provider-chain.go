@@ -45,11 +45,51 @@ func (p *ChainProvider) IsSupported(ctx context.Context) error {
 }
 
 // Start implements Provider.Start.
-func (p *ChainProvider) Start(ctx context.Context, address string) error {
-	return p.provider.Start(ctx, address)
+func (p *ChainProvider) Start(ctx context.Context) (*Endpoint, error) {
+	return p.provider.Start(ctx)
+}
+
+// Info implements Provider.Info.
+func (p *ChainProvider) Info() *ProviderInfo {
+	if p.provider == nil {
+		return &ProviderInfo{}
+	}
+
+	return p.provider.Info()
+}
+
+// Logs implements Provider.Logs.
+func (p *ChainProvider) Logs(ctx context.Context) ([]byte, error) {
+	if p.provider == nil {
+		return nil, nil
+	}
+
+	return p.provider.Logs(ctx)
+}
+
+// Running implements Provider.Running.
+func (p *ChainProvider) Running(ctx context.Context) error {
+	if p.provider == nil {
+		return nil
+	}
+
+	return p.provider.Running(ctx)
 }
 
 // Stop implements Provider.Stop.
 func (p *ChainProvider) Stop(ctx context.Context) error {
+	if p.provider == nil {
+		return nil
+	}
+
 	return p.provider.Stop(ctx)
 }
+
+// Kill implements Provider.Kill.
+func (p *ChainProvider) Kill(ctx context.Context) error {
+	if p.provider == nil {
+		return nil
+	}
+
+	return p.provider.Kill(ctx)
+}
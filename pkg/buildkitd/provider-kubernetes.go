@@ -0,0 +1,679 @@
+package buildkitd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/rs/zerolog/log"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// The ways of connecting to a buildkitd pod.
+const (
+	// KubernetesConnectPortForward connects via a port forwarded through the
+	// Kubernetes API server, which works from outside of the cluster.
+	KubernetesConnectPortForward = "port-forward"
+	// KubernetesConnectPodIP connects to the IP of the pod directly, which
+	// requires running in the cluster's network.
+	KubernetesConnectPodIP = "pod-ip"
+)
+
+// KubernetesConnects are all of the supported ways of connecting to a
+// buildkitd pod.
+var KubernetesConnects = []string{KubernetesConnectPortForward, KubernetesConnectPodIP}
+
+// DefaultKubernetesReadyTimeout is how long the Kubernetes provider waits for
+// the buildkitd pod to become ready by default.
+const DefaultKubernetesReadyTimeout = 2 * time.Minute
+
+const (
+	kubernetesContainerName = "buildkitd"
+	// kubernetesSecretDir is where the secret with the server's TLS
+	// credentials and the buildkitd configuration is mounted.
+	kubernetesSecretDir = "/run/please-buildkit"
+	kubernetesConfigKey = "buildkitd.toml"
+	// kubernetesTLSServerName is the name the server certificate is valid for
+	// when connecting to the pod IP, which is not known in advance.
+	kubernetesTLSServerName = "buildkitd.please-buildkit"
+	// kubernetesUID is the user the rootless buildkitd image runs as.
+	kubernetesUID int64 = 1000
+)
+
+// kubernetesPollInterval is how often the buildkitd pod is checked for
+// readiness.
+var kubernetesPollInterval = time.Second
+
+// kubernetesFailedWaitingReasons are the reasons a container may be waiting
+// for which mean that the pod will not become ready without intervention,
+// although it stays pending.
+var kubernetesFailedWaitingReasons = map[string]struct{}{
+	"ErrImagePull":               {},
+	"ImagePullBackOff":           {},
+	"InvalidImageName":           {},
+	"CreateContainerConfigError": {},
+	"CreateContainerError":       {},
+}
+
+// KubernetesProviderOpts represents the options for the buildkitd Kubernetes
+// provider.
+type KubernetesProviderOpts struct {
+	Client kubernetes.Interface
+	// RESTConfig is the configuration of Client, which is required to port
+	// forward.
+	RESTConfig *rest.Config
+	Namespace  string
+	// Image is the rootless buildkitd image to run.
+	Image string
+	// Connect is how buildkitd is connected to, one of KubernetesConnects.
+	Connect string
+	// ConfigFile is an optional `buildkitd.toml` to configure buildkitd with.
+	ConfigFile string
+	// StateClaim is the name of an optional PersistentVolumeClaim to keep
+	// buildkitd's state in. As buildkitd cannot share its state, it should
+	// only be used by one build at a time.
+	StateClaim string
+	// ReadyTimeout is how long to wait for the pod to become ready.
+	ReadyTimeout time.Duration
+	// Runtime is optional resource limits and runtime options of buildkitd.
+	// Mounts must be read-only files, which are copied into the pod, and the pids limit
+	// is configured on the kubelet instead.
+	Runtime *RuntimeOpts
+}
+
+// KubernetesProvider implements the buildkit provider via a rootless
+// buildkitd pod in a Kubernetes cluster.
+type KubernetesProvider struct {
+	Provider
+	opts *KubernetesProviderOpts
+	info *ProviderInfo
+	// dir is a private directory for the TLS credentials.
+	dir         string
+	client      *TLSCredentials
+	stopForward chan struct{}
+
+	Name string
+}
+
+// NewKubernetesProvider returns a new buildkit provider implemented via
+// Kubernetes.
+func NewKubernetesProvider(o *KubernetesProviderOpts) *KubernetesProvider {
+	return &KubernetesProvider{
+		opts: o,
+		info: &ProviderInfo{Name: "kubernetes", Rootless: true},
+	}
+}
+
+// IsSupported implements Provider.IsSupported.
+func (p *KubernetesProvider) IsSupported(ctx context.Context) error {
+	if p.opts.Client == nil {
+		return fmt.Errorf("no kubernetes client is configured")
+	}
+
+	checks := []*authorizationv1.ResourceAttributes{
+		{Namespace: p.opts.Namespace, Verb: "create", Resource: "pods"},
+		{Namespace: p.opts.Namespace, Verb: "create", Resource: "secrets"},
+	}
+	if p.opts.Connect == KubernetesConnectPortForward {
+		checks = append(checks, &authorizationv1.ResourceAttributes{
+			Namespace: p.opts.Namespace, Verb: "create", Resource: "pods", Subresource: "portforward",
+		})
+	}
+
+	for _, attrs := range checks {
+		review, err := p.opts.Client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attrs},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("could not check kubernetes access: %w", err)
+		}
+
+		resource := attrs.Resource
+		if attrs.Subresource != "" {
+			resource += "/" + attrs.Subresource
+		}
+		if !review.Status.Allowed {
+			return fmt.Errorf("cannot %s %s in namespace '%s': %s", attrs.Verb, resource, attrs.Namespace, review.Status.Reason)
+		}
+	}
+
+	return nil
+}
+
+// Start implements Provider.Start.
+func (p *KubernetesProvider) Start(ctx context.Context) (*Endpoint, error) {
+	switch p.opts.Connect {
+	case KubernetesConnectPortForward, KubernetesConnectPodIP:
+	default:
+		return nil, fmt.Errorf("invalid kubernetes connect '%s', must be one of: %s", p.opts.Connect, strings.Join(KubernetesConnects, ", "))
+	}
+	for _, m := range p.runtime().Mounts {
+		if !m.ReadOnly {
+			return nil, fmt.Errorf("invalid mount '%s', mounts are copied into pods so must be read-only, e.g. '%s:ro'", m, m)
+		}
+	}
+
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+
+	p.dir, err = os.MkdirTemp("", "pbk-")
+	if err != nil {
+		return nil, err
+	}
+
+	server, client, err := GenerateTLSCredentials(p.dir, append([]string{kubernetesTLSServerName}, tlsHosts...))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate TLS credentials: %w", err)
+	}
+	p.client = client
+
+	secret, err := p.secret(name, server)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("starting '%s' pod in namespace '%s'", name, p.opts.Namespace)
+	// the secret and pod may exist as soon as they are created, so they must
+	// be cleaned up from here on.
+	p.Name = name
+	recordStart := stats.Start(ctx, stats.PhaseContainerStart)
+	if _, err := p.opts.Client.CoreV1().Secrets(p.opts.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("could not create secret: %w", err)
+	}
+	if _, err := p.opts.Client.CoreV1().Pods(p.opts.Namespace).Create(ctx, p.pod(name), metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("could not create pod: %w", err)
+	}
+
+	pod, err := p.waitForReady(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recordStart()
+	log.Info().Msgf("started '%s' pod", p.Name)
+	p.describe(ctx, pod)
+
+	endpoint := &Endpoint{TLS: p.client, Transport: TransportTCP}
+	if p.opts.Connect == KubernetesConnectPodIP {
+		p.client.ServerName = kubernetesTLSServerName
+		endpoint.Address = fmt.Sprintf("tcp://%s:%s", pod.Status.PodIP, containerPort)
+		return endpoint, nil
+	}
+
+	endpoint.Address, err = p.portForward(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint, nil
+}
+
+// secret returns the secret with the server's TLS credentials and the
+// buildkitd configuration.
+func (p *KubernetesProvider) secret(name string, server *TLSCredentials) (*corev1.Secret, error) {
+	secret := &corev1.Secret{
+		ObjectMeta: p.objectMeta(name),
+		Data:       map[string][]byte{},
+	}
+
+	for _, path := range []string{server.CACert, server.Cert, server.Key} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		secret.Data[filepath.Base(path)] = b
+	}
+
+	if p.opts.ConfigFile != "" {
+		b, err := os.ReadFile(p.opts.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read buildkitd config: %w", err)
+		}
+		secret.Data[kubernetesConfigKey] = b
+	}
+
+	for i, m := range p.runtime().Mounts {
+		b, err := os.ReadFile(m.Source)
+		if err != nil {
+			return nil, fmt.Errorf("could not read mount '%s', only files can be mounted into pods: %w", m.Source, err)
+		}
+		secret.Data[kubernetesMountKey(i)] = b
+	}
+
+	return secret, nil
+}
+
+// pod returns the rootless buildkitd pod, see
+// https://github.com/moby/buildkit/blob/master/examples/kubernetes/pod.rootless.yaml.
+func (p *KubernetesProvider) pod(name string) *corev1.Pod {
+	args := []string{
+		"--addr", fmt.Sprintf("unix:///run/user/%d/buildkit/buildkitd.sock", kubernetesUID),
+		"--addr", fmt.Sprintf("tcp://0.0.0.0:%s", containerPort),
+	}
+	args = append(args, (&TLSCredentials{
+		CACert: kubernetesSecretDir + "/ca.pem",
+		Cert:   kubernetesSecretDir + "/server.pem",
+		Key:    kubernetesSecretDir + "/server-key.pem",
+	}).BuildkitdArgs()...)
+	if p.opts.ConfigFile != "" {
+		args = append(args, "--config", kubernetesSecretDir+"/"+kubernetesConfigKey)
+	}
+	args = append(args, p.opts.Runtime.buildkitdArgs()...)
+	args = append(args, "--oci-worker-no-process-sandbox")
+
+	secretMode := int32(0o440)
+	uid := kubernetesUID
+	pod := &corev1.Pod{
+		ObjectMeta: p.objectMeta(name),
+		Spec: corev1.PodSpec{
+			RestartPolicy: corev1.RestartPolicyNever,
+			SecurityContext: &corev1.PodSecurityContext{
+				FSGroup: &uid,
+			},
+			Containers: []corev1.Container{{
+				Name:  kubernetesContainerName,
+				Image: p.opts.Image,
+				Args:  args,
+				Ports: []corev1.ContainerPort{{
+					Name:          "buildkitd",
+					ContainerPort: kubernetesContainerPort(),
+				}},
+				ReadinessProbe: &corev1.Probe{
+					ProbeHandler: corev1.ProbeHandler{
+						Exec: &corev1.ExecAction{
+							Command: []string{"buildctl", "debug", "workers"},
+						},
+					},
+					PeriodSeconds: 1,
+				},
+				SecurityContext: &corev1.SecurityContext{
+					RunAsUser:  &uid,
+					RunAsGroup: &uid,
+					SeccompProfile: &corev1.SeccompProfile{
+						Type: corev1.SeccompProfileTypeUnconfined,
+					},
+				},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "please-buildkit",
+					MountPath: kubernetesSecretDir,
+					ReadOnly:  true,
+				}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "please-buildkit",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName:  name,
+						DefaultMode: &secretMode,
+					},
+				},
+			}},
+		},
+	}
+	pod.Annotations["container.apparmor.security.beta.kubernetes.io/"+kubernetesContainerName] = "unconfined"
+
+	p.applyRuntime(pod)
+
+	if p.opts.StateClaim != "" {
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "state",
+			MountPath: rootlessStateMountPath,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "state",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: p.opts.StateClaim,
+				},
+			},
+		})
+	}
+
+	return pod
+}
+
+// runtime returns the runtime options of buildkitd.
+func (p *KubernetesProvider) runtime() *RuntimeOpts {
+	if p.opts.Runtime == nil {
+		return &RuntimeOpts{}
+	}
+
+	return p.opts.Runtime
+}
+
+// kubernetesMountKey returns the key of the secret which holds the file of
+// the mount with the given index.
+func kubernetesMountKey(i int) string {
+	return fmt.Sprintf("mount-%d", i)
+}
+
+// applyRuntime applies the runtime options of buildkitd to the given pod.
+func (p *KubernetesProvider) applyRuntime(pod *corev1.Pod) {
+	runtime := p.runtime()
+	container := &pod.Spec.Containers[0]
+
+	limits := corev1.ResourceList{}
+	if runtime.CPUs > 0 {
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(math.Ceil(runtime.CPUs*1000)), resource.DecimalSI)
+	}
+	if runtime.Memory > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(runtime.Memory, resource.BinarySI)
+	}
+	if len(limits) > 0 {
+		container.Resources.Limits = limits
+	}
+	if runtime.PidsLimit > 0 {
+		log.Warn().Msg("the pids limit of pods is configured on the kubelet, ignoring it")
+	}
+
+	for i, m := range runtime.Mounts {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "please-buildkit",
+			MountPath: m.Target,
+			SubPath:   kubernetesMountKey(i),
+			ReadOnly:  true,
+		})
+	}
+
+	for _, env := range runtime.Env {
+		name, value, _ := strings.Cut(env, "=")
+		container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: value})
+	}
+
+	if len(runtime.DNS) > 0 || len(runtime.DNSSearch) > 0 || len(runtime.DNSOptions) > 0 {
+		pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+			Nameservers: runtime.DNS,
+			Searches:    runtime.DNSSearch,
+		}
+		for _, opt := range runtime.DNSOptions {
+			name, value, ok := strings.Cut(opt, ":")
+			option := corev1.PodDNSConfigOption{Name: name}
+			if ok {
+				option.Value = &value
+			}
+			pod.Spec.DNSConfig.Options = append(pod.Spec.DNSConfig.Options, option)
+		}
+	}
+	// the cluster's DNS is only replaced when DNS servers are given, like
+	// container engines.
+	if len(runtime.DNS) > 0 {
+		pod.Spec.DNSPolicy = corev1.DNSNone
+	}
+}
+
+// objectMeta returns the metadata of the objects the provider creates. The
+// owner is recorded like the labels of containers, but as annotations as its
+// values are not valid label values.
+func (p *KubernetesProvider) objectMeta(name string) metav1.ObjectMeta {
+	hostname, _ := os.Hostname()
+
+	return metav1.ObjectMeta{
+		Name:      name,
+		Namespace: p.opts.Namespace,
+		Labels: map[string]string{
+			"app.kubernetes.io/name": "please-buildkit",
+			LabelSessionID:           SessionID(),
+		},
+		Annotations: map[string]string{
+			LabelOwnerPID:  fmt.Sprintf("%d", os.Getpid()),
+			LabelOwnerHost: hostname,
+			LabelStartedAt: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+// waitForReady waits for the pod to become ready, failing early if it stops.
+func (p *KubernetesProvider) waitForReady(ctx context.Context) (*corev1.Pod, error) {
+	timeout := p.opts.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DefaultKubernetesReadyTimeout
+	}
+
+	var pod *corev1.Pod
+	err := wait.PollUntilContextTimeout(ctx, kubernetesPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		var err error
+		pod, err = p.opts.Client.CoreV1().Pods(p.opts.Namespace).Get(ctx, p.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		if err := podRunning(pod); err != nil {
+			return false, err
+		}
+		if err := podStuck(pod); err != nil {
+			return false, err
+		}
+
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not wait for '%s' pod to become ready: %w", p.Name, err)
+	}
+
+	return pod, nil
+}
+
+// describe fills in the info of the provider from the cluster and the given
+// ready pod. This is best effort, so details which cannot be determined, e.g.
+// as the user cannot get nodes, are left empty.
+func (p *KubernetesProvider) describe(ctx context.Context, pod *corev1.Pod) {
+	if version, err := p.opts.Client.Discovery().ServerVersion(); err != nil {
+		log.Debug().Err(err).Msg("could not get kubernetes version")
+	} else {
+		p.info.EngineVersion = version.GitVersion
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == kubernetesContainerName {
+			// image IDs are e.g. `docker.io/moby/buildkit@sha256:...`.
+			if _, digest, ok := strings.Cut(status.ImageID, "@"); ok {
+				p.info.ImageDigest = digest
+			}
+		}
+	}
+
+	node, err := p.opts.Client.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		log.Debug().Err(err).Msgf("could not get node '%s'", pod.Spec.NodeName)
+		return
+	}
+	p.info.Platforms = []string{node.Status.NodeInfo.OperatingSystem + "/" + node.Status.NodeInfo.Architecture}
+}
+
+// podRunning returns an error wrapping ErrExited if the given pod or its
+// buildkitd container has stopped.
+func podRunning(pod *corev1.Pod) error {
+	switch pod.Status.Phase {
+	case corev1.PodFailed, corev1.PodSucceeded:
+		return fmt.Errorf("%w: '%s' pod stopped with phase '%s': %s", ErrExited, pod.Name, pod.Status.Phase, pod.Status.Message)
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == kubernetesContainerName && status.State.Terminated != nil {
+			terminated := status.State.Terminated
+			return fmt.Errorf("%w: '%s' pod's container exited with code %d: %s", ErrExited, pod.Name, terminated.ExitCode, terminated.Reason)
+		}
+	}
+
+	return nil
+}
+
+// podStuck returns an error if the buildkitd container of the given pending
+// pod is waiting for a reason which it will not recover from, e.g. its image
+// cannot be pulled.
+func podStuck(pod *corev1.Pod) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != kubernetesContainerName || status.State.Waiting == nil {
+			continue
+		}
+
+		waiting := status.State.Waiting
+		if _, ok := kubernetesFailedWaitingReasons[waiting.Reason]; ok {
+			return fmt.Errorf("'%s' pod's container is waiting with reason '%s': %s", pod.Name, waiting.Reason, waiting.Message)
+		}
+	}
+
+	return nil
+}
+
+// kubernetesContainerPort returns containerPort as the port of a container.
+func kubernetesContainerPort() int32 {
+	port, err := strconv.ParseInt(containerPort, 10, 32)
+	if err != nil {
+		panic(fmt.Sprintf("invalid container port '%s': %v", containerPort, err))
+	}
+
+	return int32(port)
+}
+
+// portForward forwards a local port to buildkitd in the pod and returns its
+// address.
+func (p *KubernetesProvider) portForward(ctx context.Context) (string, error) {
+	if p.opts.RESTConfig == nil {
+		return "", fmt.Errorf("port forwarding requires a kubernetes REST config")
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(p.opts.RESTConfig)
+	if err != nil {
+		return "", err
+	}
+	url := p.opts.Client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(p.opts.Namespace).
+		Name(p.Name).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	p.stopForward = make(chan struct{})
+	ready := make(chan struct{})
+	forwarder, err := portforward.NewOnAddresses(
+		dialer,
+		[]string{"127.0.0.1"},
+		[]string{"0:" + containerPort},
+		p.stopForward,
+		ready,
+		io.Discard,
+		log.Logger,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-ready:
+	case err := <-errCh:
+		return "", fmt.Errorf("could not port forward to '%s' pod: %w", p.Name, err)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	ports, err := forwarder.GetPorts()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("tcp://127.0.0.1:%d", ports[0].Local), nil
+}
+
+// Info implements Provider.Info.
+func (p *KubernetesProvider) Info() *ProviderInfo {
+	return p.info
+}
+
+// Logs implements Provider.Logs.
+func (p *KubernetesProvider) Logs(ctx context.Context) ([]byte, error) {
+	if p.Name == "" {
+		return nil, nil
+	}
+
+	out, err := p.opts.Client.CoreV1().Pods(p.opts.Namespace).GetLogs(p.Name, &corev1.PodLogOptions{
+		Container: kubernetesContainerName,
+	}).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get logs of '%s' pod: %w", p.Name, err)
+	}
+
+	return out, nil
+}
+
+// Running implements Provider.Running.
+func (p *KubernetesProvider) Running(ctx context.Context) error {
+	pod, err := p.opts.Client.CoreV1().Pods(p.opts.Namespace).Get(ctx, p.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get '%s' pod: %w", p.Name, err)
+	}
+
+	return podRunning(pod)
+}
+
+// Kill implements Provider.Kill.
+func (p *KubernetesProvider) Kill(ctx context.Context) error {
+	var gracePeriod int64
+
+	return p.delete(ctx, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+}
+
+// Stop implements Provider.Stop.
+func (p *KubernetesProvider) Stop(ctx context.Context) error {
+	return p.delete(ctx, metav1.DeleteOptions{})
+}
+
+// delete stops port forwarding and deletes the pod and secret, if they were
+// created.
+func (p *KubernetesProvider) delete(ctx context.Context, opts metav1.DeleteOptions) error {
+	if p.stopForward != nil {
+		close(p.stopForward)
+		p.stopForward = nil
+	}
+	if p.dir != "" {
+		defer func() {
+			if err := os.RemoveAll(p.dir); err != nil {
+				log.Warn().Err(err).Msgf("could not remove '%s'", p.dir)
+			}
+		}()
+	}
+
+	if p.Name == "" {
+		return nil
+	}
+
+	log.Info().Msgf("deleting '%s' pod", p.Name)
+	if err := p.opts.Client.CoreV1().Pods(p.opts.Namespace).Delete(ctx, p.Name, opts); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete pod: %w", err)
+	}
+	if err := p.opts.Client.CoreV1().Secrets(p.opts.Namespace).Delete(ctx, p.Name, opts); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete secret: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package buildkitd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testNamespace = "ci"
+
+// newTestKubernetesProvider returns a provider with a fake clientset, whose
+// pods get the given status when they are created.
+func newTestKubernetesProvider(t *testing.T, status corev1.PodStatus) (*KubernetesProvider, *fake.Clientset) {
+	t.Helper()
+
+	interval := kubernetesPollInterval
+	kubernetesPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { kubernetesPollInterval = interval })
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		pod.Status = status
+		return false, nil, nil
+	})
+
+	return NewKubernetesProvider(&KubernetesProviderOpts{
+		Client:       client,
+		Namespace:    testNamespace,
+		Image:        testRootlessImage,
+		Connect:      KubernetesConnectPodIP,
+		ReadyTimeout: time.Second,
+	}), client
+}
+
+var readyPodStatus = corev1.PodStatus{
+	Phase: corev1.PodRunning,
+	PodIP: "10.0.0.5",
+	ContainerStatuses: []corev1.ContainerStatus{{
+		Name:    kubernetesContainerName,
+		ImageID: "docker.io/moby/buildkit@sha256:0123",
+	}},
+	Conditions: []corev1.PodCondition{{
+		Type:   corev1.PodReady,
+		Status: corev1.ConditionTrue,
+	}},
+}
+
+func TestKubernetesProviderIsSupported(t *testing.T) {
+	tests := []struct {
+		name    string
+		denied  string
+		connect string
+		wantErr bool
+	}{
+		{name: "allowed", connect: KubernetesConnectPortForward},
+		{name: "pods denied", denied: "pods", connect: KubernetesConnectPodIP, wantErr: true},
+		{name: "port forward denied", denied: "pods/portforward", connect: KubernetesConnectPortForward, wantErr: true},
+		{name: "port forward denied but unused", denied: "pods/portforward", connect: KubernetesConnectPodIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, client := newTestKubernetesProvider(t, readyPodStatus)
+			p.opts.Connect = tt.connect
+			client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				attrs := review.Spec.ResourceAttributes
+				resource := attrs.Resource
+				if attrs.Subresource != "" {
+					resource += "/" + attrs.Subresource
+				}
+				review.Status.Allowed = attrs.Namespace == testNamespace && resource != tt.denied
+				return true, review, nil
+			})
+
+			err := p.IsSupported(context.Background())
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("no client", func(t *testing.T) {
+		assert.Error(t, NewKubernetesProvider(&KubernetesProviderOpts{}).IsSupported(context.Background()))
+	})
+}
+
+func TestKubernetesProviderStartStop(t *testing.T) {
+	p, client := newTestKubernetesProvider(t, readyPodStatus)
+	p.opts.StateClaim = "buildkitd-state"
+	ctx := context.Background()
+
+	endpoint, err := p.Start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp://10.0.0.5:1234", endpoint.Address)
+	assert.Equal(t, kubernetesTLSServerName, endpoint.TLS.ServerName)
+	assert.FileExists(t, endpoint.TLS.Key)
+
+	pod, err := client.CoreV1().Pods(testNamespace).Get(ctx, p.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, testRootlessImage, container.Image)
+	assert.Contains(t, container.Args, "--oci-worker-no-process-sandbox")
+	assert.Equal(t, kubernetesUID, *container.SecurityContext.RunAsUser)
+	assert.Equal(t, corev1.SeccompProfileTypeUnconfined, container.SecurityContext.SeccompProfile.Type)
+	assert.Equal(t, "unconfined", pod.Annotations["container.apparmor.security.beta.kubernetes.io/buildkitd"])
+	assert.Equal(t, SessionID(), pod.Labels[LabelSessionID])
+	assert.Contains(t, container.VolumeMounts, corev1.VolumeMount{Name: "state", MountPath: rootlessStateMountPath})
+	assert.Equal(t, "buildkitd-state", pod.Spec.Volumes[1].PersistentVolumeClaim.ClaimName)
+
+	secret, err := client.CoreV1().Secrets(testNamespace).Get(ctx, p.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, secret.Data, "ca.pem")
+	assert.Contains(t, secret.Data, "server.pem")
+	assert.Contains(t, secret.Data, "server-key.pem")
+	assert.NotContains(t, secret.Data, "client-key.pem")
+
+	require.NoError(t, p.Stop(ctx))
+	pods, err := client.CoreV1().Pods(testNamespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pods.Items)
+	secrets, err := client.CoreV1().Secrets(testNamespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, secrets.Items)
+	assert.NoFileExists(t, endpoint.TLS.Key)
+}
+
+func TestKubernetesProviderRuntime(t *testing.T) {
+	p, client := newTestKubernetesProvider(t, readyPodStatus)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, []byte("ca"), 0o644))
+	p.opts.Runtime = &RuntimeOpts{
+		CPUs:       1.5,
+		Memory:     4 << 30,
+		Mounts:     []*Mount{{Source: caPath, Target: "/etc/ssl/certs/ca.pem", ReadOnly: true}},
+		Env:        []string{"HTTPS_PROXY=http://proxy:3128"},
+		DNS:        []string{"10.0.0.53"},
+		DNSOptions: []string{"ndots:2", "rotate"},
+	}
+	ctx := context.Background()
+
+	_, err := p.Start(ctx)
+	require.NoError(t, err)
+	defer p.Stop(ctx)
+
+	pod, err := client.CoreV1().Pods(testNamespace).Get(ctx, p.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, "1500m", container.Resources.Limits.Cpu().String())
+	assert.Equal(t, "4Gi", container.Resources.Limits.Memory().String())
+	assert.Contains(t, container.VolumeMounts, corev1.VolumeMount{
+		Name:      "please-buildkit",
+		MountPath: "/etc/ssl/certs/ca.pem",
+		SubPath:   "mount-0",
+		ReadOnly:  true,
+	})
+	assert.Equal(t, []corev1.EnvVar{{Name: "HTTPS_PROXY", Value: "http://proxy:3128"}}, container.Env)
+	assert.Equal(t, corev1.DNSNone, pod.Spec.DNSPolicy)
+	assert.Equal(t, []string{"10.0.0.53"}, pod.Spec.DNSConfig.Nameservers)
+	ndots := "2"
+	assert.Equal(t, []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}, {Name: "rotate"}}, pod.Spec.DNSConfig.Options)
+	assert.Contains(t, container.Args, "--oci-worker-max-parallelism")
+
+	secret, err := client.CoreV1().Secrets(testNamespace).Get(ctx, p.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ca"), secret.Data["mount-0"])
+}
+
+func TestKubernetesProviderWritableMount(t *testing.T) {
+	p, client := newTestKubernetesProvider(t, readyPodStatus)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, []byte("ca"), 0o644))
+	p.opts.Runtime = &RuntimeOpts{Mounts: []*Mount{{Source: caPath, Target: "/etc/ssl/certs/ca.pem"}}}
+	ctx := context.Background()
+
+	_, err := p.Start(ctx)
+	assert.ErrorContains(t, err, "must be read-only")
+
+	pods, err := client.CoreV1().Pods(testNamespace).List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, pods.Items)
+}
+
+func TestKubernetesProviderInfoAndLogs(t *testing.T) {
+	p, client := newTestKubernetesProvider(t, readyPodStatus)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		pod.Spec.NodeName = "node-a"
+		return false, nil, nil
+	})
+	_, err := client.CoreV1().Nodes().Create(context.Background(), &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+		Status: corev1.NodeStatus{NodeInfo: corev1.NodeSystemInfo{
+			OperatingSystem: "linux",
+			Architecture:    "arm64",
+		}},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	_, err = p.Start(context.Background())
+	require.NoError(t, err)
+	defer p.Stop(context.Background())
+
+	info := p.Info()
+	assert.Equal(t, "kubernetes", info.Name)
+	assert.True(t, info.Rootless)
+	assert.Equal(t, []string{"linux/arm64"}, info.Platforms)
+	assert.Equal(t, "sha256:0123", info.ImageDigest)
+
+	logs, err := p.Logs(context.Background())
+	require.NoError(t, err)
+	assert.NotEmpty(t, logs)
+}
+
+func TestKubernetesProviderPodFailed(t *testing.T) {
+	waiting := func(reason string, message string) corev1.PodStatus {
+		return corev1.PodStatus{
+			Phase: corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: kubernetesContainerName,
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: message},
+				},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		status  corev1.PodStatus
+		wantErr string
+	}{
+		{
+			name:    "image pull back-off",
+			status:  waiting("ImagePullBackOff", `Back-off pulling image "moby/buildkit:missing"`),
+			wantErr: "ImagePullBackOff",
+		},
+		{
+			name:    "config error",
+			status:  waiting("CreateContainerConfigError", `secret "missing" not found`),
+			wantErr: "CreateContainerConfigError",
+		},
+		{
+			name:    "evicted",
+			status:  corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted", Message: "The node was low on resource: memory."},
+			wantErr: "low on resource",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, client := newTestKubernetesProvider(t, tt.status)
+			// the pod fails long before it would time out.
+			p.opts.ReadyTimeout = time.Minute
+
+			start := time.Now()
+			_, err := p.Start(context.Background())
+			require.ErrorContains(t, err, tt.wantErr)
+			assert.Less(t, time.Since(start), 10*time.Second)
+
+			// the worker stops the provider when it fails to start.
+			require.NoError(t, p.Stop(context.Background()))
+			pods, err := client.CoreV1().Pods(testNamespace).List(context.Background(), metav1.ListOptions{})
+			require.NoError(t, err)
+			assert.Empty(t, pods.Items)
+		})
+	}
+}
+
+func TestKubernetesProviderPodPending(t *testing.T) {
+	p, _ := newTestKubernetesProvider(t, corev1.PodStatus{
+		Phase: corev1.PodPending,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name: kubernetesContainerName,
+			State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+			},
+		}},
+	})
+	p.opts.ReadyTimeout = 50 * time.Millisecond
+
+	// containers which are still being created are waited for.
+	_, err := p.Start(context.Background())
+	assert.ErrorContains(t, err, "could not wait for")
+	assert.NotContains(t, err.Error(), "ContainerCreating")
+}
+
+func TestKubernetesProviderRunning(t *testing.T) {
+	p, client := newTestKubernetesProvider(t, readyPodStatus)
+	ctx := context.Background()
+
+	_, err := p.Start(ctx)
+	require.NoError(t, err)
+	defer p.Stop(ctx)
+	require.NoError(t, p.Running(ctx))
+
+	pod, err := client.CoreV1().Pods(testNamespace).Get(ctx, p.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	pod.Status.ContainerStatuses[0].State.Terminated = &corev1.ContainerStateTerminated{
+		ExitCode: 1,
+		Reason:   "Error",
+	}
+	_, err = client.CoreV1().Pods(testNamespace).UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	err = p.Running(ctx)
+	assert.ErrorIs(t, err, ErrExited)
+	assert.ErrorContains(t, err, "exited with code 1")
+}
+
+func TestKubernetesProviderReadyTimeout(t *testing.T) {
+	p, _ := newTestKubernetesProvider(t, corev1.PodStatus{Phase: corev1.PodPending})
+	p.opts.ReadyTimeout = 50 * time.Millisecond
+
+	_, err := p.Start(context.Background())
+	assert.Error(t, err)
+}
+
+func TestKubernetesProviderKill(t *testing.T) {
+	p, client := newTestKubernetesProvider(t, readyPodStatus)
+
+	_, err := p.Start(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, p.Kill(context.Background()))
+
+	var deletes int
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "delete" {
+			deletes++
+		}
+	}
+	assert.Equal(t, 2, deletes)
+	_, err = client.CoreV1().Pods(testNamespace).Get(context.Background(), p.Name, metav1.GetOptions{})
+	assert.Error(t, err)
+}
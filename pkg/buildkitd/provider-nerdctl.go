@@ -0,0 +1,176 @@
+package buildkitd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/rs/zerolog/log"
+)
+
+// NerdctlProviderOpts represents the options for the buildkitd nerdctl provider.
+type NerdctlProviderOpts struct {
+	Binary string
+	Image  string
+	// RootlessImage is the image to run when containerd is rootless.
+	RootlessImage string
+	// Transport is how buildkitd is exposed to the host, one of Transports.
+	Transport string
+	// ConfigFile is an optional `buildkitd.toml` to configure buildkitd with.
+	ConfigFile string
+	// PullPolicy is when to pull Image, one of PullPolicies.
+	PullPolicy string
+	// ImageTar is an optional tarball of the buildkitd image to load instead
+	// of pulling Image.
+	ImageTar string
+	// ImageDigest is the config or manifest digest which ImageTar must have,
+	// unless Image is pinned by digest.
+	ImageDigest string
+	// State is optional persistent buildkitd state to run buildkitd with.
+	State *State
+	// Runtime is optional resource limits and runtime options of buildkitd.
+	Runtime *RuntimeOpts
+}
+
+// NerdctlProvider implements the buildkit provider via containerd with
+// nerdctl, which may be rootful or rootless.
+type NerdctlProvider struct {
+	Provider
+	listener *listener
+	engine   *containerEngine
+	info     *ProviderInfo
+	opts     *NerdctlProviderOpts
+	rootless bool
+
+	Name string
+}
+
+// NewNerdctlProvider returns a new buildkit provider implemented via nerdctl.
+func NewNerdctlProvider(o *NerdctlProviderOpts) *NerdctlProvider {
+	return &NerdctlProvider{
+		opts:   o,
+		engine: &containerEngine{binary: o.Binary},
+		info:   &ProviderInfo{Name: "nerdctl"},
+	}
+}
+
+// IsSupported implements Provider.IsSupported.
+func (p *NerdctlProvider) IsSupported(ctx context.Context) error {
+	// nerdctl talks to containerd directly, so `info` fails if containerd,
+	// or RootlessKit for rootless containerd, is not running.
+	infoCmd := p.engine.command(ctx,
+		"info",
+		"--format", `{{ range $opt := .SecurityOptions }}{{ $opt }}{{"\n"}}{{ end }}`,
+	)
+	infoOut, err := infoCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not run '%s': %w\n%s", strings.Join(infoCmd.Args, " "), err, infoOut)
+	}
+
+	p.rootless = strings.Contains(string(infoOut), "rootless")
+	p.info.Rootless = p.rootless
+	if p.rootless {
+		log.Debug().Msg("containerd is rootless")
+	}
+
+	return nil
+}
+
+// Start implements Provider.Start.
+func (p *NerdctlProvider) Start(ctx context.Context) (*Endpoint, error) {
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+
+	p.listener, err = newListener(p.opts.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	image, stateMount := p.opts.Image, stateMountPath
+	if p.rootless {
+		image, stateMount = p.opts.RootlessImage, rootlessStateMountPath
+	}
+
+	imageRef, err := prepareImage(ctx, p.engine, image, p.opts.PullPolicy, p.opts.ImageTar, p.opts.ImageDigest)
+	if err != nil {
+		return nil, err
+	}
+	p.engine.describe(ctx, p.info, imageRef, "info", "--format", "{{.ServerVersion}}")
+
+	stateArgs, err := p.opts.State.volumeRunArgs(ctx, p.engine, stateMount)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("starting '%s' container", name)
+	runArgs := []string{
+		"run",
+		"-d",
+		"--name", name,
+	}
+	if p.rootless {
+		runArgs = append(runArgs,
+			"--security-opt", "seccomp=unconfined",
+			"--security-opt", "apparmor=unconfined",
+			"--security-opt", "systempaths=unconfined",
+		)
+	} else {
+		runArgs = append(runArgs, "--privileged")
+	}
+	runArgs = append(runArgs, labelRunArgs()...)
+	runArgs = append(runArgs, p.listener.runArgs()...)
+	runArgs = append(runArgs, configRunArgs(p.opts.ConfigFile)...)
+	runArgs = append(runArgs, stateArgs...)
+	runArgs = append(runArgs, p.opts.Runtime.runArgs()...)
+	runArgs = append(runArgs, imageRef)
+	runArgs = append(runArgs, p.listener.buildkitdArgs()...)
+	runArgs = append(runArgs, configBuildkitdArgs(p.opts.ConfigFile)...)
+	runArgs = append(runArgs, p.opts.Runtime.buildkitdArgs()...)
+	if p.rootless {
+		runArgs = append(runArgs, "--oci-worker-no-process-sandbox")
+	}
+	// the container may exist as soon as it is run, so it must be cleaned up
+	// from here on.
+	p.Name = name
+	runCmd := p.engine.command(ctx, runArgs...)
+	recordStart := stats.Start(ctx, stats.PhaseContainerStart)
+	if out, err := runCmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("could not run '%s': %w\n%s", strings.Join(runCmd.Args, " "), err, out)
+	}
+	recordStart()
+	log.Info().Msgf("started '%s' container", p.Name)
+
+	return p.listener.endpoint(ctx, p.engine, p.Name)
+}
+
+// Info implements Provider.Info.
+func (p *NerdctlProvider) Info() *ProviderInfo {
+	return p.info
+}
+
+// Logs implements Provider.Logs.
+func (p *NerdctlProvider) Logs(ctx context.Context) ([]byte, error) {
+	return containerLogs(ctx, p.engine, p.Name)
+}
+
+// Running implements Provider.Running.
+func (p *NerdctlProvider) Running(ctx context.Context) error {
+	return containerRunning(ctx, p.engine, p.Name)
+}
+
+// Kill implements Provider.Kill.
+func (p *NerdctlProvider) Kill(ctx context.Context) error {
+	defer p.listener.Close()
+
+	return killContainer(ctx, p.engine, p.Name)
+}
+
+// Stop implements Provider.Stop.
+func (p *NerdctlProvider) Stop(ctx context.Context) error {
+	defer p.listener.Close()
+
+	return stopContainer(ctx, p.engine, p.Name)
+}
@@ -0,0 +1,128 @@
+package buildkitd
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRootlessImage = "moby/buildkit:master-rootless"
+
+func newTestNerdctlProvider(t *testing.T) (*NerdctlProvider, *fakeEngine) {
+	t.Helper()
+
+	engine := newFakeEngine(t, testImage, testRootlessImage)
+
+	return NewNerdctlProvider(&NerdctlProviderOpts{
+		Binary:        engine.binary,
+		Image:         testImage,
+		RootlessImage: testRootlessImage,
+		Transport:     TransportTCP,
+		PullPolicy:    PullPolicyIfNotPresent,
+	}), engine
+}
+
+// runCall returns the `run` call of the fake engine.
+func runCall(t *testing.T, engine *fakeEngine) string {
+	t.Helper()
+
+	for _, call := range engine.calls(t) {
+		if strings.HasPrefix(call, "run ") {
+			return call
+		}
+	}
+	require.Fail(t, "no run call", engine.calls(t))
+
+	return ""
+}
+
+func TestNerdctlProviderIsSupported(t *testing.T) {
+	t.Run("containerd running", func(t *testing.T) {
+		p, _ := newTestNerdctlProvider(t)
+		assert.NoError(t, p.IsSupported(context.Background()))
+	})
+
+	t.Run("containerd not running", func(t *testing.T) {
+		p, _ := newTestNerdctlProvider(t)
+		t.Setenv("FAKE_ENGINE_FAIL", "info")
+		assert.Error(t, p.IsSupported(context.Background()))
+	})
+
+	t.Run("nerdctl not installed", func(t *testing.T) {
+		p := NewNerdctlProvider(&NerdctlProviderOpts{Binary: filepath.Join(t.TempDir(), "nerdctl")})
+		assert.Error(t, p.IsSupported(context.Background()))
+	})
+}
+
+func TestNerdctlProviderRootful(t *testing.T) {
+	p, engine := newTestNerdctlProvider(t)
+	require.NoError(t, p.IsSupported(context.Background()))
+
+	endpoint, err := p.Start(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "tcp://127.0.0.1:49153", endpoint.Address)
+	assert.False(t, p.Info().Rootless)
+
+	run := runCall(t, engine)
+	assert.Contains(t, run, " --privileged ")
+	assert.Contains(t, run, " "+testImage+" ")
+	assert.NotContains(t, run, "--rm")
+	assert.NotContains(t, run, "--oci-worker-no-process-sandbox")
+
+	require.NoError(t, p.Stop(context.Background()))
+	calls := engine.calls(t)
+	assert.Equal(t, []string{"stop " + p.Name, "rm --force " + p.Name}, calls[len(calls)-2:])
+}
+
+func TestNerdctlProviderStopFailure(t *testing.T) {
+	p, engine := newTestNerdctlProvider(t)
+	require.NoError(t, p.IsSupported(context.Background()))
+
+	_, err := p.Start(context.Background())
+	require.NoError(t, err)
+
+	// the container is removed even if it could not be stopped.
+	t.Setenv("FAKE_ENGINE_FAIL", "stop")
+	err = p.Stop(context.Background())
+	assert.ErrorContains(t, err, "stop failed")
+	calls := engine.calls(t)
+	assert.Equal(t, "rm --force "+p.Name, calls[len(calls)-1])
+}
+
+func TestNerdctlProviderRootless(t *testing.T) {
+	p, engine := newTestNerdctlProvider(t)
+	t.Setenv("FAKE_ENGINE_ROOTLESS", "1")
+	require.NoError(t, p.IsSupported(context.Background()))
+
+	_, err := p.Start(context.Background())
+	require.NoError(t, err)
+
+	run := runCall(t, engine)
+	assert.NotContains(t, run, "--privileged")
+	assert.Contains(t, run, " --security-opt seccomp=unconfined ")
+	assert.Contains(t, run, " "+testRootlessImage+" ")
+	assert.True(t, strings.HasSuffix(run, " --oci-worker-no-process-sandbox"), run)
+	assert.True(t, p.Info().Rootless)
+
+	require.NoError(t, p.Kill(context.Background()))
+	assert.Contains(t, engine.calls(t), "rm --force "+p.Name)
+}
+
+func TestNerdctlProviderRuntime(t *testing.T) {
+	p, engine := newTestNerdctlProvider(t)
+	p.opts.Runtime = &RuntimeOpts{CPUs: 2, PidsLimit: 512}
+	t.Setenv("FAKE_ENGINE_ROOTLESS", "1")
+	require.NoError(t, p.IsSupported(context.Background()))
+
+	_, err := p.Start(context.Background())
+	require.NoError(t, err)
+	defer p.Stop(context.Background())
+
+	run := runCall(t, engine)
+	assert.Contains(t, run, " --cpus 2 --pids-limit 512 ")
+	assert.True(t, strings.HasSuffix(run, " --oci-worker-max-parallelism 2 --oci-worker-no-process-sandbox"), run)
+}
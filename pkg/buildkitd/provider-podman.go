@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 
+	"github.com/VJftw/please-buildkit/pkg/stats"
 	"github.com/rs/zerolog/log"
 )
 
@@ -15,12 +15,42 @@ import (
 type PodmanProviderOpts struct {
 	Binary string
 	Image  string
+	// Transport is how buildkitd is exposed to the host, one of Transports.
+	Transport string
+	// ConfigFile is an optional `buildkitd.toml` to configure buildkitd with.
+	ConfigFile string
+	// PullPolicy is when to pull Image, one of PullPolicies.
+	PullPolicy string
+	// ImageTar is an optional tarball of the buildkitd image to load instead
+	// of pulling Image.
+	ImageTar string
+	// ImageDigest is the config or manifest digest which ImageTar must have,
+	// unless Image is pinned by digest.
+	ImageDigest string
+	// State is optional persistent buildkitd state to run buildkitd with.
+	State *State
+	// Runtime is optional resource limits and runtime options of buildkitd.
+	Runtime *RuntimeOpts
+	// StorageDir is an optional directory to use as podman's storage instead
+	// of a new per-session one, e.g. to reuse the buildkitd image between
+	// builds.
+	StorageDir string
+	// StorageCleanup is when to remove the storage, one of PodmanCleanups.
+	StorageCleanup string
+	// Workspace is the root of the Please workspace which per-session storage
+	// is kept for, see PodmanSessionsDir. It is required unless StorageDir is
+	// given.
+	Workspace string
 }
 
 // PodmanProvider implements the buildkit provider via Podman.
 type PodmanProvider struct {
 	Provider
-	opts *PodmanProviderOpts
+	listener *listener
+	engine   *containerEngine
+	info     *ProviderInfo
+	storage  *podmanStorage
+	opts     *PodmanProviderOpts
 
 	Name string
 }
@@ -28,7 +58,9 @@ type PodmanProvider struct {
 // NewPodmanProvider returns a new buildkit provider implemented via Podman.
 func NewPodmanProvider(o *PodmanProviderOpts) *PodmanProvider {
 	return &PodmanProvider{
-		opts: o,
+		opts:   o,
+		engine: &containerEngine{binary: o.Binary},
+		info:   &ProviderInfo{Name: "podman"},
 	}
 }
 
@@ -39,69 +71,127 @@ func (p *PodmanProvider) IsSupported(ctx context.Context) error {
 	}...).Run(); err != nil {
 		return err
 	}
+	// podman runs containers as the user which runs it.
+	p.info.Rootless = os.Geteuid() != 0
 
 	return nil
 }
 
 // Start implements Provider.Start.
-func (p *PodmanProvider) Start(ctx context.Context, address string) error {
-
-	portNumber := strings.Split(address, ":")[2]
-	p.Name = fmt.Sprintf("please-buildkit-%s", portNumber)
-
-	log.Info().Msgf("pulling image '%s'", p.opts.Image)
-	pullCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
-		"pull",
-		p.opts.Image,
-	}...)
-	if err := pullCmd.Run(); err != nil {
-		return fmt.Errorf("could not run '%s': %w", strings.Join(pullCmd.Args, " "), err)
+func (p *PodmanProvider) Start(ctx context.Context) (*Endpoint, error) {
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.opts.StorageCleanup {
+	case "", PodmanCleanupAuto, PodmanCleanupAlways, PodmanCleanupNever:
+	default:
+		return nil, fmt.Errorf("invalid podman storage cleanup '%s', must be one of: %s", p.opts.StorageCleanup, strings.Join(PodmanCleanups, ", "))
+	}
+
+	p.listener, err = newListener(p.opts.Transport)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Info().Msgf("starting '%s' container", p.Name)
+	// podman uses its own storage so that it can be cleaned up without
+	// removing the user's images and containers.
+	p.storage, err = newPodmanStorage(p.opts.StorageDir, p.opts.Workspace)
+	if err != nil {
+		return nil, err
+	}
+	p.engine.globalArgs = p.storage.globalArgs()
+
+	imageRef, err := prepareImage(ctx, p.engine, p.opts.Image, p.opts.PullPolicy, p.opts.ImageTar, p.opts.ImageDigest)
+	if err != nil {
+		return nil, err
+	}
+	p.engine.describe(ctx, p.info, imageRef, "version", "--format", "{{.Client.Version}}")
+
+	// volumes are kept in podman's storage, which may be removed, so the
+	// state is kept in a directory instead.
+	stateArgs, err := p.opts.State.dirRunArgs(stateMountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("starting '%s' container", name)
 	// TODO: attempt to set XDG_RUNTIME_DIR, $TMPDIR, $HOME to be much shorter
-	runCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
+	runArgs := []string{
 		"run",
 		"-d",
-		"--rm",
-		"--name", p.Name,
+		"--name", name,
 		"--privileged",
-		"--publish", fmt.Sprintf("%s:%s", portNumber, portNumber),
-		p.opts.Image,
-		"--addr",
-		address,
-	}...)
+	}
+	runArgs = append(runArgs, labelRunArgs()...)
+	runArgs = append(runArgs, p.listener.runArgs()...)
+	runArgs = append(runArgs, configRunArgs(p.opts.ConfigFile)...)
+	runArgs = append(runArgs, stateArgs...)
+	runArgs = append(runArgs, p.opts.Runtime.runArgs()...)
+	runArgs = append(runArgs, imageRef)
+	runArgs = append(runArgs, p.listener.buildkitdArgs()...)
+	runArgs = append(runArgs, configBuildkitdArgs(p.opts.ConfigFile)...)
+	runArgs = append(runArgs, p.opts.Runtime.buildkitdArgs()...)
+	// the container may exist as soon as it is run, so it must be cleaned up
+	// from here on.
+	p.Name = name
+	runCmd := p.engine.command(ctx, runArgs...)
+	recordStart := stats.Start(ctx, stats.PhaseContainerStart)
 	runOut, err := runCmd.CombinedOutput()
 	if err != nil {
 		log.Error().Err(err).Strs("cmd", runCmd.Args).Msgf("%s", runOut)
-		return err
+		return nil, err
 	}
+	recordStart()
 	log.Info().Msgf("started '%s' container", p.Name)
 
+	return p.listener.endpoint(ctx, p.engine, p.Name)
+}
+
+// Info implements Provider.Info.
+func (p *PodmanProvider) Info() *ProviderInfo {
+	return p.info
+}
+
+// Logs implements Provider.Logs.
+func (p *PodmanProvider) Logs(ctx context.Context) ([]byte, error) {
+	return containerLogs(ctx, p.engine, p.Name)
+}
+
+// Running implements Provider.Running.
+func (p *PodmanProvider) Running(ctx context.Context) error {
+	return containerRunning(ctx, p.engine, p.Name)
+}
+
+// Kill implements Provider.Kill.
+func (p *PodmanProvider) Kill(ctx context.Context) error {
+	defer p.listener.Close()
+
+	if err := killContainer(ctx, p.engine, p.Name); err != nil {
+		return err
+	}
+	p.cleanupStorage(ctx)
+
 	return nil
 }
 
 // Stop implements Provider.Stop.
 func (p *PodmanProvider) Stop(ctx context.Context) error {
-	log.Info().Msgf("stopping '%s' container", p.Name)
-	stopCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
-		"stop",
-		p.Name,
-	}...)
-	stopOut, err := stopCmd.CombinedOutput()
-	if err != nil {
-		log.Error().Err(err).Strs("cmd", stopCmd.Args).Msgf("%s", stopOut)
-		return err
-	}
+	defer p.listener.Close()
 
-	cleanupCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
-		"unshare",
-		"rm", "-rf", filepath.Join(os.Getenv("HOME"), ".local/share/containers/storage"),
-	}...)
-	cleanupOut, err := cleanupCmd.CombinedOutput()
-	if err != nil {
-		log.Warn().Err(err).Strs("cmd", cleanupCmd.Args).Msgf("%s", cleanupOut)
+	if err := stopContainer(ctx, p.engine, p.Name); err != nil {
+		return err
 	}
+	p.cleanupStorage(ctx)
 
 	return nil
 }
+
+// cleanupStorage removes podman's storage according to the cleanup policy,
+// if it was created.
+func (p *PodmanProvider) cleanupStorage(ctx context.Context) {
+	if err := p.storage.cleanup(ctx, p.opts.Binary, p.opts.StorageCleanup); err != nil {
+		log.Warn().Err(err).Msgf("could not remove podman storage '%s'", p.storage.dir)
+	}
+}
@@ -0,0 +1,92 @@
+package buildkitd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// RemoteProviderOpts represents the options for the remote buildkitd provider.
+type RemoteProviderOpts struct {
+	// Address is the address of an externally managed buildkitd, e.g.
+	// `tcp://buildkitd.example.com:1234`.
+	Address string
+	// TLS is the optional user-supplied credentials to connect to buildkitd
+	// with. Any of its paths may be empty, e.g. to only verify the server.
+	TLS *TLSCredentials
+}
+
+// RemoteProvider implements the buildkit provider by connecting to an
+// externally managed buildkitd, which it never starts or stops.
+type RemoteProvider struct {
+	Provider
+	info *ProviderInfo
+	opts *RemoteProviderOpts
+}
+
+// NewRemoteProvider returns a new buildkit provider which connects to an
+// externally managed buildkitd.
+func NewRemoteProvider(o *RemoteProviderOpts) *RemoteProvider {
+	return &RemoteProvider{
+		opts: o,
+		info: &ProviderInfo{Name: "remote"},
+	}
+}
+
+// IsSupported implements Provider.IsSupported.
+func (p *RemoteProvider) IsSupported(ctx context.Context) error {
+	if p.opts.Address == "" {
+		return fmt.Errorf("no remote buildkitd address is set")
+	}
+
+	if p.opts.TLS != nil {
+		for _, path := range []string{p.opts.TLS.CACert, p.opts.TLS.Cert, p.opts.TLS.Key} {
+			if path == "" {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("could not read remote buildkitd TLS credentials: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Start implements Provider.Start.
+func (p *RemoteProvider) Start(ctx context.Context) (*Endpoint, error) {
+	transport, _, _ := strings.Cut(p.opts.Address, "://")
+
+	return &Endpoint{Address: p.opts.Address, TLS: p.opts.TLS, Transport: transport}, nil
+}
+
+// Info implements Provider.Info.
+func (p *RemoteProvider) Info() *ProviderInfo {
+	return p.info
+}
+
+// Logs implements Provider.Logs. The logs of an externally managed buildkitd
+// are not available.
+func (p *RemoteProvider) Logs(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+// Running implements Provider.Running. Whether an externally managed buildkitd
+// is running cannot be known other than by connecting to it.
+func (p *RemoteProvider) Running(ctx context.Context) error {
+	return errors.New("cannot check whether a remote buildkitd is running")
+}
+
+// Stop implements Provider.Stop. An externally managed buildkitd is left
+// running.
+func (p *RemoteProvider) Stop(ctx context.Context) error {
+	return nil
+}
+
+// Kill implements Provider.Kill. An externally managed buildkitd is left
+// running.
+func (p *RemoteProvider) Kill(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,41 @@
+package buildkitd
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteProvider(t *testing.T) {
+	ctx := context.Background()
+	_, client, err := GenerateTLSCredentials(t.TempDir(), tlsHosts)
+	require.NoError(t, err)
+
+	p := NewRemoteProvider(&RemoteProviderOpts{Address: "tcp://buildkitd.example.com:1234", TLS: client})
+	require.NoError(t, p.IsSupported(ctx))
+
+	endpoint, err := p.Start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &Endpoint{Address: "tcp://buildkitd.example.com:1234", TLS: client, Transport: TransportTCP}, endpoint)
+	assert.Equal(t, "remote", p.Info().Name)
+
+	// an externally managed buildkitd is never stopped.
+	assert.NoError(t, p.Stop(ctx))
+	assert.NoError(t, p.Kill(ctx))
+	assert.NotErrorIs(t, p.Running(ctx), ErrExited)
+
+	t.Run("no address", func(t *testing.T) {
+		assert.Error(t, NewRemoteProvider(&RemoteProviderOpts{}).IsSupported(ctx))
+	})
+
+	t.Run("missing credentials", func(t *testing.T) {
+		p := NewRemoteProvider(&RemoteProviderOpts{
+			Address: "tcp://buildkitd.example.com:1234",
+			TLS:     &TLSCredentials{CACert: filepath.Join(t.TempDir(), "ca.pem")},
+		})
+		assert.ErrorContains(t, p.IsSupported(ctx), "TLS credentials")
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/VJftw/please-buildkit/pkg/stats"
 	"github.com/rs/zerolog/log"
 )
 
@@ -14,19 +15,40 @@ import (
 type RootlessDockerProviderOpts struct {
 	Binary string
 	Image  string
+	// Transport is how buildkitd is exposed to the host, one of Transports.
+	Transport string
+	// ConfigFile is an optional `buildkitd.toml` to configure buildkitd with.
+	ConfigFile string
+	// PullPolicy is when to pull Image, one of PullPolicies.
+	PullPolicy string
+	// ImageTar is an optional tarball of the buildkitd image to load instead
+	// of pulling Image.
+	ImageTar string
+	// ImageDigest is the config or manifest digest which ImageTar must have,
+	// unless Image is pinned by digest.
+	ImageDigest string
+	// State is optional persistent buildkitd state to run buildkitd with.
+	State *State
+	// Runtime is optional resource limits and runtime options of buildkitd.
+	Runtime *RuntimeOpts
 }
 
 // RootlessDockerProvider implements the buildkit provider via Docker.
 type RootlessDockerProvider struct {
 	Provider
-	Name string
-	opts *RootlessDockerProviderOpts
+	listener *listener
+	engine   *containerEngine
+	info     *ProviderInfo
+	Name     string
+	opts     *RootlessDockerProviderOpts
 }
 
 // NewRootlessDockerProvider returns a new buildkit provider implemented via Docker.
 func NewRootlessDockerProvider(o *RootlessDockerProviderOpts) *RootlessDockerProvider {
 	return &RootlessDockerProvider{
-		opts: o,
+		opts:   o,
+		engine: &containerEngine{binary: o.Binary},
+		info:   &ProviderInfo{Name: "rootless-docker", Rootless: true},
 	}
 }
 
@@ -68,57 +90,89 @@ func (p *RootlessDockerProvider) IsSupported(ctx context.Context) error {
 }
 
 // Start implements Provider.Start.
-func (p *RootlessDockerProvider) Start(ctx context.Context, address string) error {
-
-	portNumber := strings.Split(address, ":")[2]
-	p.Name = fmt.Sprintf("please-buildkit-%s", portNumber)
-	log.Info().Msgf("pulling image '%s'", p.opts.Image)
-	pullCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
-		"pull",
-		p.opts.Image,
-	}...)
-	if err := pullCmd.Run(); err != nil {
-		return fmt.Errorf("could not run '%s': %w", strings.Join(pullCmd.Args, " "), err)
+func (p *RootlessDockerProvider) Start(ctx context.Context) (*Endpoint, error) {
+	name, err := containerName()
+	if err != nil {
+		return nil, err
+	}
+
+	p.listener, err = newListener(p.opts.Transport)
+	if err != nil {
+		return nil, err
+	}
+
+	imageRef, err := prepareImage(ctx, p.engine, p.opts.Image, p.opts.PullPolicy, p.opts.ImageTar, p.opts.ImageDigest)
+	if err != nil {
+		return nil, err
 	}
+	p.engine.describe(ctx, p.info, imageRef, "version", "--format", "{{.Server.Version}}")
 
-	runCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
+	stateArgs, err := p.opts.State.volumeRunArgs(ctx, p.engine, rootlessStateMountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	runArgs := []string{
 		"run",
-		"--rm",
 		"-d",
 		"--security-opt", "seccomp=unconfined",
 		"--security-opt", "apparmor=unconfined",
 		"--security-opt", "systempaths=unconfined",
-		"--name", p.Name,
-		"--publish", fmt.Sprintf("%s:%s", portNumber, portNumber),
-		p.opts.Image,
-		"--addr",
-		address,
-		"--oci-worker-no-process-sandbox",
-	}...)
+		"--name", name,
+	}
+	runArgs = append(runArgs, labelRunArgs()...)
+	runArgs = append(runArgs, p.listener.runArgs()...)
+	runArgs = append(runArgs, configRunArgs(p.opts.ConfigFile)...)
+	runArgs = append(runArgs, stateArgs...)
+	runArgs = append(runArgs, p.opts.Runtime.runArgs()...)
+	runArgs = append(runArgs, imageRef)
+	runArgs = append(runArgs, p.listener.buildkitdArgs()...)
+	runArgs = append(runArgs, configBuildkitdArgs(p.opts.ConfigFile)...)
+	runArgs = append(runArgs, p.opts.Runtime.buildkitdArgs()...)
+	runArgs = append(runArgs, "--oci-worker-no-process-sandbox")
+	// the container may exist as soon as it is run, so it must be cleaned up
+	// from here on.
+	p.Name = name
+	runCmd := p.engine.command(ctx, runArgs...)
 	runCmd.Stdout = os.Stdout
 	runCmd.Stderr = os.Stderr
 
 	log.Info().Str("cmd", strings.Join(runCmd.Args, " ")).Msgf("starting '%s' container", p.Name)
+	recordStart := stats.Start(ctx, stats.PhaseContainerStart)
 	if err := runCmd.Run(); err != nil {
-		return fmt.Errorf("could not run '%s': %w", strings.Join(runCmd.Args, " "), err)
+		return nil, fmt.Errorf("could not run '%s': %w", strings.Join(runCmd.Args, " "), err)
 	}
+	recordStart()
 	log.Info().Msgf("started '%s' container", p.Name)
 
-	return nil
+	return p.listener.endpoint(ctx, p.engine, p.Name)
+}
+
+// Info implements Provider.Info.
+func (p *RootlessDockerProvider) Info() *ProviderInfo {
+	return p.info
+}
+
+// Logs implements Provider.Logs.
+func (p *RootlessDockerProvider) Logs(ctx context.Context) ([]byte, error) {
+	return containerLogs(ctx, p.engine, p.Name)
+}
+
+// Running implements Provider.Running.
+func (p *RootlessDockerProvider) Running(ctx context.Context) error {
+	return containerRunning(ctx, p.engine, p.Name)
+}
+
+// Kill implements Provider.Kill.
+func (p *RootlessDockerProvider) Kill(ctx context.Context) error {
+	defer p.listener.Close()
+
+	return killContainer(ctx, p.engine, p.Name)
 }
 
 // Stop implements Provider.Stop.
 func (p *RootlessDockerProvider) Stop(ctx context.Context) error {
-	log.Info().Msgf("stopping '%s' container", p.Name)
-	stopCmd := exec.CommandContext(ctx, p.opts.Binary, []string{
-		"stop",
-		p.Name,
-	}...)
-	stopOut, err := stopCmd.CombinedOutput()
-	if err != nil {
-		log.Error().Err(err).Strs("cmd", stopCmd.Args).Msgf("%s", stopOut)
-		return err
-	}
+	defer p.listener.Close()
 
-	return nil
+	return stopContainer(ctx, p.engine, p.Name)
 }
@@ -2,9 +2,9 @@ package buildkitd
 
 import (
 	"context"
-	"os"
-	"os/exec"
-	"time"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
@@ -16,41 +16,125 @@ type Provider interface {
 	// this host.
 	IsSupported(ctx context.Context) error
 	// Start starts the `buildkitd` daemon using the implementation and returns
-	// the buildkitd address to use as `BUILDKIT_HOST`. This should wait for the
-	// daemon to be ready.
-	Start(ctx context.Context, address string) error
-	// Stop stops the `buildkitd` daemon using the implementation.
+	// how to connect to it.
+	Start(ctx context.Context) (*Endpoint, error)
+	// Info describes the implementation and the `buildkitd` daemon it started.
+	// Details which are not known, e.g. before Start, are left empty.
+	Info() *ProviderInfo
+	// Logs returns the logs of the started `buildkitd` daemon, or nothing if
+	// it was never started.
+	Logs(ctx context.Context) ([]byte, error)
+	// Running returns an error wrapping ErrExited if the started `buildkitd`
+	// daemon has exited, e.g. as it crashed, or any error checking it.
+	Running(ctx context.Context) error
+	// Stop stops the `buildkitd` daemon using the implementation. It should
+	// do nothing if the daemon was never started.
 	Stop(ctx context.Context) error
+	// Kill forcefully stops and removes the `buildkitd` daemon using the
+	// implementation. It should do nothing if the daemon was never started.
+	Kill(ctx context.Context) error
 }
 
-func WaitForBuildKitWorkers(
-	buildctlBinary string,
-	addr string,
-	timeout time.Duration,
-) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	_ = cancel
-	log.Info().Msgf("waiting for buildkit workers %s", addr)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(250 * time.Millisecond):
-			cmd := exec.CommandContext(ctx,
-				buildctlBinary,
-				[]string{"debug", "workers"}...,
-			)
-			cmd.Env = append(os.Environ(), []string{"BUILDKIT_HOST=" + addr}...)
-			stdoutStderr, err := cmd.CombinedOutput()
-			if err != nil {
-				log.Warn().Err(err).Msgf("buildkit workers failed: %s", stdoutStderr)
-				continue
-			}
-
-			log.Info().Msgf("%s is available", addr)
-
-			return nil
-		}
+// ErrExited is returned when the `buildkitd` daemon has exited.
+var ErrExited = errors.New("buildkitd exited")
+
+// Endpoint is how to connect to a started `buildkitd` daemon.
+type Endpoint struct {
+	// Address is the buildkitd address to use as `BUILDKIT_HOST`.
+	Address string
+	// TLS is the credentials to connect with, or nil if none are required.
+	TLS *TLSCredentials
+	// Transport is how buildkitd is exposed, one of Transports.
+	Transport string
+}
+
+// ProviderInfo describes a Provider and the `buildkitd` daemon it runs.
+type ProviderInfo struct {
+	// Name is the name of the provider, e.g. `podman`.
+	Name string
+	// EngineVersion is the version of the container engine, or Kubernetes,
+	// which runs buildkitd.
+	EngineVersion string
+	// Rootless is whether buildkitd runs without root privileges.
+	Rootless bool
+	// Platforms are the platforms buildkitd natively builds for, i.e. those of
+	// its image, which is run for the host's platform.
+	Platforms []string
+	// ImageDigest is the manifest digest of the buildkitd image in the
+	// registry it was pulled from or, for images which were not pulled, e.g.
+	// those loaded from tarballs, the engine's image ID.
+	ImageDigest string
+}
+
+// killContainer forcefully stops and removes the given container, if any.
+func killContainer(ctx context.Context, engine *containerEngine, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	log.Warn().Msgf("killing '%s' container", name)
+	rmCmd := engine.command(ctx, "rm", "--force", name)
+	if out, err := rmCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("could not run '%s': %w\n%s", strings.Join(rmCmd.Args, " "), err, out)
+	}
+
+	return nil
+}
+
+// containerLogs returns the logs of the given container, if any.
+func containerLogs(ctx context.Context, engine *containerEngine, name string) ([]byte, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	logsCmd := engine.command(ctx, "logs", name)
+	out, err := logsCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("could not run '%s': %w\n%s", strings.Join(logsCmd.Args, " "), err, out)
+	}
+
+	return out, nil
+}
+
+// stopContainer stops and removes the given container, if any. Containers are
+// not run with `--rm` so that their logs are kept if buildkitd exits. The
+// container is removed even if it could not be stopped gracefully, so that it
+// is not leaked.
+func stopContainer(ctx context.Context, engine *containerEngine, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	log.Info().Msgf("stopping '%s' container", name)
+	var stopErr error
+	stopCmd := engine.command(ctx, "stop", name)
+	if out, err := stopCmd.CombinedOutput(); err != nil {
+		stopErr = fmt.Errorf("could not run '%s': %w\n%s", strings.Join(stopCmd.Args, " "), err, out)
+	}
+
+	var rmErr error
+	rmCmd := engine.command(ctx, "rm", "--force", name)
+	if out, err := rmCmd.CombinedOutput(); err != nil {
+		rmErr = fmt.Errorf("could not run '%s': %w\n%s", strings.Join(rmCmd.Args, " "), err, out)
 	}
+
+	return errors.Join(stopErr, rmErr)
+}
+
+// containerRunning returns an error wrapping ErrExited if the given container
+// has exited.
+func containerRunning(ctx context.Context, engine *containerEngine, name string) error {
+	inspectCmd := engine.command(ctx, "inspect", "--format", "{{.State.Status}} {{.State.ExitCode}}", name)
+	out, err := inspectCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not run '%s': %w\n%s", strings.Join(inspectCmd.Args, " "), err, out)
+	}
+
+	status, exitCode, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	switch status {
+	case "exited", "dead":
+		return fmt.Errorf("%w: '%s' container is %s with exit code %s", ErrExited, name, status, exitCode)
+	}
+
+	return nil
 }
@@ -0,0 +1,192 @@
+package buildkitd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/rs/zerolog/log"
+)
+
+// LabelWorkerSnapshotter is the label of buildkitd workers which names their
+// snapshotter.
+const LabelWorkerSnapshotter = "org.mobyproject.buildkit.worker.snapshotter"
+
+// workerPollInterval is how often buildkitd is checked for workers.
+var workerPollInterval = 250 * time.Millisecond
+
+// WaitOpts represents the options for waiting for buildkitd's workers.
+type WaitOpts struct {
+	BuildctlBinary string
+	// Timeout is how long to wait for buildkitd to have workers.
+	Timeout time.Duration
+	// Platforms are the platforms, e.g. `linux/arm64`, which a worker must
+	// support.
+	Platforms []string
+	// Snapshotter is the snapshotter, e.g. `overlayfs`, which a worker must
+	// use, if any.
+	Snapshotter string
+}
+
+// WorkerInfo describes a buildkitd worker as reported by `buildctl debug
+// workers`.
+type WorkerInfo struct {
+	ID        string
+	Labels    map[string]string
+	Platforms []v1.Platform
+}
+
+// WaitForBuildKitWorkers waits for `buildkitd` at the given endpoint, started
+// by the given worker, to have a worker which meets the given options and
+// returns its workers. It fails early if `buildkitd` exits or the given
+// context is cancelled.
+func WaitForBuildKitWorkers(
+	ctx context.Context,
+	worker *Worker,
+	endpoint *Endpoint,
+	opts *WaitOpts,
+) ([]*WorkerInfo, error) {
+	platforms := make([]v1.Platform, 0, len(opts.Platforms))
+	for _, p := range opts.Platforms {
+		platform, err := v1.ParsePlatform(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform '%s': %w", p, err)
+		}
+		platforms = append(platforms, *platform)
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	log.Info().Msgf("waiting for buildkit workers %s", endpoint.Address)
+	ticker := time.NewTicker(workerPollInterval)
+	defer ticker.Stop()
+
+	// lastErr is the last error of buildctl which was not caused by the
+	// context, which kills buildctl when it is done.
+	var lastErr error
+	for {
+		workers, err := listWorkers(ctx, opts.BuildctlBinary, endpoint)
+		if err == nil {
+			for _, w := range workers {
+				log.Info().
+					Str("id", w.ID).
+					Strs("platforms", w.platforms()).
+					Interface("labels", w.Labels).
+					Msg("found buildkit worker")
+			}
+
+			if err := matchWorkers(workers, platforms, opts.Snapshotter); err != nil {
+				return nil, err
+			}
+			log.Info().Msgf("%s is available", endpoint.Address)
+
+			return workers, nil
+		}
+		if ctx.Err() == nil {
+			lastErr = err
+			log.Warn().Err(err).Msg("buildkit workers failed")
+		}
+
+		if runErr := worker.Running(ctx); errors.Is(runErr, ErrExited) {
+			return nil, runErr
+		} else if runErr != nil {
+			log.Debug().Err(runErr).Msg("could not check whether buildkitd is running")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w, last error: %v", ctx.Err(), lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// listWorkers returns the workers of `buildkitd` at the given endpoint.
+func listWorkers(ctx context.Context, buildctlBinary string, endpoint *Endpoint) ([]*WorkerInfo, error) {
+	cmd := exec.CommandContext(ctx,
+		buildctlBinary,
+		append(endpoint.TLS.BuildctlArgs(), "debug", "workers", "--format", "{{json .}}")...,
+	)
+	cmd.Env = append(os.Environ(), "BUILDKIT_HOST="+endpoint.Address)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not run '%s': %w\n%s", strings.Join(cmd.Args, " "), err, stderr.String())
+	}
+
+	workers := []*WorkerInfo{}
+	if err := json.Unmarshal(out, &workers); err != nil {
+		return nil, fmt.Errorf("could not parse buildkit workers: %w", err)
+	}
+
+	return workers, nil
+}
+
+// matchWorkers returns an error unless one of the given workers supports all
+// of the given platforms and uses the given snapshotter, if any.
+func matchWorkers(workers []*WorkerInfo, platforms []v1.Platform, snapshotter string) error {
+	if len(workers) == 0 {
+		return fmt.Errorf("buildkitd has no workers")
+	}
+
+	found := make([]string, 0, len(workers))
+	for _, w := range workers {
+		if w.supports(platforms, snapshotter) {
+			return nil
+		}
+		found = append(found, fmt.Sprintf("%s (platforms: %s, snapshotter: %s)",
+			w.ID, strings.Join(w.platforms(), ","), w.Labels[LabelWorkerSnapshotter]))
+	}
+
+	wanted := make([]string, 0, len(platforms))
+	for _, p := range platforms {
+		wanted = append(wanted, p.String())
+	}
+
+	return fmt.Errorf("no buildkit worker supports platforms '%s' with snapshotter '%s', found: %s",
+		strings.Join(wanted, ","), snapshotter, strings.Join(found, "; "))
+}
+
+// supports returns whether the worker supports all of the given platforms and
+// uses the given snapshotter, if any.
+func (w *WorkerInfo) supports(platforms []v1.Platform, snapshotter string) bool {
+	if snapshotter != "" && w.Labels[LabelWorkerSnapshotter] != snapshotter {
+		return false
+	}
+
+	for _, want := range platforms {
+		supported := false
+		for _, have := range w.Platforms {
+			if have.Satisfies(want) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+
+	return true
+}
+
+// platforms returns the platforms of the worker, e.g. `linux/amd64`.
+func (w *WorkerInfo) platforms() []string {
+	platforms := make([]string, 0, len(w.Platforms))
+	for _, p := range w.Platforms {
+		platforms = append(platforms, p.String())
+	}
+
+	return platforms
+}
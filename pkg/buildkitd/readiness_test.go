@@ -0,0 +1,140 @@
+package buildkitd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBuildctlScript is a stand-in for buildctl which prints the workers in
+// $FAKE_BUILDCTL_WORKERS, or fails if it does not exist, e.g. while buildkitd
+// is starting.
+const fakeBuildctlScript = `#!/bin/sh
+if [ ! -f "$FAKE_BUILDCTL_WORKERS" ]; then
+	echo "connection refused" >&2
+	exit 1
+fi
+cat "$FAKE_BUILDCTL_WORKERS"
+`
+
+const testWorkers = `[{
+	"id": "abc123",
+	"labels": {"org.mobyproject.buildkit.worker.snapshotter": "overlayfs"},
+	"platforms": [
+		{"architecture": "amd64", "os": "linux"},
+		{"architecture": "arm64", "os": "linux", "variant": "v8"}
+	]
+}]`
+
+// newTestWaitOpts returns options to wait for workers with a fake buildctl,
+// which prints the given workers, if any.
+func newTestWaitOpts(t *testing.T, workers string) *WaitOpts {
+	t.Helper()
+
+	interval := workerPollInterval
+	workerPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { workerPollInterval = interval })
+
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "buildctl")
+	require.NoError(t, os.WriteFile(binary, []byte(fakeBuildctlScript), 0o755))
+	workersPath := filepath.Join(dir, "workers.json")
+	if workers != "" {
+		require.NoError(t, os.WriteFile(workersPath, []byte(workers), 0o644))
+	}
+	t.Setenv("FAKE_BUILDCTL_WORKERS", workersPath)
+
+	return &WaitOpts{BuildctlBinary: binary, Timeout: 5 * time.Second}
+}
+
+func TestWaitForBuildKitWorkers(t *testing.T) {
+	tests := []struct {
+		name        string
+		platforms   []string
+		snapshotter string
+		wantErr     string
+	}{
+		{name: "any"},
+		{name: "platforms", platforms: []string{"linux/amd64", "linux/arm64"}},
+		{name: "snapshotter", snapshotter: "overlayfs"},
+		{name: "unsupported platform", platforms: []string{"linux/amd64", "linux/s390x"}, wantErr: "linux/s390x"},
+		{name: "other snapshotter", snapshotter: "native", wantErr: "snapshotter 'native'"},
+		{name: "invalid platform", platforms: []string{"linux/amd64/v3/x"}, wantErr: "invalid platform"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _, _ := newTestWorker(t, DefaultStopTimeout)
+			opts := newTestWaitOpts(t, testWorkers)
+			opts.Platforms = tt.platforms
+			opts.Snapshotter = tt.snapshotter
+
+			ctx := context.Background()
+			endpoint, err := w.Start(ctx)
+			require.NoError(t, err)
+			defer w.Stop(ctx)
+
+			workers, err := WaitForBuildKitWorkers(ctx, w, endpoint, opts)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, workers, 1)
+			assert.Equal(t, "abc123", workers[0].ID)
+			assert.Equal(t, "overlayfs", workers[0].Labels[LabelWorkerSnapshotter])
+		})
+	}
+}
+
+func TestWaitForBuildKitWorkersExited(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+	opts := newTestWaitOpts(t, "")
+
+	ctx := context.Background()
+	endpoint, err := w.Start(ctx)
+	require.NoError(t, err)
+	defer w.Stop(ctx)
+	require.NoError(t, os.WriteFile(filepath.Join(engine.dir, "state-"+provider.Name), []byte("exited 1\n"), 0o644))
+
+	start := time.Now()
+	_, err = WaitForBuildKitWorkers(ctx, w, endpoint, opts)
+	assert.ErrorIs(t, err, ErrExited)
+	assert.ErrorContains(t, err, "exit code 1")
+	assert.Less(t, time.Since(start), opts.Timeout)
+}
+
+func TestWaitForBuildKitWorkersCancelled(t *testing.T) {
+	w, _, _ := newTestWorker(t, DefaultStopTimeout)
+	opts := newTestWaitOpts(t, "")
+
+	endpoint, err := w.Start(context.Background())
+	require.NoError(t, err)
+	defer w.Stop(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err = WaitForBuildKitWorkers(ctx, w, endpoint, opts)
+	assert.ErrorIs(t, err, context.Canceled)
+	// the error of buildctl being killed by the context is not reported.
+	assert.ErrorContains(t, err, "connection refused")
+}
+
+func TestWaitForBuildKitWorkersTimeout(t *testing.T) {
+	w, _, _ := newTestWorker(t, DefaultStopTimeout)
+	opts := newTestWaitOpts(t, "")
+	opts.Timeout = 50 * time.Millisecond
+
+	endpoint, err := w.Start(context.Background())
+	require.NoError(t, err)
+	defer w.Stop(context.Background())
+
+	_, err = WaitForBuildKitWorkers(context.Background(), w, endpoint, opts)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "connection refused")
+}
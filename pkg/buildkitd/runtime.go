@@ -0,0 +1,171 @@
+package buildkitd
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mount is a path on the host which is mounted into buildkitd's container,
+// e.g. a CA bundle.
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// ParseMount parses a mount in the form SOURCE:TARGET[:ro]. Relative sources
+// are relative to the given directory, e.g. the workspace, and are invalid if
+// it is empty, as the working directory of a build is its sandbox.
+func ParseMount(s string, dir string) (*Mount, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid mount '%s', must be in the form SOURCE:TARGET[:ro]", s)
+	}
+
+	source := parts[0]
+	if !filepath.IsAbs(source) {
+		if dir == "" {
+			return nil, fmt.Errorf("invalid mount '%s', source must be absolute", s)
+		}
+		source = filepath.Join(dir, source)
+	}
+	if !filepath.IsAbs(parts[1]) {
+		return nil, fmt.Errorf("invalid mount '%s', target must be absolute", s)
+	}
+
+	m := &Mount{Source: source, Target: parts[1]}
+	if len(parts) == 3 {
+		if parts[2] != "ro" {
+			return nil, fmt.Errorf("invalid mount '%s', only the 'ro' option is supported", s)
+		}
+		m.ReadOnly = true
+	}
+
+	return m, nil
+}
+
+// String returns the mount in the form of `<engine> run --volume`.
+func (m *Mount) String() string {
+	if m.ReadOnly {
+		return m.Source + ":" + m.Target + ":ro"
+	}
+
+	return m.Source + ":" + m.Target
+}
+
+var memoryPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([kmgt]?)(?:i?b)?$`)
+
+// memoryUnits are the number of bytes of each unit of ParseMemory.
+var memoryUnits = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// ParseMemory parses an amount of memory like `<engine> run --memory`, e.g.
+// `512m` or `4g`, into bytes. Units are powers of 1024.
+func ParseMemory(s string) (int64, error) {
+	matches := memoryPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid memory '%s', must be a number of bytes with an optional unit: k, m, g or t", s)
+	}
+
+	n, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory '%s': %w", s, err)
+	}
+
+	return int64(n * float64(memoryUnits[matches[2]])), nil
+}
+
+// RuntimeOpts represents the resource limits and runtime options of
+// buildkitd. The zero value imposes no limits.
+type RuntimeOpts struct {
+	// CPUs is the number of CPUs buildkitd may use, e.g. 1.5, or 0 for no
+	// limit.
+	CPUs float64
+	// Memory is the number of bytes of memory buildkitd may use, or 0 for no
+	// limit.
+	Memory int64
+	// PidsLimit is the maximum number of processes buildkitd may run, or 0
+	// for no limit.
+	PidsLimit int64
+	// MaxParallelism is the maximum number of build steps buildkitd runs in
+	// parallel. It defaults to the CPU limit, rounded up.
+	MaxParallelism int
+	// Mounts are extra paths on the host to mount into buildkitd's container.
+	Mounts []*Mount
+	// Env are extra environment variables of buildkitd in the form KEY=VALUE.
+	Env []string
+	// DNS are the DNS servers of buildkitd, instead of the engine's default.
+	DNS []string
+	// DNSSearch are extra DNS search domains of buildkitd.
+	DNSSearch []string
+	// DNSOptions are extra resolver options of buildkitd, e.g. `ndots:2`.
+	DNSOptions []string
+}
+
+// runArgs returns the arguments to `<engine> run` which apply the options. It
+// is safe to call on nil options.
+func (o *RuntimeOpts) runArgs() []string {
+	if o == nil {
+		return nil
+	}
+
+	args := []string{}
+	if o.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(o.CPUs, 'f', -1, 64))
+	}
+	if o.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(o.Memory, 10))
+	}
+	if o.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(o.PidsLimit, 10))
+	}
+	for _, m := range o.Mounts {
+		args = append(args, "--volume", m.String())
+	}
+	for _, env := range o.Env {
+		args = append(args, "--env", env)
+	}
+	for _, dns := range o.DNS {
+		args = append(args, "--dns", dns)
+	}
+	for _, search := range o.DNSSearch {
+		args = append(args, "--dns-search", search)
+	}
+	for _, opt := range o.DNSOptions {
+		args = append(args, "--dns-option", opt)
+	}
+
+	return args
+}
+
+// buildkitdArgs returns the arguments to buildkitd which apply the options.
+// It is safe to call on nil options.
+func (o *RuntimeOpts) buildkitdArgs() []string {
+	if n := o.maxParallelism(); n > 0 {
+		return []string{"--oci-worker-max-parallelism", strconv.Itoa(n)}
+	}
+
+	return nil
+}
+
+// maxParallelism returns the maximum number of build steps buildkitd runs in
+// parallel, or 0 for buildkitd's default.
+func (o *RuntimeOpts) maxParallelism() int {
+	if o == nil {
+		return 0
+	}
+	if o.MaxParallelism > 0 {
+		return o.MaxParallelism
+	}
+
+	return int(math.Ceil(o.CPUs))
+}
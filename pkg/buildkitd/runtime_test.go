@@ -0,0 +1,110 @@
+package buildkitd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		in      string
+		dir     string
+		want    *Mount
+		wantErr bool
+	}{
+		{in: "/etc/ssl/certs/ca.pem:/etc/ssl/certs/ca-certificates.crt:ro", want: &Mount{
+			Source:   "/etc/ssl/certs/ca.pem",
+			Target:   "/etc/ssl/certs/ca-certificates.crt",
+			ReadOnly: true,
+		}},
+		{in: "certs/ca.pem:/ca.pem", dir: "/workspace", want: &Mount{
+			Source: "/workspace/certs/ca.pem",
+			Target: "/ca.pem",
+		}},
+		{in: "/ca.pem:/ca.pem", dir: "/workspace", want: &Mount{
+			Source: "/ca.pem",
+			Target: "/ca.pem",
+		}},
+		{in: "certs/ca.pem:/ca.pem", wantErr: true},
+		{in: "/ca.pem", wantErr: true},
+		{in: ":/ca.pem", wantErr: true},
+		{in: "/ca.pem:ca.pem", wantErr: true},
+		{in: "/ca.pem:/ca.pem:rw", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in+tt.dir, func(t *testing.T) {
+			got, err := ParseMount(tt.in, tt.dir)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "1048576", want: 1 << 20},
+		{in: "512m", want: 512 << 20},
+		{in: "4G", want: 4 << 30},
+		{in: "4gb", want: 4 << 30},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: "64k", want: 64 << 10},
+		{in: "", wantErr: true},
+		{in: "lots", wantErr: true},
+		{in: "4x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseMemory(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRuntimeOptsArgs(t *testing.T) {
+	var none *RuntimeOpts
+	assert.Empty(t, none.runArgs())
+	assert.Empty(t, none.buildkitdArgs())
+	assert.Empty(t, (&RuntimeOpts{}).runArgs())
+	assert.Empty(t, (&RuntimeOpts{}).buildkitdArgs())
+
+	opts := &RuntimeOpts{
+		CPUs:       1.5,
+		Memory:     4 << 30,
+		PidsLimit:  1024,
+		Mounts:     []*Mount{{Source: "/ca.pem", Target: "/etc/ssl/certs/ca.pem", ReadOnly: true}},
+		Env:        []string{"HTTPS_PROXY=http://proxy:3128"},
+		DNS:        []string{"10.0.0.53"},
+		DNSSearch:  []string{"corp.example.com"},
+		DNSOptions: []string{"ndots:2"},
+	}
+	assert.Equal(t, []string{
+		"--cpus", "1.5",
+		"--memory", "4294967296",
+		"--pids-limit", "1024",
+		"--volume", "/ca.pem:/etc/ssl/certs/ca.pem:ro",
+		"--env", "HTTPS_PROXY=http://proxy:3128",
+		"--dns", "10.0.0.53",
+		"--dns-search", "corp.example.com",
+		"--dns-option", "ndots:2",
+	}, opts.runArgs())
+
+	// max parallelism follows the CPU limit unless it is given.
+	assert.Equal(t, []string{"--oci-worker-max-parallelism", "2"}, opts.buildkitdArgs())
+	opts.MaxParallelism = 8
+	assert.Equal(t, []string{"--oci-worker-max-parallelism", "8"}, opts.buildkitdArgs())
+}
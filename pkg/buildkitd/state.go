@@ -0,0 +1,181 @@
+package buildkitd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The paths which buildkitd keeps its state in, e.g. its content store and
+// cache mounts.
+const (
+	stateMountPath         = "/var/lib/buildkit"
+	rootlessStateMountPath = "/home/user/.local/share/buildkit"
+)
+
+// LabelWorkspace is the label of a state volume which holds the workspace
+// that it belongs to.
+const LabelWorkspace = labelPrefix + "workspace"
+
+// ErrStateInUse is returned by LockState when the state of the workspace is
+// in use by another build, as buildkitd cannot share its state.
+var ErrStateInUse = errors.New("buildkitd state is in use by another build")
+
+// DefaultStateDir returns the directory which the state of the podman
+// provider, and the locks of all state, of the given workspace is kept in by
+// default. It is the same for every build of the workspace, so that the lock
+// serialises them.
+func DefaultStateDir(workspace string) string {
+	return filepath.Join(WorkspaceDir(workspace), "state")
+}
+
+// WorkspaceDir returns the directory in the given workspace which
+// please_buildkit keeps files in between builds. It is kept in the workspace,
+// rather than e.g. the user's cache dir, as each Please build action has its
+// own temporary $HOME.
+func WorkspaceDir(workspace string) string {
+	return filepath.Join(workspace, "plz-out", "please-buildkit")
+}
+
+// FindWorkspace returns the root of the Please workspace which the given
+// directory is in, i.e. the closest directory with a `.plzconfig` outside of
+// `plz-out`, as builds run in `plz-out/tmp`.
+func FindWorkspace(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if i := strings.Index(dir+string(filepath.Separator), string(filepath.Separator)+"plz-out"+string(filepath.Separator)); i >= 0 {
+		dir = dir[:i]
+	}
+
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".plzconfig")); err == nil {
+			return d, nil
+		}
+		if d == filepath.Dir(d) {
+			return "", fmt.Errorf("could not find a Please workspace containing '%s'", dir)
+		}
+	}
+}
+
+// StateName returns the name of the state volume of the given workspace.
+func StateName(workspace string) string {
+	return "please-buildkit-state-" + workspaceHash(workspace)
+}
+
+// workspaceHash returns a short hash of the given workspace, to name its
+// files outside of it.
+func workspaceHash(workspace string) string {
+	sum := sha256.Sum256([]byte(workspace))
+
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// State is the persistent buildkitd state of a workspace, which is kept
+// between builds as a named volume, or a directory for providers whose
+// volumes are not persistent.
+type State struct {
+	// Workspace is the root of the workspace which the state belongs to.
+	Workspace string
+	// Dir is the directory which the state is kept in when it is not kept in
+	// a volume.
+	Dir string
+
+	lock *os.File
+}
+
+// LockState locks the state of the given workspace, whose lock, and state
+// when it is kept in a directory, is kept in the given directory. It returns
+// ErrStateInUse if another build holds the lock.
+func LockState(workspace string, stateDir string) (*State, error) {
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create state dir: %w", err)
+	}
+
+	name := StateName(workspace)
+	lock, err := os.OpenFile(filepath.Join(stateDir, name+".lock"), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open state lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrStateInUse
+		}
+		return nil, fmt.Errorf("could not lock state: %w", err)
+	}
+
+	return &State{
+		Workspace: workspace,
+		Dir:       filepath.Join(stateDir, name),
+		lock:      lock,
+	}, nil
+}
+
+// Name returns the name of the state volume.
+func (s *State) Name() string {
+	return StateName(s.Workspace)
+}
+
+// Unlock unlocks the state so that other builds can use it. It is safe to
+// call on a nil State.
+func (s *State) Unlock() {
+	if s == nil || s.lock == nil {
+		return
+	}
+
+	// closing the file releases the lock.
+	if err := s.lock.Close(); err != nil {
+		log.Warn().Err(err).Msg("could not unlock buildkitd state")
+	}
+	s.lock = nil
+}
+
+// volumeRunArgs returns the arguments to mount the state volume at the given
+// path, creating the volume if it does not exist. It returns no arguments for
+// a nil State.
+func (s *State) volumeRunArgs(ctx context.Context, engine *containerEngine, target string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	if err := engine.command(ctx, "volume", "inspect", s.Name()).Run(); err != nil {
+		log.Info().Msgf("creating buildkitd state volume '%s' for '%s'", s.Name(), s.Workspace)
+		createCmd := engine.command(ctx,
+			"volume", "create",
+			"--label", LabelWorkspace+"="+s.Workspace,
+			s.Name(),
+		)
+		if out, err := createCmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("could not run '%s': %w\n%s", strings.Join(createCmd.Args, " "), err, out)
+		}
+	}
+
+	return []string{"--volume", s.Name() + ":" + target}, nil
+}
+
+// dirRunArgs returns the arguments to mount the state directory at the given
+// path, creating the directory if it does not exist. It returns no arguments
+// for a nil State.
+func (s *State) dirRunArgs(target string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create state dir: %w", err)
+	}
+
+	return []string{"--volume", s.Dir + ":" + target}, nil
+}
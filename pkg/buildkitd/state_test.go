@@ -0,0 +1,107 @@
+package buildkitd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindWorkspace(t *testing.T) {
+	workspace := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workspace, ".plzconfig"), nil, 0o644))
+	buildDir := filepath.Join(workspace, "plz-out", "tmp", "pkg", "image._build")
+	require.NoError(t, os.MkdirAll(buildDir, 0o755))
+	// a .plzconfig which is a source of a build is not the workspace's.
+	require.NoError(t, os.WriteFile(filepath.Join(buildDir, ".plzconfig"), nil, 0o644))
+
+	for _, dir := range []string{workspace, filepath.Join(workspace, "plz-out"), buildDir} {
+		got, err := FindWorkspace(dir)
+		require.NoError(t, err)
+		assert.Equal(t, workspace, got, dir)
+	}
+
+	_, err := FindWorkspace(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestStateName(t *testing.T) {
+	assert.Equal(t, StateName("/a"), StateName("/a"))
+	assert.NotEqual(t, StateName("/a"), StateName("/b"))
+	assert.True(t, strings.HasPrefix(StateName("/a"), "please-buildkit-state-"))
+}
+
+func TestLockState(t *testing.T) {
+	stateDir := t.TempDir()
+
+	state, err := LockState("/workspace", stateDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(stateDir, StateName("/workspace")), state.Dir)
+
+	_, err = LockState("/workspace", stateDir)
+	assert.ErrorIs(t, err, ErrStateInUse)
+
+	other, err := LockState("/other", stateDir)
+	require.NoError(t, err)
+	other.Unlock()
+
+	state.Unlock()
+	state.Unlock()
+	state, err = LockState("/workspace", stateDir)
+	require.NoError(t, err)
+	state.Unlock()
+}
+
+// builds each have their own $HOME, so the lock of the state must not depend
+// on it.
+func TestLockStateDefaultStateDir(t *testing.T) {
+	workspace := t.TempDir()
+
+	t.Setenv("HOME", t.TempDir())
+	state, err := LockState(workspace, DefaultStateDir(workspace))
+	require.NoError(t, err)
+	defer state.Unlock()
+	assert.Equal(t, filepath.Join(workspace, "plz-out", "please-buildkit", "state", StateName(workspace)), state.Dir)
+
+	t.Setenv("HOME", t.TempDir())
+	_, err = LockState(workspace, DefaultStateDir(workspace))
+	assert.ErrorIs(t, err, ErrStateInUse)
+}
+
+func TestProviderStateVolume(t *testing.T) {
+	engine := newFakeEngine(t, testImage)
+	state, err := LockState("/workspace", t.TempDir())
+	require.NoError(t, err)
+	defer state.Unlock()
+
+	for i := 0; i < 2; i++ {
+		p := NewRootDockerProvider(&RootDockerProviderOpts{
+			Binary:     engine.binary,
+			Image:      testImage,
+			Transport:  TransportTCP,
+			PullPolicy: PullPolicyIfNotPresent,
+			State:      state,
+		})
+		_, err := p.Start(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, p.Stop(context.Background()))
+	}
+
+	var creates, runs int
+	for _, call := range engine.calls(t) {
+		if strings.HasPrefix(call, "volume create ") {
+			creates++
+			assert.Equal(t, "volume create --label "+LabelWorkspace+"=/workspace "+state.Name(), call)
+		}
+		if strings.HasPrefix(call, "run ") {
+			runs++
+			assert.Contains(t, call, " --volume "+state.Name()+":"+stateMountPath+" ")
+		}
+	}
+	assert.Equal(t, 1, creates)
+	assert.Equal(t, 2, runs)
+}
@@ -0,0 +1,202 @@
+package buildkitd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certValidity is how long generated certificates are valid for. They are
+// only used for a single session.
+const certValidity = 24 * time.Hour
+
+// TLSCredentials represents the paths to the PEM encoded certificates used to
+// connect to buildkitd with mutual TLS.
+type TLSCredentials struct {
+	CACert string
+	Cert   string
+	Key    string
+	// ServerName is the name to verify the server certificate with instead
+	// of the host which is connected to, if set.
+	ServerName string
+}
+
+// BuildctlArgs returns the arguments to buildctl which make it connect with
+// the credentials. Empty paths are omitted, e.g. for user-supplied
+// credentials which only verify the server. It is safe to call on nil
+// credentials, returning no arguments.
+func (c *TLSCredentials) BuildctlArgs() []string {
+	if c == nil {
+		return nil
+	}
+
+	args := []string{}
+	for _, arg := range [][2]string{
+		{"--tlscacert", c.CACert},
+		{"--tlscert", c.Cert},
+		{"--tlskey", c.Key},
+		{"--tlsservername", c.ServerName},
+	} {
+		if arg[1] != "" {
+			args = append(args, arg[0], arg[1])
+		}
+	}
+
+	return args
+}
+
+// BuildkitdArgs returns the arguments to buildkitd which make it serve, and
+// require clients to present certificates signed by the CA, with the
+// credentials.
+func (c *TLSCredentials) BuildkitdArgs() []string {
+	return []string{
+		"--tlscacert", c.CACert,
+		"--tlscert", c.Cert,
+		"--tlskey", c.Key,
+	}
+}
+
+// GenerateTLSCredentials generates an ephemeral CA, and server and client
+// certificates signed by it, into the given directory. The server
+// certificate is valid for the given hosts, which may be IP addresses or DNS
+// names. The credentials of the server and the client are returned.
+//
+// The server's files are readable by all users so that they can be mounted
+// into buildkitd containers which do not run as the current user, so the
+// directory should not be accessible by other users.
+func GenerateTLSCredentials(dir string, hosts []string) (*TLSCredentials, *TLSCredentials, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caTemplate, err := newCertTemplate("please-buildkit CA")
+	if err != nil {
+		return nil, nil, err
+	}
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create CA certificate: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caPath := filepath.Join(dir, "ca.pem")
+	if err := writePEM(caPath, "CERTIFICATE", caDER, 0o644); err != nil {
+		return nil, nil, err
+	}
+
+	serverTemplate, err := newCertTemplate("buildkitd")
+	if err != nil {
+		return nil, nil, err
+	}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, host)
+		}
+	}
+
+	server, err := writeSignedCert(dir, "server", 0o644, serverTemplate, caCert, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create server certificate: %w", err)
+	}
+	server.CACert = caPath
+
+	clientTemplate, err := newCertTemplate("please-buildkit")
+	if err != nil {
+		return nil, nil, err
+	}
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	client, err := writeSignedCert(dir, "client", 0o600, clientTemplate, caCert, caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create client certificate: %w", err)
+	}
+	client.CACert = caPath
+
+	return server, client, nil
+}
+
+func newCertTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+// writeSignedCert generates a key and a certificate from the given template
+// signed by the given CA, and writes them to `<name>.pem` and
+// `<name>-key.pem` in the given directory. The key is written with the given
+// mode.
+func writeSignedCert(
+	dir string,
+	name string,
+	keyMode os.FileMode,
+	template *x509.Certificate,
+	caCert *x509.Certificate,
+	caKey *ecdsa.PrivateKey,
+) (*TLSCredentials, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &TLSCredentials{
+		Cert: filepath.Join(dir, name+".pem"),
+		Key:  filepath.Join(dir, name+"-key.pem"),
+	}
+	if err := writePEM(creds.Cert, "CERTIFICATE", der, 0o644); err != nil {
+		return nil, err
+	}
+	if err := writePEM(creds.Key, "PRIVATE KEY", keyDER, keyMode); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode); err != nil {
+		return err
+	}
+
+	// the mode given to os.WriteFile is subject to the umask.
+	return os.Chmod(path, mode)
+}
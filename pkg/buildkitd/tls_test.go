@@ -0,0 +1,123 @@
+package buildkitd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loadTLSConfig(t *testing.T, creds *TLSCredentials) (*tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	cert, err := tls.LoadX509KeyPair(creds.Cert, creds.Key)
+	require.NoError(t, err)
+
+	caPEM, err := os.ReadFile(creds.CACert)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(caPEM))
+
+	return &cert, pool
+}
+
+func TestGenerateTLSCredentials(t *testing.T) {
+	dir := t.TempDir()
+	server, client, err := GenerateTLSCredentials(dir, tlsHosts)
+	require.NoError(t, err)
+
+	// only the client's key is private.
+	for path, mode := range map[string]os.FileMode{
+		"ca.pem":         0o644,
+		"server.pem":     0o644,
+		"server-key.pem": 0o644,
+		"client.pem":     0o644,
+		"client-key.pem": 0o600,
+	} {
+		info, err := os.Stat(filepath.Join(dir, path))
+		require.NoError(t, err)
+		assert.Equal(t, mode, info.Mode().Perm(), path)
+	}
+
+	serverCert, serverPool := loadTLSConfig(t, server)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientCAs:    serverPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	clientCert, clientPool := loadTLSConfig(t, client)
+
+	t.Run("client certificate", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{*clientCert},
+			RootCAs:      clientPool,
+		})
+		require.NoError(t, err)
+		defer conn.Close()
+
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(b))
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs: clientPool,
+		})
+		if err == nil {
+			// with TLS 1.3 the server's rejection is only seen on read.
+			_, err = io.ReadAll(conn)
+			conn.Close()
+		}
+		assert.Error(t, err)
+	})
+
+	t.Run("other CA", func(t *testing.T) {
+		_, other, err := GenerateTLSCredentials(t.TempDir(), tlsHosts)
+		require.NoError(t, err)
+		_, otherPool := loadTLSConfig(t, other)
+
+		_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{*clientCert},
+			RootCAs:      otherPool,
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestTLSCredentialsBuildctlArgs(t *testing.T) {
+	var creds *TLSCredentials
+	assert.Empty(t, creds.BuildctlArgs())
+
+	creds = &TLSCredentials{CACert: "ca.pem", Cert: "client.pem", Key: "client-key.pem"}
+	assert.Equal(t, []string{
+		"--tlscacert", "ca.pem",
+		"--tlscert", "client.pem",
+		"--tlskey", "client-key.pem",
+	}, creds.BuildctlArgs())
+
+	creds = &TLSCredentials{CACert: "ca.pem", ServerName: "buildkitd"}
+	assert.Equal(t, []string{
+		"--tlscacert", "ca.pem",
+		"--tlsservername", "buildkitd",
+	}, creds.BuildctlArgs())
+}
@@ -0,0 +1,239 @@
+package buildkitd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultStopTimeout is how long a Worker waits for its provider to stop.
+const DefaultStopTimeout = 30 * time.Second
+
+// workerState is the lifecycle state of a Worker.
+type workerState int
+
+const (
+	workerIdle workerState = iota
+	// workerStarting is while the provider is starting, which Kill may
+	// preempt.
+	workerStarting
+	workerRunning
+	// workerStopping is while the provider is stopping gracefully, which Kill
+	// may preempt.
+	workerStopping
+	workerStopped
+)
+
+// ErrKilled is returned by Worker.Start if the Worker was killed while it was
+// starting.
+var ErrKilled = errors.New("buildkitd was killed")
+
+// Worker runs `buildkitd` with a Provider and ensures that it is torn down,
+// even when the build is cancelled or fails. It stays registered for KillAll
+// until its provider has stopped.
+type Worker struct {
+	provider    Provider
+	stopTimeout time.Duration
+
+	mu    sync.Mutex
+	state workerState
+	// cancel cancels the in-flight Start or Stop, if any.
+	cancel context.CancelFunc
+
+	// providerMu serializes the calls to start, stop and kill the provider,
+	// which providers do not synchronise themselves. Kill cancels the
+	// in-flight call rather than waiting for it to finish.
+	providerMu sync.Mutex
+}
+
+// NewWorker returns a new Worker which runs `buildkitd` with the given
+// provider, waiting up to the given timeout for it to stop.
+func NewWorker(provider Provider, stopTimeout time.Duration) *Worker {
+	if stopTimeout <= 0 {
+		stopTimeout = DefaultStopTimeout
+	}
+
+	return &Worker{
+		provider:    provider,
+		stopTimeout: stopTimeout,
+	}
+}
+
+// Start starts `buildkitd` and returns how to connect to it. If the provider
+// fails to start, it is stopped so that partially started daemons are not
+// left running. If the Worker is killed while starting, Start returns
+// ErrKilled once Kill has torn down whatever the provider created.
+func (w *Worker) Start(ctx context.Context) (*Endpoint, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w.mu.Lock()
+	w.state = workerStarting
+	w.cancel = cancel
+	w.mu.Unlock()
+	register(w)
+
+	w.providerMu.Lock()
+	endpoint, err := w.provider.Start(ctx)
+	w.providerMu.Unlock()
+
+	w.mu.Lock()
+	killed := w.state != workerStarting
+	if !killed {
+		w.state = workerRunning
+	}
+	w.cancel = nil
+	w.mu.Unlock()
+
+	if killed {
+		// Kill tears down whatever the provider created once it has returned.
+		return nil, ErrKilled
+	}
+	if err != nil {
+		if stopErr := w.Stop(ctx); stopErr != nil {
+			log.Warn().Err(stopErr).Msg("could not stop partially started provider")
+		}
+		return nil, err
+	}
+
+	return endpoint, nil
+}
+
+// Info describes the provider and the `buildkitd` daemon it started.
+func (w *Worker) Info() *ProviderInfo {
+	return w.provider.Info()
+}
+
+// Logs returns the logs of `buildkitd`, which must be called before it is
+// stopped as providers may remove them.
+func (w *Worker) Logs(ctx context.Context) ([]byte, error) {
+	return w.provider.Logs(ctx)
+}
+
+// Running returns an error wrapping ErrExited if `buildkitd` has exited.
+func (w *Worker) Running(ctx context.Context) error {
+	return w.provider.Running(ctx)
+}
+
+// Stop stops `buildkitd`. The given context is only used for its values,
+// e.g. the current trace, as it is usually cancelled when the build is
+// interrupted; the provider is instead given up to the stop timeout. It is
+// safe to call Stop multiple times, and Kill may preempt it.
+func (w *Worker) Stop(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(withoutCancel(ctx), w.stopTimeout)
+	defer cancel()
+
+	w.mu.Lock()
+	if w.state != workerRunning {
+		w.mu.Unlock()
+		return nil
+	}
+	w.state = workerStopping
+	w.cancel = cancel
+	w.mu.Unlock()
+
+	w.providerMu.Lock()
+	err := w.provider.Stop(ctx)
+	w.providerMu.Unlock()
+
+	w.mu.Lock()
+	killed := w.state != workerStopping
+	w.state = workerStopped
+	w.cancel = nil
+	w.mu.Unlock()
+
+	if killed {
+		// Kill took over stopping buildkitd and unregisters the worker.
+		return nil
+	}
+	unregister(w)
+	if err != nil {
+		return fmt.Errorf("could not stop buildkitd: %w", err)
+	}
+
+	return nil
+}
+
+// Kill forcefully stops `buildkitd`, e.g. when the user is no longer willing
+// to wait for Start or Stop, which it preempts by cancelling them and waiting
+// for them to return, so that whatever they created is killed. It is safe to
+// call Kill multiple times, and after Stop.
+func (w *Worker) Kill(ctx context.Context) error {
+	w.mu.Lock()
+	switch w.state {
+	case workerStarting, workerRunning, workerStopping:
+	default:
+		w.mu.Unlock()
+		return nil
+	}
+	w.state = workerStopped
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.mu.Unlock()
+	defer unregister(w)
+
+	w.providerMu.Lock()
+	defer w.providerMu.Unlock()
+
+	if err := w.provider.Kill(ctx); err != nil {
+		return fmt.Errorf("could not kill buildkitd: %w", err)
+	}
+
+	return nil
+}
+
+var (
+	runningMu sync.Mutex
+	running   = map[*Worker]struct{}{}
+)
+
+func register(w *Worker) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	running[w] = struct{}{}
+}
+
+func unregister(w *Worker) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	delete(running, w)
+}
+
+// KillAll forcefully stops all of the Workers which have been started but not
+// stopped yet, e.g. on a second interrupt signal.
+func KillAll(ctx context.Context) {
+	runningMu.Lock()
+	workers := make([]*Worker, 0, len(running))
+	for w := range running {
+		workers = append(workers, w)
+	}
+	runningMu.Unlock()
+
+	for _, w := range workers {
+		if err := w.Kill(ctx); err != nil {
+			log.Error().Err(err).Msg("could not kill buildkitd worker")
+		}
+	}
+}
+
+// detachedContext carries the values of its parent but is never cancelled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// withoutCancel returns a copy of ctx which is not cancelled when ctx is.
+// TODO: use context.WithoutCancel when Go 1.21 is the minimum version.
+func withoutCancel(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
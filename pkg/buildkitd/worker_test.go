@@ -0,0 +1,226 @@
+package buildkitd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWorker(t *testing.T, stopTimeout time.Duration) (*Worker, *RootDockerProvider, *fakeEngine) {
+	t.Helper()
+
+	engine := newFakeEngine(t, testImage)
+	provider := NewRootDockerProvider(&RootDockerProviderOpts{
+		Binary:     engine.binary,
+		Image:      testImage,
+		Transport:  TransportTCP,
+		PullPolicy: PullPolicyIfNotPresent,
+	})
+
+	return NewWorker(provider, stopTimeout), provider, engine
+}
+
+func TestWorkerStopAfterCancel(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	endpoint, err := w.Start(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "tcp://127.0.0.1:49153", endpoint.Address)
+	assert.Equal(t, TransportTCP, endpoint.Transport)
+	assert.NotNil(t, endpoint.TLS)
+
+	cancel()
+	require.NoError(t, w.Stop(ctx))
+
+	assert.Contains(t, engine.calls(t), "stop "+provider.Name)
+}
+
+func TestWorkerInfoAndLogs(t *testing.T) {
+	w, provider, _ := newTestWorker(t, DefaultStopTimeout)
+	ctx := context.Background()
+
+	logs, err := w.Logs(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, logs)
+
+	_, err = w.Start(ctx)
+	require.NoError(t, err)
+	defer w.Stop(ctx)
+
+	assert.Equal(t, &ProviderInfo{
+		Name:          "docker",
+		EngineVersion: "24.0.5",
+		Platforms:     []string{"linux/amd64"},
+		ImageDigest:   "sha256:" + testImage,
+	}, w.Info())
+
+	logs, err = w.Logs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "buildkitd logs of "+provider.Name+"\n", string(logs))
+}
+
+func TestWorkerStartFailureCleansUp(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+	t.Setenv("FAKE_ENGINE_FAIL", "port")
+
+	_, err := w.Start(context.Background())
+	require.Error(t, err)
+
+	assert.Contains(t, engine.calls(t), "stop "+provider.Name)
+	assert.NotContains(t, workers(), w)
+}
+
+func TestWorkerStopIsIdempotent(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+
+	_, err := w.Start(context.Background())
+	require.NoError(t, err)
+
+	require.NoError(t, w.Stop(context.Background()))
+	require.NoError(t, w.Stop(context.Background()))
+	require.NoError(t, w.Kill(context.Background()))
+
+	var stops, removals int
+	for _, call := range engine.calls(t) {
+		switch call {
+		case "stop " + provider.Name:
+			stops++
+		case "rm --force " + provider.Name:
+			removals++
+		}
+	}
+	assert.Equal(t, 1, stops)
+	assert.Equal(t, 1, removals)
+}
+
+func TestWorkerStopTimeout(t *testing.T) {
+	w, _, _ := newTestWorker(t, 100*time.Millisecond)
+	t.Setenv("FAKE_ENGINE_STOP_SLEEP", "5")
+
+	_, err := w.Start(context.Background())
+	require.NoError(t, err)
+
+	start := time.Now()
+	assert.Error(t, w.Stop(context.Background()))
+	assert.Less(t, time.Since(start), 4*time.Second)
+}
+
+func TestKillAll(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+
+	_, err := w.Start(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, workers(), w)
+
+	KillAll(context.Background())
+
+	assert.Contains(t, engine.calls(t), "rm --force "+provider.Name)
+	assert.NotContains(t, workers(), w)
+	require.NoError(t, w.Stop(context.Background()))
+	assert.NotContains(t, engine.calls(t), "stop "+provider.Name)
+}
+
+func TestKillAllDuringStop(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+	t.Setenv("FAKE_ENGINE_STOP_SLEEP", "5")
+
+	_, err := w.Start(context.Background())
+	require.NoError(t, err)
+
+	stopped := make(chan error)
+	go func() { stopped <- w.Stop(context.Background()) }()
+
+	// the worker stays registered while it is stopping gracefully.
+	require.Eventually(t, func() bool {
+		return contains(engine.calls(t), "stop "+provider.Name)
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Contains(t, workers(), w)
+
+	start := time.Now()
+	KillAll(context.Background())
+	assert.Contains(t, engine.calls(t), "rm --force "+provider.Name)
+	assert.NotContains(t, workers(), w)
+
+	// Stop returns early as Kill preempted it.
+	assert.NoError(t, <-stopped)
+	assert.Less(t, time.Since(start), 4*time.Second)
+}
+
+func TestKillAllDuringStart(t *testing.T) {
+	w, provider, engine := newTestWorker(t, DefaultStopTimeout)
+	t.Setenv("FAKE_ENGINE_RUN_SLEEP", "5")
+
+	started := make(chan error)
+	go func() {
+		_, err := w.Start(context.Background())
+		started <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		return indexOfPrefix(engine.calls(t), "run ") >= 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Contains(t, workers(), w)
+
+	start := time.Now()
+	KillAll(context.Background())
+	assert.NotContains(t, workers(), w)
+
+	// Start returns early as Kill preempted it, and the container which may
+	// have been created is removed after it was run.
+	assert.ErrorIs(t, <-started, ErrKilled)
+	assert.Less(t, time.Since(start), 4*time.Second)
+	calls := engine.calls(t)
+	require.NotEmpty(t, provider.Name)
+	assert.Greater(t, indexOf(calls, "rm --force "+provider.Name), indexOfPrefix(calls, "run "))
+
+	// the worker has already been torn down.
+	require.NoError(t, w.Stop(context.Background()))
+	assert.NotContains(t, engine.calls(t), "stop "+provider.Name)
+}
+
+func indexOf(calls []string, call string) int {
+	for i, c := range calls {
+		if c == call {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func indexOfPrefix(calls []string, prefix string) int {
+	for i, c := range calls {
+		if strings.HasPrefix(c, prefix) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func contains(calls []string, call string) bool {
+	for _, c := range calls {
+		if c == call {
+			return true
+		}
+	}
+
+	return false
+}
+
+func workers() []*Worker {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+
+	ws := make([]*Worker, 0, len(running))
+	for w := range running {
+		ws = append(ws, w)
+	}
+
+	return ws
+}
@@ -0,0 +1,366 @@
+package image
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const (
+	// ReferenceTypeAnnotation is the BuildKit annotation which describes what
+	// an image manifest in an index refers to.
+	ReferenceTypeAnnotation = "vnd.docker.reference.type"
+	// ReferenceDigestAnnotation is the BuildKit annotation which holds the
+	// digest of the image manifest an attestation manifest refers to.
+	ReferenceDigestAnnotation = "vnd.docker.reference.digest"
+
+	attestationManifestReferenceType = "attestation-manifest"
+
+	// imageNameAnnotation is the containerd annotation which holds the full
+	// name of an image in an OCI layout, as set by BuildKit.
+	imageNameAnnotation = "io.containerd.image.name"
+)
+
+var (
+	ErrNoImages       = errors.New("no images found")
+	ErrMultipleImages = errors.New("multiple images found")
+)
+
+// Archive represents a single image archive as written by the `build` command
+// or by the BuildKit `docker` and `oci` exporters.
+type Archive struct {
+	// Image is the single image in the archive.
+	Image v1.Image
+	// RepoTags are the repo tags the image is tagged with in the archive.
+	RepoTags []string
+	// Attestations are the attestations of Image in the archive.
+	Attestations []*Attestation
+
+	tmpDir string
+}
+
+// OpenArchive opens the image archive at the given path. The path may either
+// be a `docker load` compatible tarball, an OCI image layout directory or a
+// tarball of one. Close should be called once the returned Archive is no
+// longer used.
+func OpenArchive(path string) (*Archive, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat '%s': %w", path, err)
+	}
+
+	if stat.IsDir() {
+		return OpenOCIArchive(path)
+	}
+
+	isDocker, err := tarContains(path, "manifest.json")
+	if err != nil {
+		return nil, err
+	}
+
+	if !isDocker {
+		return OpenOCIArchive(path)
+	}
+
+	return OpenDockerArchive(path)
+}
+
+// OpenDockerArchive opens the `docker load` compatible tarball at the given
+// path.
+func OpenDockerArchive(path string) (*Archive, error) {
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return os.Open(path) })
+	if err != nil {
+		return nil, fmt.Errorf("could not read docker archive '%s': %w", path, err)
+	}
+
+	switch {
+	case len(manifest) < 1:
+		return nil, fmt.Errorf("'%s': %w", path, ErrNoImages)
+	case len(manifest) > 1:
+		return nil, fmt.Errorf("'%s': %w", path, ErrMultipleImages)
+	}
+
+	img, err := tarball.ImageFromPath(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not read docker archive '%s': %w", path, err)
+	}
+
+	return &Archive{
+		Image:    img,
+		RepoTags: manifest[0].RepoTags,
+	}, nil
+}
+
+// OpenOCIArchive opens the OCI image layout at the given path. The path may
+// either be an OCI image layout directory or a tarball of one.
+func OpenOCIArchive(path string) (*Archive, error) {
+	a := &Archive{}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not stat '%s': %w", path, err)
+	}
+
+	layoutPath := path
+	if !stat.IsDir() {
+		a.tmpDir, err = os.MkdirTemp("", "oci-layout")
+		if err != nil {
+			return nil, fmt.Errorf("could not create temporary dir: %w", err)
+		}
+		layoutPath = a.tmpDir
+
+		if err := ExtractTar(path, a.tmpDir); err != nil {
+			a.Close()
+			return nil, err
+		}
+	}
+
+	idx, err := layout.ImageIndexFromPath(layoutPath)
+	if err != nil {
+		a.Close()
+		return nil, fmt.Errorf("could not read OCI layout '%s': %w", path, err)
+	}
+
+	images := []v1.Image{}
+	attestationImages := []v1.Image{}
+	repoTags := map[string]struct{}{}
+	if err := walkIndex(idx, func(desc v1.Descriptor, img v1.Image) {
+		if name, ok := desc.Annotations[imageNameAnnotation]; ok {
+			repoTags[name] = struct{}{}
+		}
+		if img == nil {
+			return
+		}
+		if desc.Annotations[ReferenceTypeAnnotation] == attestationManifestReferenceType {
+			attestationImages = append(attestationImages, img)
+			return
+		}
+		images = append(images, img)
+	}); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("could not read OCI layout '%s': %w", path, err)
+	}
+
+	switch {
+	case len(images) < 1:
+		a.Close()
+		return nil, fmt.Errorf("'%s': %w", path, ErrNoImages)
+	case len(images) > 1:
+		a.Close()
+		return nil, fmt.Errorf("'%s': %w", path, ErrMultipleImages)
+	}
+	a.Image = images[0]
+
+	for repoTag := range repoTags {
+		a.RepoTags = append(a.RepoTags, repoTag)
+	}
+	sort.Strings(a.RepoTags)
+
+	for _, img := range attestationImages {
+		attestations, err := LoadAttestationsFromImage(img)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.Attestations = append(a.Attestations, attestations...)
+	}
+
+	return a, nil
+}
+
+// Close removes any temporary files created when opening the archive.
+func (a *Archive) Close() error {
+	if a.tmpDir == "" {
+		return nil
+	}
+
+	return os.RemoveAll(a.tmpDir)
+}
+
+// WriteDockerArchive writes the given image as a `docker load` compatible
+// tarball to the given path, tagged with the given repo tags.
+func WriteDockerArchive(path string, img v1.Image, repoTags []string) error {
+	refToImage := map[name.Reference]v1.Image{}
+	for _, repoTag := range repoTags {
+		tag, err := name.NewTag(repoTag)
+		if err != nil {
+			return fmt.Errorf("could not parse '%s': %w", repoTag, err)
+		}
+		refToImage[tag] = img
+	}
+
+	if err := tarball.MultiRefWriteToFile(path, refToImage); err != nil {
+		return fmt.Errorf("could not write '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// WriteDockerArchive writes the archive's image as a `docker load` compatible
+// tarball to the given path, tagged with the given repo tags. As the tarball's
+// image has a docker manifest, which is what is pushed, rather than the
+// archive's (e.g. OCI) manifest, the archive's attestations are re-subjected
+// to the digest of the written image.
+func (a *Archive) WriteDockerArchive(path string, repoTags []string) error {
+	if err := WriteDockerArchive(path, a.Image, repoTags); err != nil {
+		return err
+	}
+
+	written, err := OpenDockerArchive(path)
+	if err != nil {
+		return err
+	}
+
+	from, err := a.Image.Digest()
+	if err != nil {
+		return fmt.Errorf("could not get image digest: %w", err)
+	}
+	to, err := written.Image.Digest()
+	if err != nil {
+		return fmt.Errorf("could not get digest of '%s': %w", path, err)
+	}
+
+	for i, attestation := range a.Attestations {
+		a.Attestations[i], err = attestation.Resubject(from, to)
+		if err != nil {
+			return fmt.Errorf("could not re-subject attestation: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// WriteOCILayout writes the given image to an OCI image layout in the given
+// directory.
+func WriteOCILayout(dir string, img v1.Image) error {
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return fmt.Errorf("could not write OCI layout '%s': %w", dir, err)
+	}
+
+	if err := p.AppendImage(img); err != nil {
+		return fmt.Errorf("could not write image to OCI layout '%s': %w", dir, err)
+	}
+
+	return nil
+}
+
+// ExtractTar extracts the given tarball into the given directory.
+func ExtractTar(tarPath string, dir string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("could not open '%s': %w", tarPath, err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read '%s': %w", tarPath, err)
+		}
+
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("'%s' escapes '%s'", hdr.Name, dir)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("could not create '%s': %w", target, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("could not create '%s': %w", filepath.Dir(target), err)
+			}
+			if err := writeFile(target, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("could not write '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// tarContains returns whether or not the given tarball contains the given
+// file.
+func tarContains(tarPath string, fileName string) (bool, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return false, fmt.Errorf("could not open '%s': %w", tarPath, err)
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not read '%s': %w", tarPath, err)
+		}
+
+		if filepath.Clean(hdr.Name) == fileName {
+			return true, nil
+		}
+	}
+}
+
+// walkIndex calls the given function for every manifest in the given index
+// and its child indexes. The given image is nil for index manifests.
+func walkIndex(idx v1.ImageIndex, fn func(v1.Descriptor, v1.Image)) error {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			fn(desc, nil)
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := walkIndex(child, fn); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
+			fn(desc, img)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package image_test
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSBOMStatement       = `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document","subject":[],"predicate":{}}`
+	testProvenanceStatement = `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","subject":[],"predicate":{}}`
+)
+
+// writeBuildKitOCILayout writes an OCI layout to the given directory which
+// mimics the structure of BuildKit's `oci` exporter with attestations.
+func writeBuildKitOCILayout(t *testing.T, dir string) v1.Image {
+	t.Helper()
+
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	writeAttestedOCILayout(t, dir, img, testSBOMStatement, testProvenanceStatement)
+
+	return img
+}
+
+// writeAttestedOCILayout writes an OCI layout to the given directory with the
+// given image and an attestation manifest with the given SBOM and provenance
+// statements, like BuildKit's `oci` exporter.
+func writeAttestedOCILayout(t *testing.T, dir string, img v1.Image, sbomStatement string, provenanceStatement string) {
+	t.Helper()
+
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	attestationImg, err := mutate.Append(
+		mutate.MediaType(empty.Image, types.OCIManifestSchema1),
+		mutate.Addendum{
+			Layer:       static.NewLayer([]byte(sbomStatement), image.InTotoMediaType),
+			Annotations: map[string]string{image.PredicateTypeAnnotation: "https://spdx.dev/Document"},
+		},
+		mutate.Addendum{
+			Layer:       static.NewLayer([]byte(provenanceStatement), image.InTotoMediaType),
+			Annotations: map[string]string{image.PredicateTypeAnnotation: "https://slsa.dev/provenance/v0.2"},
+		},
+	)
+	require.NoError(t, err)
+
+	idx := mutate.AppendManifests(
+		mutate.IndexMediaType(empty.Index, types.OCIImageIndex),
+		mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+			},
+		},
+		mutate.IndexAddendum{
+			Add: attestationImg,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"},
+				Annotations: map[string]string{
+					image.ReferenceTypeAnnotation:   "attestation-manifest",
+					image.ReferenceDigestAnnotation: imgDigest.String(),
+				},
+			},
+		},
+	)
+
+	p, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, p.AppendIndex(idx))
+}
+
+func tarDir(t *testing.T, dir string, tarPath string) {
+	t.Helper()
+
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	defer tw.Close()
+
+	require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name, err = filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		return err
+	}))
+}
+
+func TestOpenOCIArchive(t *testing.T) {
+	layoutDir := t.TempDir()
+	img := writeBuildKitOCILayout(t, layoutDir)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	tarPath := filepath.Join(t.TempDir(), "image.oci.tar")
+	tarDir(t, layoutDir, tarPath)
+
+	for desc, path := range map[string]string{
+		"directory": layoutDir,
+		"tarball":   tarPath,
+	} {
+		t.Run(desc, func(t *testing.T) {
+			archive, err := image.OpenOCIArchive(path)
+			require.NoError(t, err)
+			defer archive.Close()
+
+			digest, err := archive.Image.Digest()
+			require.NoError(t, err)
+			assert.Equal(t, imgDigest, digest)
+
+			require.Len(t, archive.Attestations, 2)
+			assert.True(t, archive.Attestations[0].IsSBOM())
+			assert.JSONEq(t, testSBOMStatement, string(archive.Attestations[0].Statement))
+			assert.True(t, archive.Attestations[1].IsProvenance())
+			assert.JSONEq(t, testProvenanceStatement, string(archive.Attestations[1].Statement))
+		})
+	}
+}
+
+func TestOpenOCIArchiveNoImages(t *testing.T) {
+	dir := t.TempDir()
+	_, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+
+	_, err = image.OpenOCIArchive(dir)
+	assert.ErrorIs(t, err, image.ErrNoImages)
+}
+
+func TestWriteDockerArchive(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+	require.NoError(t, image.WriteDockerArchive(path, img, []string{
+		"example.com/foo:latest",
+		"example.com/foo:srcsha256-12345",
+	}))
+
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) { return os.Open(path) })
+	require.NoError(t, err)
+	require.Len(t, manifest, 1)
+	assert.ElementsMatch(t, []string{
+		"example.com/foo:latest",
+		"example.com/foo:srcsha256-12345",
+	}, manifest[0].RepoTags)
+}
+
+func TestArchiveWriteDockerArchive(t *testing.T) {
+	ctx := context.Background()
+
+	// BuildKit exports images with an OCI manifest, which the docker tarball
+	// replaces with a docker manifest.
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	img = mutate.ConfigMediaType(mutate.MediaType(img, types.OCIManifestSchema1), types.OCIConfigJSON)
+	ociDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	statement := `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"%s","subject":[{"name":"pkg:docker/foo","digest":{"sha256":"%s"}}],"predicate":{}}`
+	layoutDir := t.TempDir()
+	writeAttestedOCILayout(t, layoutDir, img,
+		fmt.Sprintf(statement, "https://spdx.dev/Document", ociDigest.Hex),
+		fmt.Sprintf(statement, "https://slsa.dev/provenance/v0.2", ociDigest.Hex),
+	)
+
+	archive, err := image.OpenOCIArchive(layoutDir)
+	require.NoError(t, err)
+	defer archive.Close()
+
+	reg := newTestRegistry(t)
+	path := filepath.Join(t.TempDir(), "image.tar")
+	require.NoError(t, archive.WriteDockerArchive(path, []string{reg + "/foo:latest"}))
+
+	// push the tarball like `crane push` does.
+	ref, err := name.ParseReference(reg + "/foo:latest")
+	require.NoError(t, err)
+	tarImg, err := tarball.ImageFromPath(path, nil)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, tarImg, remote.WithContext(ctx)))
+	desc, err := remote.Head(ref, remote.WithContext(ctx))
+	require.NoError(t, err)
+	assert.NotEqual(t, ociDigest, desc.Digest)
+
+	require.Len(t, archive.Attestations, 2)
+	for _, a := range archive.Attestations {
+		digests, err := a.SubjectDigests()
+		require.NoError(t, err)
+		assert.Equal(t, []v1.Hash{desc.Digest}, digests)
+		assert.NoError(t, a.VerifySubject(desc.Digest))
+		assert.Error(t, a.VerifySubject(ociDigest))
+	}
+}
+
+func TestWriteOCILayout(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	require.NoError(t, image.WriteOCILayout(dir, img))
+
+	p, err := layout.FromPath(dir)
+	require.NoError(t, err)
+	layoutImg, err := p.Image(imgDigest)
+	require.NoError(t, err)
+	digest, err := layoutImg.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, imgDigest, digest)
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir := t.TempDir()
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	imgDigest, err := img.Digest()
+	require.NoError(t, err)
+
+	dockerPath := filepath.Join(dir, "image.tar")
+	require.NoError(t, image.WriteDockerArchive(dockerPath, img, []string{"example.com/foo:latest"}))
+
+	layoutDir := filepath.Join(dir, "layout")
+	p, err := layout.Write(layoutDir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		"io.containerd.image.name": "example.com/foo:latest",
+	})))
+
+	ociPath := filepath.Join(dir, "image.oci.tar")
+	tarDir(t, layoutDir, ociPath)
+
+	for desc, path := range map[string]string{
+		"docker tarball":     dockerPath,
+		"OCI layout":         layoutDir,
+		"OCI layout tarball": ociPath,
+	} {
+		t.Run(desc, func(t *testing.T) {
+			archive, err := image.OpenArchive(path)
+			require.NoError(t, err)
+			defer archive.Close()
+
+			digest, err := archive.Image.Digest()
+			require.NoError(t, err)
+			assert.Equal(t, imgDigest, digest)
+			assert.Equal(t, []string{"example.com/foo:latest"}, archive.RepoTags)
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// OCILayoutPrefix is the prefix of base image references which refer to a
+// local OCI image layout rather than a registry.
+const OCILayoutPrefix = "oci-layout://"
+
+// AssembleFile represents a file to copy from the host into an image.
+type AssembleFile struct {
+	Src  string
+	Dest string
+}
+
+// AssembleOpts represents the options for assembling an image.
+type AssembleOpts struct {
+	Files      []AssembleFile
+	Entrypoint []string
+	Cmd        []string
+	User       string
+	WorkingDir string
+	Env        []string
+	Labels     map[string]string
+	// Created is the creation time of the image and of its new layer's
+	// history, e.g. the SOURCE_DATE_EPOCH of a reproducible build, as
+	// BuildKit sets it. The base image's creation time is kept if it is zero.
+	Created time.Time
+}
+
+// LoadBaseImage returns the image for the given platform from either an OCI
+// image layout, if the reference is prefixed with `oci-layout://`, or a
+// registry.
+func LoadBaseImage(ctx context.Context, ref string, platform v1.Platform, opts ...remote.Option) (v1.Image, error) {
+	if layoutPath, ok := strings.CutPrefix(ref, OCILayoutPrefix); ok {
+		return loadLayoutImage(layoutPath, platform)
+	}
+
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %w", ref, err)
+	}
+
+	opts = append(opts, remote.WithContext(ctx), remote.WithPlatform(platform))
+	img, err := remote.Image(r, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not get '%s': %w", ref, err)
+	}
+
+	return img, nil
+}
+
+func loadLayoutImage(layoutPath string, platform v1.Platform) (v1.Image, error) {
+	p, err := layout.FromPath(layoutPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open OCI layout '%s': %w", layoutPath, err)
+	}
+
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("could not read OCI layout '%s': %w", layoutPath, err)
+	}
+
+	var found v1.Image
+	var candidates []v1.Image
+	if err := walkIndex(idx, func(desc v1.Descriptor, img v1.Image) {
+		if img == nil || desc.Annotations[ReferenceTypeAnnotation] != "" {
+			return
+		}
+		candidates = append(candidates, img)
+		if found == nil && desc.Platform != nil && desc.Platform.Satisfies(platform) {
+			found = img
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case found != nil:
+		return found, nil
+	case len(candidates) == 1:
+		// single-platform layouts often omit the platform on the descriptor.
+		return candidates[0], nil
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("%w in '%s'", ErrNoImages, layoutPath)
+	}
+
+	return nil, fmt.Errorf("%w in '%s' and none match platform '%s'", ErrMultipleImages, layoutPath, platform.String())
+}
+
+// Assemble returns the given base image with a single layer containing the
+// given files appended and its config updated with the given options.
+func Assemble(base v1.Image, opts *AssembleOpts) (v1.Image, error) {
+	layer, err := NewFilesLayer(opts.Files)
+	if err != nil {
+		return nil, fmt.Errorf("could not create layer: %w", err)
+	}
+
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			Created:   v1.Time{Time: opts.Created},
+			CreatedBy: "please_buildkit assemble",
+			Comment:   fmt.Sprintf("%d files", len(opts.Files)),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not append layer: %w", err)
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("could not get config: %w", err)
+	}
+	configFile = configFile.DeepCopy()
+	if !opts.Created.IsZero() {
+		configFile.Created = v1.Time{Time: opts.Created}
+	}
+
+	config := &configFile.Config
+	if opts.Entrypoint != nil {
+		config.Entrypoint = opts.Entrypoint
+		// matches the behaviour of ENTRYPOINT in a Dockerfile.
+		config.Cmd = nil
+	}
+	if opts.Cmd != nil {
+		config.Cmd = opts.Cmd
+	}
+	if opts.User != "" {
+		config.User = opts.User
+	}
+	if opts.WorkingDir != "" {
+		config.WorkingDir = opts.WorkingDir
+	}
+	config.Env = mergeEnv(config.Env, opts.Env)
+	if len(opts.Labels) > 0 && config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	for k, v := range opts.Labels {
+		config.Labels[k] = v
+	}
+
+	return mutate.ConfigFile(img, configFile)
+}
+
+// mergeEnv returns the given base environment with the given overrides
+// applied, replacing variables of the same key in place.
+func mergeEnv(base []string, overrides []string) []string {
+	env := append([]string{}, base...)
+	for _, kv := range overrides {
+		k, _, _ := strings.Cut(kv, "=")
+		replaced := false
+		for i, existing := range env {
+			if ek, _, _ := strings.Cut(existing, "="); ek == k {
+				env[i] = kv
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
+
+// NewFilesLayer returns a layer containing the given files and their parent
+// directories. The layer is deterministic: entries are sorted, owned by root
+// and have a zero modification time. Files keep only their executable bit.
+func NewFilesLayer(files []AssembleFile) (v1.Layer, error) {
+	sorted := append([]AssembleFile{}, files...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return path.Clean(sorted[i].Dest) < path.Clean(sorted[j].Dest)
+	})
+
+	for _, f := range sorted {
+		info, err := os.Stat(f.Src)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("'%s' is not a regular file", f.Src)
+		}
+	}
+
+	// the layer is streamed from the source files whenever it is read rather
+	// than buffered, as srcs may be large binaries.
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeFilesTar(pw, sorted))
+		}()
+
+		return pr, nil
+	})
+}
+
+func writeFilesTar(w io.Writer, files []AssembleFile) error {
+	tw := tar.NewWriter(w)
+	dirs := map[string]struct{}{}
+	for _, f := range files {
+		dest := path.Clean("/" + f.Dest)
+
+		if err := writeParentDirs(tw, dirs, path.Dir(dest)); err != nil {
+			return err
+		}
+
+		if err := writeFileEntry(tw, f.Src, dest); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeParentDirs(tw *tar.Writer, written map[string]struct{}, dir string) error {
+	if dir == "/" {
+		return nil
+	}
+	if _, ok := written[dir]; ok {
+		return nil
+	}
+
+	if err := writeParentDirs(tw, written, path.Dir(dir)); err != nil {
+		return err
+	}
+
+	written[dir] = struct{}{}
+
+	return tw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(dir, "/") + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0o755,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	})
+}
+
+func writeFileEntry(tw *tar.Writer, src string, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	mode := int64(0o644)
+	if info.Mode().Perm()&0o111 != 0 {
+		mode = 0o755
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(dest, "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     mode,
+		Size:     info.Size(),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
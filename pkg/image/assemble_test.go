@@ -0,0 +1,204 @@
+package image_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeAssembleSrcs(t *testing.T) []image.AssembleFile {
+	t.Helper()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "cmd"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cmd", "server"), []byte("#!/bin/sh\n"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("debug: false\n"), 0o600))
+
+	return []image.AssembleFile{
+		{Src: filepath.Join(dir, "config.yaml"), Dest: "/app/config.yaml"},
+		{Src: filepath.Join(dir, "cmd", "server"), Dest: "/app/cmd/server"},
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	base, err := mutate.Config(
+		newTestImage(t, newTestLayer(t, testFile{name: "etc/"}, testFile{name: "etc/passwd", contents: "root"})),
+		v1.Config{Cmd: []string{"/bin/sh"}, Env: []string{"PATH=/usr/bin", "HOME=/root"}},
+	)
+	require.NoError(t, err)
+
+	files := writeAssembleSrcs(t)
+	opts := &image.AssembleOpts{
+		Files:      files,
+		Entrypoint: []string{"/app/cmd/server"},
+		User:       "65535",
+		Env:        []string{"PATH=/app/cmd:/usr/bin"},
+		Labels:     map[string]string{"org.opencontainers.image.source": "https://example.com"},
+	}
+
+	img, err := image.Assemble(base, opts)
+	require.NoError(t, err)
+
+	fs, err := image.FlattenFilesystem(img)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"/app",
+		"/app/cmd",
+		"/app/cmd/server",
+		"/app/config.yaml",
+		"/etc",
+		"/etc/passwd",
+	}, fs.Paths())
+	assert.Equal(t, "-rwxr-xr-x", fs["/app/cmd/server"].FileMode().String())
+	assert.Equal(t, "-rw-r--r--", fs["/app/config.yaml"].FileMode().String())
+	assert.Equal(t, 0, fs["/app/config.yaml"].UID)
+
+	configFile, err := img.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/app/cmd/server"}, configFile.Config.Entrypoint)
+	assert.Nil(t, configFile.Config.Cmd)
+	assert.Equal(t, "65535", configFile.Config.User)
+	assert.Equal(t, []string{"PATH=/app/cmd:/usr/bin", "HOME=/root"}, configFile.Config.Env)
+	assert.Equal(t, "https://example.com", configFile.Config.Labels["org.opencontainers.image.source"])
+
+	// assembling the same files again must result in the same image.
+	again, err := image.Assemble(base, opts)
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	againDigest, err := again.Digest()
+	require.NoError(t, err)
+	assert.Equal(t, digest, againDigest)
+}
+
+// TestAssembleDockerfileConfig checks that the assembled image's config
+// matches that of the equivalent Dockerfile, i.e. `ENTRYPOINT <entrypoint>`,
+// `CMD <cmd>` and `USER <user>` built with SOURCE_DATE_EPOCH.
+func TestAssembleDockerfileConfig(t *testing.T) {
+	baseCreated := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	base, err := mutate.CreatedAt(
+		newTestImage(t, newTestLayer(t, testFile{name: "etc/passwd", contents: "root"})),
+		v1.Time{Time: baseCreated},
+	)
+	require.NoError(t, err)
+	base, err = mutate.Config(base, v1.Config{
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"echo hello"},
+	})
+	require.NoError(t, err)
+
+	epoch := time.Unix(1700000000, 0).UTC()
+	tests := []struct {
+		name           string
+		opts           *image.AssembleOpts
+		wantEntrypoint []string
+		wantCmd        []string
+		wantCreated    time.Time
+	}{
+		{
+			name:           "entrypoint resets the base cmd",
+			opts:           &image.AssembleOpts{Entrypoint: []string{"/app/server"}, Created: epoch},
+			wantEntrypoint: []string{"/app/server"},
+			wantCreated:    epoch,
+		},
+		{
+			name:           "entrypoint and cmd",
+			opts:           &image.AssembleOpts{Entrypoint: []string{"/app/server"}, Cmd: []string{"--debug"}, Created: epoch},
+			wantEntrypoint: []string{"/app/server"},
+			wantCmd:        []string{"--debug"},
+			wantCreated:    epoch,
+		},
+		{
+			name:        "empty entrypoint and cmd",
+			opts:        &image.AssembleOpts{Entrypoint: []string{}, Cmd: []string{}, Created: epoch},
+			wantCreated: epoch,
+		},
+		{
+			name:           "no entrypoint keeps the base config",
+			opts:           &image.AssembleOpts{},
+			wantEntrypoint: []string{"/bin/sh", "-c"},
+			wantCmd:        []string{"echo hello"},
+			wantCreated:    baseCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Files = writeAssembleSrcs(t)
+			img, err := image.Assemble(base, tt.opts)
+			require.NoError(t, err)
+
+			configFile, err := img.ConfigFile()
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantEntrypoint, nilIfEmpty(configFile.Config.Entrypoint))
+			assert.Equal(t, tt.wantCmd, nilIfEmpty(configFile.Config.Cmd))
+			assert.True(t, tt.wantCreated.Equal(configFile.Created.Time), "created %s", configFile.Created.Time)
+
+			history := configFile.History[len(configFile.History)-1]
+			assert.Equal(t, "please_buildkit assemble", history.CreatedBy)
+			if !tt.opts.Created.IsZero() {
+				assert.True(t, tt.opts.Created.Equal(history.Created.Time), "history created %s", history.Created.Time)
+			}
+		})
+	}
+}
+
+// nilIfEmpty returns nil for empty slices, which are omitted from image
+// configs like nil slices.
+func nilIfEmpty(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+
+	return s
+}
+
+func TestNewFilesLayerMissingSrc(t *testing.T) {
+	_, err := image.NewFilesLayer([]image.AssembleFile{
+		{Src: filepath.Join(t.TempDir(), "missing"), Dest: "/app/missing"},
+	})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadBaseImage(t *testing.T) {
+	base := newTestImage(t, newTestLayer(t, testFile{name: "etc/passwd", contents: "root"}))
+	baseDigest, err := base.Digest()
+	require.NoError(t, err)
+
+	platform := v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	t.Run("OCI layout", func(t *testing.T) {
+		dir := t.TempDir()
+		p, err := layout.Write(dir, empty.Index)
+		require.NoError(t, err)
+		require.NoError(t, p.AppendImage(base, layout.WithPlatform(platform)))
+
+		img, err := image.LoadBaseImage(context.Background(), image.OCILayoutPrefix+dir, platform)
+		require.NoError(t, err)
+		digest, err := img.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, baseDigest, digest)
+	})
+
+	t.Run("registry", func(t *testing.T) {
+		repoTag := newTestRegistry(t) + "/base:latest"
+		ref := mustParseReference(t, repoTag)
+		require.NoError(t, remote.Write(ref, base))
+
+		img, err := image.LoadBaseImage(context.Background(), repoTag, platform)
+		require.NoError(t, err)
+		digest, err := img.Digest()
+		require.NoError(t, err)
+		assert.Equal(t, baseDigest, digest)
+	})
+}
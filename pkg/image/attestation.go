@@ -0,0 +1,280 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// InTotoMediaType is the media type of in-toto statement layers and of
+	// the attestation artifacts pushed as referrers.
+	InTotoMediaType types.MediaType = "application/vnd.in-toto+json"
+	// PredicateTypeAnnotation is the annotation which holds the in-toto
+	// predicate type of an attestation.
+	PredicateTypeAnnotation = "in-toto.io/predicate-type"
+)
+
+// Attestation represents an in-toto attestation statement of an image.
+type Attestation struct {
+	PredicateType string
+	Statement     []byte
+}
+
+// IsSBOM returns whether or not the attestation is a Software Bill of
+// Materials.
+func (a *Attestation) IsSBOM() bool {
+	return a.PredicateType == "https://spdx.dev/Document" ||
+		strings.HasPrefix(a.PredicateType, "https://cyclonedx.org/bom")
+}
+
+// IsProvenance returns whether or not the attestation is a SLSA provenance.
+func (a *Attestation) IsProvenance() bool {
+	return strings.HasPrefix(a.PredicateType, "https://slsa.dev/provenance/")
+}
+
+// SubjectDigests returns the digests of the subjects of the attestation's
+// statement.
+func (a *Attestation) SubjectDigests() ([]v1.Hash, error) {
+	statement := struct {
+		Subject []struct {
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+	}{}
+	if err := json.Unmarshal(a.Statement, &statement); err != nil {
+		return nil, fmt.Errorf("could not decode '%s' statement: %w", a.PredicateType, err)
+	}
+
+	digests := []v1.Hash{}
+	for _, subject := range statement.Subject {
+		for algorithm, hex := range subject.Digest {
+			digests = append(digests, v1.Hash{Algorithm: algorithm, Hex: hex})
+		}
+	}
+
+	return digests, nil
+}
+
+// VerifySubject returns an error unless the given digest is a subject of the
+// attestation's statement.
+func (a *Attestation) VerifySubject(digest v1.Hash) error {
+	digests, err := a.SubjectDigests()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range digests {
+		if d == digest {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("'%s' statement does not refer to '%s', its subjects are %v", a.PredicateType, digest, digests)
+}
+
+// Resubject returns a copy of the attestation whose statement refers to the
+// given digest instead of the given previous digest, e.g. when the image it
+// refers to is converted to a different manifest format. The statement must
+// refer to the previous digest.
+func (a *Attestation) Resubject(from v1.Hash, to v1.Hash) (*Attestation, error) {
+	if err := a.VerifySubject(from); err != nil {
+		return nil, err
+	}
+
+	statement := map[string]json.RawMessage{}
+	if err := json.Unmarshal(a.Statement, &statement); err != nil {
+		return nil, fmt.Errorf("could not decode '%s' statement: %w", a.PredicateType, err)
+	}
+
+	subjects := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(statement["subject"], &subjects); err != nil {
+		return nil, fmt.Errorf("could not decode '%s' statement subjects: %w", a.PredicateType, err)
+	}
+
+	for _, subject := range subjects {
+		digest := map[string]string{}
+		if err := json.Unmarshal(subject["digest"], &digest); err != nil {
+			return nil, fmt.Errorf("could not decode '%s' statement subject digest: %w", a.PredicateType, err)
+		}
+		if digest[from.Algorithm] != from.Hex {
+			continue
+		}
+
+		b, err := json.Marshal(map[string]string{to.Algorithm: to.Hex})
+		if err != nil {
+			return nil, err
+		}
+		subject["digest"] = b
+	}
+
+	b, err := json.Marshal(subjects)
+	if err != nil {
+		return nil, err
+	}
+	statement["subject"] = b
+
+	b, err = json.Marshal(statement)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode '%s' statement: %w", a.PredicateType, err)
+	}
+
+	return &Attestation{PredicateType: a.PredicateType, Statement: b}, nil
+}
+
+// LoadAttestationsFromImage returns the attestations in the given BuildKit
+// attestation manifest.
+func LoadAttestationsFromImage(img v1.Image) ([]*Attestation, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("could not get attestation manifest: %w", err)
+	}
+
+	attestations := []*Attestation{}
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != InTotoMediaType {
+			continue
+		}
+
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("could not get attestation '%s': %w", desc.Digest, err)
+		}
+
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return nil, fmt.Errorf("could not read attestation '%s': %w", desc.Digest, err)
+		}
+		statement, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read attestation '%s': %w", desc.Digest, err)
+		}
+
+		attestations = append(attestations, &Attestation{
+			PredicateType: desc.Annotations[PredicateTypeAnnotation],
+			Statement:     statement,
+		})
+	}
+
+	return attestations, nil
+}
+
+// WriteAttestations writes the given attestations as newline delimited in-toto
+// statements to the given path.
+func WriteAttestations(path string, attestations []*Attestation) error {
+	var buf bytes.Buffer
+	for _, a := range attestations {
+		if err := json.Compact(&buf, a.Statement); err != nil {
+			return fmt.Errorf("could not compact '%s' statement: %w", a.PredicateType, err)
+		}
+		buf.WriteByte('\n')
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not write '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+// LoadAttestations loads the newline delimited in-toto statements at the
+// given path.
+func LoadAttestations(path string) ([]*Attestation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open '%s': %w", path, err)
+	}
+	defer f.Close()
+
+	attestations := []*Attestation{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) < 1 {
+			continue
+		}
+
+		statement := struct {
+			PredicateType string `json:"predicateType"`
+		}{}
+		if err := json.Unmarshal(line, &statement); err != nil {
+			return nil, fmt.Errorf("could not decode statement in '%s': %w", path, err)
+		}
+
+		attestations = append(attestations, &Attestation{
+			PredicateType: statement.PredicateType,
+			Statement:     append([]byte{}, line...),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read '%s': %w", path, err)
+	}
+
+	return attestations, nil
+}
+
+// AttachAttestation pushes the given attestation as an OCI artifact which
+// refers to the given image digest so that it is discoverable via the OCI
+// referrers API (or its fallback tag schema).
+func AttachAttestation(ctx context.Context, digest name.Digest, attestation *Attestation, opts ...remote.Option) (name.Digest, error) {
+	opts = append(opts, remote.WithContext(ctx))
+
+	subject, err := remote.Head(digest, opts...)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("could not get subject '%s': %w", digest, err)
+	}
+
+	img, err := mutate.Append(
+		mutate.ConfigMediaType(
+			mutate.MediaType(empty.Image, types.OCIManifestSchema1),
+			InTotoMediaType,
+		),
+		mutate.Addendum{
+			Layer: static.NewLayer(attestation.Statement, InTotoMediaType),
+			Annotations: map[string]string{
+				PredicateTypeAnnotation: attestation.PredicateType,
+			},
+		},
+	)
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("could not create attestation artifact: %w", err)
+	}
+
+	// the subject must be set last as mutating annotations resets it.
+	artifact := mutate.Subject(
+		mutate.Annotations(img, map[string]string{
+			PredicateTypeAnnotation: attestation.PredicateType,
+		}),
+		v1.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+	).(v1.Image)
+
+	artifactDigest, err := artifact.Digest()
+	if err != nil {
+		return name.Digest{}, fmt.Errorf("could not get attestation artifact digest: %w", err)
+	}
+
+	ref := digest.Context().Digest(artifactDigest.String())
+	if err := remote.Write(ref, artifact, opts...); err != nil {
+		return name.Digest{}, fmt.Errorf("could not push attestation '%s': %w", ref, err)
+	}
+
+	return ref, nil
+}
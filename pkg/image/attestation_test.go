@@ -0,0 +1,103 @@
+package image_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAndLoadAttestations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attestations.intoto.jsonl")
+
+	require.NoError(t, image.WriteAttestations(path, []*image.Attestation{
+		{PredicateType: "https://spdx.dev/Document", Statement: []byte(testSBOMStatement)},
+		{PredicateType: "https://slsa.dev/provenance/v0.2", Statement: []byte("{\n  \"predicateType\": \"https://slsa.dev/provenance/v0.2\"\n}")},
+	}))
+
+	attestations, err := image.LoadAttestations(path)
+	require.NoError(t, err)
+	require.Len(t, attestations, 2)
+
+	assert.Equal(t, "https://spdx.dev/Document", attestations[0].PredicateType)
+	assert.JSONEq(t, testSBOMStatement, string(attestations[0].Statement))
+	assert.Equal(t, "https://slsa.dev/provenance/v0.2", attestations[1].PredicateType)
+}
+
+func TestAttestationResubject(t *testing.T) {
+	from := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	to := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("b", 64)}
+	other := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("c", 64)}
+
+	a := &image.Attestation{
+		PredicateType: "https://spdx.dev/Document",
+		Statement: []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document","subject":[` +
+			`{"name":"pkg:docker/foo","digest":{"sha256":"` + from.Hex + `"}},` +
+			`{"name":"pkg:docker/bar","digest":{"sha256":"` + other.Hex + `"}}],"predicate":{"foo":"bar"}}`),
+	}
+
+	resubjected, err := a.Resubject(from, to)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document","subject":[`+
+		`{"name":"pkg:docker/foo","digest":{"sha256":"`+to.Hex+`"}},`+
+		`{"name":"pkg:docker/bar","digest":{"sha256":"`+other.Hex+`"}}],"predicate":{"foo":"bar"}}`, string(resubjected.Statement))
+	assert.NoError(t, resubjected.VerifySubject(to))
+	assert.Error(t, resubjected.VerifySubject(from))
+
+	// the original attestation is unchanged.
+	assert.NoError(t, a.VerifySubject(from))
+
+	_, err = a.Resubject(to, from)
+	assert.Error(t, err)
+}
+
+func TestAttachAttestation(t *testing.T) {
+	for desc, referrersSupport := range map[string]bool{
+		"referrers API":          true,
+		"referrers tag fallback": false,
+	} {
+		t.Run(desc, func(t *testing.T) {
+			ctx := context.Background()
+
+			reg := newTestRegistry(t, registry.WithReferrersSupport(referrersSupport))
+			digest := pushRandomImage(t, reg+"/foo:bar")
+
+			for _, a := range []*image.Attestation{
+				{PredicateType: "https://spdx.dev/Document", Statement: []byte(testSBOMStatement)},
+				{PredicateType: "https://slsa.dev/provenance/v0.2", Statement: []byte(testProvenanceStatement)},
+			} {
+				_, err := image.AttachAttestation(ctx, digest, a)
+				require.NoError(t, err)
+			}
+
+			referrers, err := remote.Referrers(digest)
+			require.NoError(t, err)
+			manifest, err := referrers.IndexManifest()
+			require.NoError(t, err)
+			require.Len(t, manifest.Manifests, 2)
+
+			predicateTypes := []string{}
+			for _, desc := range manifest.Manifests {
+				assert.Equal(t, string(image.InTotoMediaType), desc.ArtifactType)
+
+				img, err := remote.Image(digest.Context().Digest(desc.Digest.String()))
+				require.NoError(t, err)
+				attestations, err := image.LoadAttestationsFromImage(img)
+				require.NoError(t, err)
+				require.Len(t, attestations, 1)
+				predicateTypes = append(predicateTypes, attestations[0].PredicateType)
+			}
+			assert.ElementsMatch(t, []string{
+				"https://spdx.dev/Document",
+				"https://slsa.dev/provenance/v0.2",
+			}, predicateTypes)
+		})
+	}
+}
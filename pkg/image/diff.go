@@ -0,0 +1,303 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var (
+	ErrSizeRegression = errors.New("size regression")
+)
+
+// Change types used in an ImageDiff.
+const (
+	ChangeAdded     = "added"
+	ChangeRemoved   = "removed"
+	ChangeModified  = "modified"
+	ChangeUnchanged = "unchanged"
+)
+
+// ImageDiff represents the differences between two images.
+type ImageDiff struct {
+	DigestA   string       `json:"digestA"`
+	DigestB   string       `json:"digestB"`
+	SizeA     int64        `json:"sizeA"`
+	SizeB     int64        `json:"sizeB"`
+	SizeDelta int64        `json:"sizeDelta"`
+	Config    []ConfigDiff `json:"config"`
+	Layers    []LayerDiff  `json:"layers"`
+	Files     []FileDiff   `json:"files"`
+}
+
+// ConfigDiff represents a difference in an image config field.
+type ConfigDiff struct {
+	Field string `json:"field"`
+	A     any    `json:"a"`
+	B     any    `json:"b"`
+}
+
+// LayerDiff represents the presence of a layer in either image.
+type LayerDiff struct {
+	Change string `json:"change"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// FileDiff represents a file which was added, removed or modified between
+// images.
+type FileDiff struct {
+	Change    string `json:"change"`
+	Path      string `json:"path"`
+	SizeA     int64  `json:"sizeA"`
+	SizeB     int64  `json:"sizeB"`
+	SizeDelta int64  `json:"sizeDelta"`
+}
+
+// Diff returns the differences between the given images, comparing their
+// config fields, layer digests and flattened filesystems.
+func Diff(a v1.Image, b v1.Image) (*ImageDiff, error) {
+	inspectionA, err := Inspect(a, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect a: %w", err)
+	}
+
+	inspectionB, err := Inspect(b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect b: %w", err)
+	}
+
+	d := &ImageDiff{
+		DigestA:   inspectionA.Digest,
+		DigestB:   inspectionB.Digest,
+		SizeA:     inspectionA.Size,
+		SizeB:     inspectionB.Size,
+		SizeDelta: inspectionB.Size - inspectionA.Size,
+		Config:    diffConfig(inspectionA, inspectionB),
+		Layers:    diffLayers(inspectionA.Layers, inspectionB.Layers),
+		Files:     []FileDiff{},
+	}
+
+	fsA, err := FlattenFilesystem(a)
+	if err != nil {
+		return nil, fmt.Errorf("could not read filesystem of a: %w", err)
+	}
+
+	fsB, err := FlattenFilesystem(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not read filesystem of b: %w", err)
+	}
+
+	d.Files = diffFilesystems(fsA, fsB)
+
+	return d, nil
+}
+
+func diffConfig(a *Inspection, b *Inspection) []ConfigDiff {
+	fields := []struct {
+		name string
+		a    any
+		b    any
+	}{
+		{"platform", a.Platform, b.Platform},
+		{"entrypoint", a.Config.Entrypoint, b.Config.Entrypoint},
+		{"cmd", a.Config.Cmd, b.Config.Cmd},
+		{"env", a.Config.Env, b.Config.Env},
+		{"user", a.Config.User, b.Config.User},
+		{"workingDir", a.Config.WorkingDir, b.Config.WorkingDir},
+		{"labels", a.Config.Labels, b.Config.Labels},
+		{"exposedPorts", a.Config.ExposedPorts, b.Config.ExposedPorts},
+	}
+
+	diffs := []ConfigDiff{}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.a, f.b) {
+			diffs = append(diffs, ConfigDiff{Field: f.name, A: f.a, B: f.b})
+		}
+	}
+
+	return diffs
+}
+
+func diffLayers(a []InspectionLayer, b []InspectionLayer) []LayerDiff {
+	inA := map[string]struct{}{}
+	for _, l := range a {
+		inA[l.Digest] = struct{}{}
+	}
+	inB := map[string]struct{}{}
+	for _, l := range b {
+		inB[l.Digest] = struct{}{}
+	}
+
+	diffs := []LayerDiff{}
+	for _, l := range a {
+		change := ChangeUnchanged
+		if _, ok := inB[l.Digest]; !ok {
+			change = ChangeRemoved
+		}
+		diffs = append(diffs, LayerDiff{Change: change, Digest: l.Digest, Size: l.Size})
+	}
+	for _, l := range b {
+		if _, ok := inA[l.Digest]; !ok {
+			diffs = append(diffs, LayerDiff{Change: ChangeAdded, Digest: l.Digest, Size: l.Size})
+		}
+	}
+
+	return diffs
+}
+
+func diffFilesystems(a Filesystem, b Filesystem) []FileDiff {
+	diffs := []FileDiff{}
+
+	for _, p := range a.Paths() {
+		fa := a[p]
+		fb, ok := b[p]
+		if !ok {
+			diffs = append(diffs, FileDiff{Change: ChangeRemoved, Path: p, SizeA: fa.Size, SizeDelta: -fa.Size})
+			continue
+		}
+
+		if fa.Type != fb.Type || fa.Mode != fb.Mode || fa.UID != fb.UID || fa.GID != fb.GID ||
+			fa.Linkname != fb.Linkname || fa.Digest != fb.Digest {
+			diffs = append(diffs, FileDiff{Change: ChangeModified, Path: p, SizeA: fa.Size, SizeB: fb.Size, SizeDelta: fb.Size - fa.Size})
+		}
+	}
+
+	for _, p := range b.Paths() {
+		if _, ok := a[p]; !ok {
+			fb := b[p]
+			diffs = append(diffs, FileDiff{Change: ChangeAdded, Path: p, SizeB: fb.Size, SizeDelta: fb.Size})
+		}
+	}
+
+	return diffs
+}
+
+// IsEmpty returns whether or not there are no differences.
+func (d *ImageDiff) IsEmpty() bool {
+	if len(d.Config) > 0 || len(d.Files) > 0 {
+		return false
+	}
+
+	for _, l := range d.Layers {
+		if l.Change != ChangeUnchanged {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckSizeRegression returns ErrSizeRegression if the size of image b
+// exceeds the size of image a by more than the given threshold. The threshold
+// is either a number of bytes with an optional unit, e.g. `10MiB`, or a
+// percentage of the size of image a, e.g. `5%`.
+func (d *ImageDiff) CheckSizeRegression(threshold string) error {
+	maxDelta, err := parseSizeThreshold(threshold, d.SizeA)
+	if err != nil {
+		return err
+	}
+
+	if d.SizeDelta > maxDelta {
+		return fmt.Errorf("%w: size increased by %s which exceeds the threshold of %s", ErrSizeRegression, HumanSize(d.SizeDelta), threshold)
+	}
+
+	return nil
+}
+
+var sizeThresholdRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([A-Za-z%]*)$`)
+
+func parseSizeThreshold(threshold string, base int64) (int64, error) {
+	matches := sizeThresholdRegex.FindStringSubmatch(strings.TrimSpace(threshold))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size threshold '%s'", threshold)
+	}
+
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size threshold '%s': %w", threshold, err)
+	}
+
+	multipliers := map[string]float64{
+		"":    1,
+		"B":   1,
+		"KB":  1000,
+		"KiB": 1024,
+		"MB":  1000 * 1000,
+		"MiB": 1024 * 1024,
+		"GB":  1000 * 1000 * 1000,
+		"GiB": 1024 * 1024 * 1024,
+	}
+
+	if matches[2] == "%" {
+		return int64(float64(base) * value / 100), nil
+	}
+
+	multiplier, ok := multipliers[matches[2]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size threshold unit '%s'", matches[2])
+	}
+
+	return int64(value * multiplier), nil
+}
+
+// WriteText writes the ImageDiff as human-readable text to the given writer.
+func (d *ImageDiff) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Digest:\t%s -> %s\n", d.DigestA, d.DigestB)
+
+	percentage := ""
+	if d.SizeA > 0 {
+		percentage = fmt.Sprintf(", %+.1f%%", float64(d.SizeDelta)*100/float64(d.SizeA))
+	}
+	fmt.Fprintf(tw, "Size:\t%s -> %s (%s%s)\n", HumanSize(d.SizeA), HumanSize(d.SizeB), signedHumanSize(d.SizeDelta), percentage)
+
+	fmt.Fprintf(tw, "\nConfig:\n")
+	for _, c := range d.Config {
+		a, _ := json.Marshal(c.A)
+		b, _ := json.Marshal(c.B)
+		fmt.Fprintf(tw, "  ~ %s:\t%s -> %s\n", c.Field, a, b)
+	}
+
+	fmt.Fprintf(tw, "\nLayers:\n")
+	for _, l := range d.Layers {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", changeSymbol(l.Change), l.Digest, HumanSize(l.Size))
+	}
+
+	fmt.Fprintf(tw, "\nFiles:\n")
+	for _, f := range d.Files {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", changeSymbol(f.Change), f.Path, signedHumanSize(f.SizeDelta))
+	}
+
+	return tw.Flush()
+}
+
+func changeSymbol(change string) string {
+	switch change {
+	case ChangeAdded:
+		return "+"
+	case ChangeRemoved:
+		return "-"
+	case ChangeModified:
+		return "~"
+	}
+
+	return "="
+}
+
+func signedHumanSize(size int64) string {
+	if size < 0 {
+		return HumanSize(size)
+	}
+
+	return "+" + HumanSize(size)
+}
@@ -0,0 +1,92 @@
+package image_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	base := newTestLayer(t,
+		testFile{name: "etc/"},
+		testFile{name: "etc/passwd", contents: "root"},
+		testFile{name: "etc/group", contents: "root"},
+	)
+
+	a := newTestImage(t, base,
+		newTestLayer(t, testFile{name: "app", contents: "v1"}),
+	)
+	b := newTestImage(t, base,
+		newTestLayer(t,
+			testFile{name: "app", contents: "v2.0"},
+			testFile{name: "etc/.wh.group"},
+			testFile{name: "data", contents: "data"},
+		),
+	)
+	b, err := mutate.Config(b, v1.Config{User: "nobody"})
+	require.NoError(t, err)
+
+	diff, err := image.Diff(a, b)
+	require.NoError(t, err)
+	assert.False(t, diff.IsEmpty())
+
+	assert.Equal(t, []image.ConfigDiff{
+		{Field: "user", A: "", B: "nobody"},
+	}, diff.Config)
+
+	require.Len(t, diff.Layers, 3)
+	assert.Equal(t, image.ChangeUnchanged, diff.Layers[0].Change)
+	assert.Equal(t, image.ChangeRemoved, diff.Layers[1].Change)
+	assert.Equal(t, image.ChangeAdded, diff.Layers[2].Change)
+
+	assert.Equal(t, []image.FileDiff{
+		{Change: image.ChangeModified, Path: "/app", SizeA: 2, SizeB: 4, SizeDelta: 2},
+		{Change: image.ChangeRemoved, Path: "/etc/group", SizeA: 4, SizeDelta: -4},
+		{Change: image.ChangeAdded, Path: "/data", SizeB: 4, SizeDelta: 4},
+	}, diff.Files)
+
+	var buf bytes.Buffer
+	require.NoError(t, diff.WriteText(&buf))
+	assert.Contains(t, buf.String(), "~ /app")
+	assert.Contains(t, buf.String(), "- /etc/group")
+	assert.Contains(t, buf.String(), "+ /data")
+}
+
+func TestDiffIdentical(t *testing.T) {
+	img := newTestImage(t, newTestLayer(t, testFile{name: "app", contents: "v1"}))
+
+	diff, err := image.Diff(img, img)
+	require.NoError(t, err)
+	assert.True(t, diff.IsEmpty())
+	assert.NoError(t, diff.CheckSizeRegression("0"))
+}
+
+func TestCheckSizeRegression(t *testing.T) {
+	diff := &image.ImageDiff{SizeA: 100 * 1024 * 1024, SizeDelta: 2 * 1024 * 1024}
+
+	for threshold, wantErr := range map[string]bool{
+		"1MiB":      true,
+		"3MiB":      false,
+		"1%":        true,
+		"2.5%":      false,
+		"1048576":   true,
+		"104857600": false,
+	} {
+		t.Run(threshold, func(t *testing.T) {
+			err := diff.CheckSizeRegression(threshold)
+			if wantErr {
+				assert.ErrorIs(t, err, image.ErrSizeRegression)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	assert.Error(t, diff.CheckSizeRegression("10 parsecs"))
+	assert.NotErrorIs(t, diff.CheckSizeRegression("10 parsecs"), image.ErrSizeRegression)
+}
@@ -0,0 +1,247 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	maxSymlinks    = 40
+)
+
+// File represents a file in the flattened filesystem of an image.
+type File struct {
+	Path     string `json:"path"`
+	Type     byte   `json:"type"`
+	Mode     int64  `json:"mode"`
+	UID      int    `json:"uid"`
+	GID      int    `json:"gid"`
+	Size     int64  `json:"size"`
+	Linkname string `json:"linkname,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Layer    int    `json:"layer"`
+}
+
+// IsDir returns whether or not the file is a directory.
+func (f *File) IsDir() bool {
+	return f.Type == tar.TypeDir
+}
+
+// Filesystem represents the flattened filesystem of an image, keyed by
+// absolute path.
+type Filesystem map[string]*File
+
+// Paths returns the sorted paths in the filesystem.
+func (fs Filesystem) Paths() []string {
+	paths := make([]string, 0, len(fs))
+	for p := range fs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// Lookup returns the file at the given path, following symlinks in every
+// component of the path, e.g. `/bin/sh` where `/bin -> usr/bin`.
+func (fs Filesystem) Lookup(p string) (*File, bool) {
+	remaining := splitPath(p)
+	current := "/"
+	links := 0
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+
+		if name == ".." {
+			current = path.Dir(current)
+			continue
+		}
+
+		next := path.Join(current, name)
+		f, ok := fs[next]
+		if !ok || f.Type != tar.TypeSymlink {
+			// parent directories may be implied by their children rather than
+			// having entries of their own.
+			current = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return nil, false
+		}
+		if path.IsAbs(f.Linkname) {
+			current = "/"
+		}
+		remaining = append(splitPath(f.Linkname), remaining...)
+	}
+
+	f, ok := fs[current]
+
+	return f, ok
+}
+
+// splitPath returns the components of the given path, excluding empty and `.`
+// components.
+func splitPath(p string) []string {
+	components := []string{}
+	for _, c := range strings.Split(p, "/") {
+		if c != "" && c != "." {
+			components = append(components, c)
+		}
+	}
+
+	return components
+}
+
+// FlattenFilesystem returns the filesystem of the given image after applying
+// each layer, and its whiteouts, in order.
+func FlattenFilesystem(img v1.Image) (Filesystem, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("could not get layers: %w", err)
+	}
+
+	fs := Filesystem{}
+	for idx, layer := range layers {
+		if err := fs.applyLayer(idx, layer); err != nil {
+			return nil, fmt.Errorf("could not apply layer %d: %w", idx, err)
+		}
+	}
+
+	return fs, nil
+}
+
+func (fs Filesystem) applyLayer(idx int, layer v1.Layer) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// paths added by this layer are not affected by opaque whiteouts in the
+	// same layer.
+	added := map[string]struct{}{}
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(p)
+		dir = path.Clean(dir)
+
+		switch {
+		case base == whiteoutOpaque:
+			for existing := range fs {
+				if _, ok := added[existing]; ok {
+					continue
+				}
+				if isChildOf(existing, dir) {
+					delete(fs, existing)
+				}
+			}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			fs.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		default:
+			f := &File{
+				Path:     p,
+				Type:     hdr.Typeflag,
+				Mode:     hdr.Mode,
+				UID:      hdr.Uid,
+				GID:      hdr.Gid,
+				Size:     hdr.Size,
+				Linkname: hdr.Linkname,
+				Layer:    idx,
+			}
+
+			if existing, ok := fs[p]; ok && existing.IsDir() && !f.IsDir() {
+				fs.remove(p)
+			}
+
+			if hdr.Typeflag == tar.TypeReg {
+				h := sha256.New()
+				if _, err := io.Copy(h, tr); err != nil {
+					return fmt.Errorf("could not read '%s': %w", p, err)
+				}
+				f.Digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+			}
+
+			fs[p] = f
+			added[p] = struct{}{}
+		}
+	}
+}
+
+// remove removes the given path and all of its children.
+func (fs Filesystem) remove(p string) {
+	delete(fs, p)
+	for existing := range fs {
+		if isChildOf(existing, p) {
+			delete(fs, existing)
+		}
+	}
+}
+
+func isChildOf(p string, dir string) bool {
+	if dir == "/" {
+		return p != "/"
+	}
+
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// FileMode returns the os.FileMode of the file, including its type bits.
+func (f *File) FileMode() os.FileMode {
+	hdr := &tar.Header{Typeflag: f.Type, Mode: f.Mode}
+
+	return hdr.FileInfo().Mode()
+}
+
+// ReadFile returns the contents of the regular file at the given path in the
+// flattened filesystem of the given image.
+func ReadFile(img v1.Image, p string) ([]byte, error) {
+	p = path.Clean("/" + p)
+
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: %s", os.ErrNotExist, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if path.Clean("/"+hdr.Name) != p {
+			continue
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("'%s' is not a regular file", p)
+		}
+
+		return io.ReadAll(tr)
+	}
+}
@@ -0,0 +1,149 @@
+package image_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFile represents an entry in a test layer. Directories have a trailing
+// slash and no contents, symlinks have a linkname.
+type testFile struct {
+	name     string
+	contents string
+	linkname string
+}
+
+func newTestLayer(t *testing.T, files ...testFile) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     int64(len(f.contents)),
+		}
+		if f.name[len(f.name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0o755
+		}
+		if f.linkname != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = f.linkname
+			hdr.Mode = 0o777
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	require.NoError(t, err)
+
+	return layer
+}
+
+func newTestImage(t *testing.T, layers ...v1.Layer) v1.Image {
+	t.Helper()
+
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	require.NoError(t, err)
+
+	return img
+}
+
+func TestFlattenFilesystem(t *testing.T) {
+	img := newTestImage(t,
+		newTestLayer(t,
+			testFile{name: "etc/"},
+			testFile{name: "etc/passwd", contents: "root"},
+			testFile{name: "etc/group", contents: "root"},
+			testFile{name: "var/"},
+			testFile{name: "var/cache/"},
+			testFile{name: "var/cache/a", contents: "a"},
+			testFile{name: "var/log", contents: "log"},
+		),
+		newTestLayer(t,
+			testFile{name: "etc/.wh.group"},
+			testFile{name: "etc/passwd", contents: "root:x"},
+			testFile{name: "var/cache/.wh..wh..opq"},
+			testFile{name: "var/cache/b", contents: "b"},
+			testFile{name: "var/log/"},
+		),
+	)
+
+	fs, err := image.FlattenFilesystem(img)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"/etc",
+		"/etc/passwd",
+		"/var",
+		"/var/cache",
+		"/var/cache/b",
+		"/var/log",
+	}, fs.Paths())
+
+	assert.Equal(t, int64(6), fs["/etc/passwd"].Size)
+	assert.Equal(t, 1, fs["/etc/passwd"].Layer)
+	assert.True(t, fs["/var/log"].IsDir())
+}
+
+func TestFilesystemLookup(t *testing.T) {
+	img := newTestImage(t,
+		newTestLayer(t,
+			testFile{name: "bin", linkname: "usr/bin"},
+			testFile{name: "lib", linkname: "/usr/lib"},
+			testFile{name: "usr/"},
+			testFile{name: "usr/bin/"},
+			testFile{name: "usr/bin/dash", contents: "dash"},
+			testFile{name: "usr/bin/sh", linkname: "dash"},
+			testFile{name: "usr/lib/libc.so", contents: "libc"},
+			testFile{name: "loop", linkname: "loop"},
+		),
+	)
+
+	fs, err := image.FlattenFilesystem(img)
+	require.NoError(t, err)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/usr/bin/dash", want: "/usr/bin/dash"},
+		{path: "/usr/bin/sh", want: "/usr/bin/dash"},
+		{path: "/bin/sh", want: "/usr/bin/dash"},
+		{path: "bin/../bin/./sh", want: "/usr/bin/dash"},
+		{path: "/lib/libc.so", want: "/usr/lib/libc.so"},
+		{path: "/bin", want: "/usr/bin"},
+		{path: "/bin/bash"},
+		{path: "/loop"},
+		{path: "/loop/sh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			f, ok := fs.Lookup(tt.path)
+			if tt.want == "" {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tt.want, f.Path)
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Inspection represents the human-relevant details of an image.
+type Inspection struct {
+	RepoTags  []string          `json:"repoTags"`
+	Digest    string            `json:"digest"`
+	MediaType string            `json:"mediaType"`
+	Size      int64             `json:"size"`
+	Platform  string            `json:"platform"`
+	Created   *time.Time        `json:"created,omitempty"`
+	Config    InspectionConfig  `json:"config"`
+	Layers    []InspectionLayer `json:"layers"`
+	Manifest  *v1.Manifest      `json:"manifest"`
+}
+
+// InspectionConfig represents the runtime configuration of an image.
+type InspectionConfig struct {
+	Entrypoint   []string          `json:"entrypoint"`
+	Cmd          []string          `json:"cmd"`
+	Env          []string          `json:"env"`
+	User         string            `json:"user"`
+	WorkingDir   string            `json:"workingDir"`
+	Labels       map[string]string `json:"labels"`
+	ExposedPorts []string          `json:"exposedPorts"`
+}
+
+// InspectionLayer represents a layer of an image.
+type InspectionLayer struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffID"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+// Inspect returns the Inspection of the given image.
+func Inspect(img v1.Image, repoTags []string) (*Inspection, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("could not get digest: %w", err)
+	}
+
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, fmt.Errorf("could not get media type: %w", err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("could not get manifest: %w", err)
+	}
+
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("could not get config: %w", err)
+	}
+
+	i := &Inspection{
+		RepoTags:  repoTags,
+		Digest:    digest.String(),
+		MediaType: string(mediaType),
+		Size:      manifest.Config.Size,
+		Config: InspectionConfig{
+			Entrypoint:   configFile.Config.Entrypoint,
+			Cmd:          configFile.Config.Cmd,
+			Env:          configFile.Config.Env,
+			User:         configFile.Config.User,
+			WorkingDir:   configFile.Config.WorkingDir,
+			Labels:       configFile.Config.Labels,
+			ExposedPorts: []string{},
+		},
+		Layers:   []InspectionLayer{},
+		Manifest: manifest,
+	}
+
+	if !configFile.Created.IsZero() {
+		i.Created = &configFile.Created.Time
+	}
+
+	if p := configFile.Platform(); p != nil {
+		i.Platform = p.String()
+	}
+
+	for port := range configFile.Config.ExposedPorts {
+		i.Config.ExposedPorts = append(i.Config.ExposedPorts, port)
+	}
+	sort.Strings(i.Config.ExposedPorts)
+
+	// history entries which created layers, in the same order as the layers.
+	layerHistory := []v1.History{}
+	for _, h := range configFile.History {
+		if !h.EmptyLayer {
+			layerHistory = append(layerHistory, h)
+		}
+	}
+
+	for idx, desc := range manifest.Layers {
+		l := InspectionLayer{
+			Digest:    desc.Digest.String(),
+			MediaType: string(desc.MediaType),
+			Size:      desc.Size,
+		}
+		if idx < len(configFile.RootFS.DiffIDs) {
+			l.DiffID = configFile.RootFS.DiffIDs[idx].String()
+		}
+		if idx < len(layerHistory) {
+			l.CreatedBy = layerHistory[idx].CreatedBy
+		}
+
+		i.Size += desc.Size
+		i.Layers = append(i.Layers, l)
+	}
+
+	return i, nil
+}
+
+// WriteText writes the Inspection as human-readable text to the given writer.
+func (i *Inspection) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Digest:\t%s\n", i.Digest)
+	fmt.Fprintf(tw, "Media Type:\t%s\n", i.MediaType)
+	fmt.Fprintf(tw, "Platform:\t%s\n", i.Platform)
+	fmt.Fprintf(tw, "Size:\t%s\n", HumanSize(i.Size))
+	if i.Created != nil {
+		fmt.Fprintf(tw, "Created:\t%s\n", i.Created.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "Repo Tags:\t%s\n", strings.Join(i.RepoTags, "\n\t"))
+
+	fmt.Fprintf(tw, "\nConfig:\n")
+	fmt.Fprintf(tw, "  Entrypoint:\t%s\n", formatList(i.Config.Entrypoint))
+	fmt.Fprintf(tw, "  Cmd:\t%s\n", formatList(i.Config.Cmd))
+	fmt.Fprintf(tw, "  User:\t%s\n", i.Config.User)
+	fmt.Fprintf(tw, "  Working Dir:\t%s\n", i.Config.WorkingDir)
+	fmt.Fprintf(tw, "  Env:\t%s\n", strings.Join(i.Config.Env, "\n\t"))
+	fmt.Fprintf(tw, "  Exposed Ports:\t%s\n", strings.Join(i.Config.ExposedPorts, ", "))
+
+	labelKeys := []string{}
+	for k := range i.Config.Labels {
+		labelKeys = append(labelKeys, k)
+	}
+	sort.Strings(labelKeys)
+	labels := []string{}
+	for _, k := range labelKeys {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, i.Config.Labels[k]))
+	}
+	fmt.Fprintf(tw, "  Labels:\t%s\n", strings.Join(labels, "\n\t"))
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nLayers:\n")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  #\tDIGEST\tSIZE\tCREATED BY\n")
+	for idx, l := range i.Layers {
+		fmt.Fprintf(tw, "  %d\t%s\t%s\t%s\n", idx, l.Digest, HumanSize(l.Size), truncate(l.CreatedBy, 60))
+	}
+
+	return tw.Flush()
+}
+
+// HumanSize returns the given number of bytes in a human-readable format.
+func HumanSize(size int64) string {
+	const unit = 1024
+	abs := size
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := abs / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatList(l []string) string {
+	if l == nil {
+		return ""
+	}
+
+	quoted := make([]string, len(l))
+	for i, s := range l {
+		quoted[i] = fmt.Sprintf("%q", s)
+	}
+
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	return s[:max-3] + "..."
+}
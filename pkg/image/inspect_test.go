@@ -0,0 +1,92 @@
+package image_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	require.NoError(t, err)
+
+	cfg, err := img.ConfigFile()
+	require.NoError(t, err)
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = "amd64"
+	cfg.Config = v1.Config{
+		Entrypoint:   []string{"/app/main"},
+		Cmd:          []string{"--help"},
+		Env:          []string{"PATH=/bin"},
+		User:         "65535",
+		WorkingDir:   "/app",
+		Labels:       map[string]string{"foo": "bar"},
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}, "443/tcp": {}},
+	}
+	img, err = mutate.ConfigFile(img, cfg)
+	require.NoError(t, err)
+
+	inspection, err := image.Inspect(img, []string{"example.com/foo:latest"})
+	require.NoError(t, err)
+
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+
+	assert.Equal(t, digest.String(), inspection.Digest)
+	assert.Equal(t, "linux/amd64", inspection.Platform)
+	assert.Equal(t, []string{"example.com/foo:latest"}, inspection.RepoTags)
+	assert.Equal(t, []string{"/app/main"}, inspection.Config.Entrypoint)
+	assert.Equal(t, []string{"--help"}, inspection.Config.Cmd)
+	assert.Equal(t, "65535", inspection.Config.User)
+	assert.Equal(t, "/app", inspection.Config.WorkingDir)
+	assert.Equal(t, []string{"443/tcp", "8080/tcp"}, inspection.Config.ExposedPorts)
+	require.Len(t, inspection.Layers, 2)
+	for i, l := range layers {
+		layerDigest, err := l.Digest()
+		require.NoError(t, err)
+		diffID, err := l.DiffID()
+		require.NoError(t, err)
+		size, err := l.Size()
+		require.NoError(t, err)
+
+		assert.Equal(t, layerDigest.String(), inspection.Layers[i].Digest)
+		assert.Equal(t, diffID.String(), inspection.Layers[i].DiffID)
+		assert.Equal(t, size, inspection.Layers[i].Size)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, inspection.WriteText(&buf))
+	assert.Contains(t, buf.String(), digest.String())
+	assert.Contains(t, buf.String(), `["/app/main"]`)
+	assert.Contains(t, buf.String(), "443/tcp, 8080/tcp")
+	assert.Contains(t, buf.String(), "foo=bar")
+}
+
+func TestHumanSize(t *testing.T) {
+	var tests = []struct {
+		in  int64
+		out string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{-2048, "-2.0 KiB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.out, func(t *testing.T) {
+			assert.Equal(t, tt.out, image.HumanSize(tt.in))
+		})
+	}
+}
@@ -9,12 +9,26 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/VJftw/please-buildkit/pkg/tracing"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PusherOpts struct {
 	CraneTool   string
 	FQNTagsPath string
+	// Signer optionally signs each pushed image, pushing a cosign compatible
+	// signature next to it.
+	Signer Signer
+	// Attestations are optionally attached to each pushed image as OCI
+	// referrers.
+	Attestations []*Attestation
+	// RemoteOptions are used when interacting with registries directly, e.g.
+	// when pushing signatures and attestations.
+	RemoteOptions []remote.Option
 }
 
 type Pusher struct {
@@ -30,35 +44,117 @@ func NewPusher(opts *PusherOpts) *Pusher {
 func (p *Pusher) PushTar(ctx context.Context, tarPath string, repoTags []string) error {
 	// TODO: return multiple errors when Go 1.20 is released.
 	resErr := fmt.Errorf("")
+	published := map[string]struct{}{}
 
 	for _, repoTag := range repoTags {
-		pushCmd := exec.CommandContext(ctx, p.opts.CraneTool, []string{
-			"push",
-			tarPath,
-			repoTag,
-		}...)
+		if err := p.push(ctx, tarPath, repoTag, published); err != nil {
+			resErr = fmt.Errorf("%s%s; ", resErr, err)
+		}
+	}
+
+	if resErr.Error() != "" {
+		return resErr
+	}
+
+	return nil
+}
 
-		pushCmd.Stderr = os.Stderr
-		pushCmd.Stdout = os.Stdout
+// push pushes the image at the given tar path to the given repo tag, followed
+// by its signature and attestations.
+func (p *Pusher) push(ctx context.Context, tarPath string, repoTag string, published map[string]struct{}) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "push", trace.WithAttributes(
+		attribute.String("image.repo_tag", repoTag),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	pushCmd := exec.CommandContext(ctx, p.opts.CraneTool, []string{
+		"push",
+		tarPath,
+		repoTag,
+	}...)
+
+	pushCmd.Stderr = os.Stderr
+	pushCmd.Stdout = os.Stdout
+
+	if err := pushCmd.Run(); err != nil {
+		log.Error().
+			Err(err).
+			Str("tarPath", tarPath).
+			Str("repoTag", repoTag).
+			Msg("could not push image")
+		return fmt.Errorf("could not push image: %s", err)
+	}
+
+	log.Info().
+		Str("repoTag", repoTag).
+		Msg("pushed image")
 
-		if err := pushCmd.Run(); err != nil {
+	if p.opts.Signer != nil || len(p.opts.Attestations) > 0 {
+		if err := p.publishArtifacts(ctx, repoTag, published); err != nil {
 			log.Error().
 				Err(err).
-				Str("tarPath", tarPath).
 				Str("repoTag", repoTag).
-				Msg("could not push image")
-			resErr = fmt.Errorf("%scould not push image: %s; ", resErr, err)
+				Msg("could not publish image artifacts")
+			return fmt.Errorf("could not publish image artifacts: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// publishArtifacts attaches the attestations to, and signs, the pushed image
+// at the given repo tag. Digests which have already been published to during
+// this push are skipped.
+func (p *Pusher) publishArtifacts(ctx context.Context, repoTag string, published map[string]struct{}) error {
+	ref, err := name.ParseReference(repoTag)
+	if err != nil {
+		return fmt.Errorf("could not parse '%s': %w", repoTag, err)
+	}
+
+	opts := append([]remote.Option{remote.WithContext(ctx)}, p.opts.RemoteOptions...)
+	desc, err := remote.Head(ref, opts...)
+	if err != nil {
+		return fmt.Errorf("could not resolve pushed digest of '%s': %w", repoTag, err)
+	}
+
+	digest := ref.Context().Digest(desc.Digest.String())
+	if _, ok := published[digest.String()]; ok {
+		return nil
+	}
+
+	for _, attestation := range p.opts.Attestations {
+		// verifiers reject attestations which do not refer to the image they
+		// are attached to, e.g. if the image was modified after it was built.
+		if err := attestation.VerifySubject(desc.Digest); err != nil {
+			return fmt.Errorf("attestation does not match pushed image '%s': %w", digest, err)
+		}
+
+		attestationRef, err := AttachAttestation(ctx, digest, attestation, p.opts.RemoteOptions...)
+		if err != nil {
+			return err
 		}
 
 		log.Info().
-			Str("repoTag", repoTag).
-			Msg("pushed image")
+			Str("digest", digest.String()).
+			Str("predicateType", attestation.PredicateType).
+			Str("attestation", attestationRef.String()).
+			Msg("attached attestation")
 	}
 
-	if resErr.Error() != "" {
-		return resErr
+	if p.opts.Signer != nil {
+		sigTag, err := SignImage(ctx, digest, p.opts.Signer, p.opts.RemoteOptions...)
+		if err != nil {
+			return err
+		}
+
+		log.Info().
+			Str("digest", digest.String()).
+			Str("signature", sigTag.String()).
+			Msg("signed image")
 	}
 
+	published[digest.String()] = struct{}{}
+
 	return nil
 }
 
@@ -0,0 +1,225 @@
+package image
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// SimpleSigningMediaType is the media type of cosign signature layers.
+	SimpleSigningMediaType types.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// SignatureAnnotation is the layer annotation which holds the base64
+	// encoded signature of the layer.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	simpleSigningType = "cosign container image signature"
+)
+
+var (
+	ErrNoSignatures = errors.New("no signatures found")
+)
+
+// SimpleSigningPayload represents the payload that is signed for an image, as
+// per the cosign "simple signing" format.
+type SimpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]any `json:"optional"`
+}
+
+// NewSimpleSigningPayload returns the simple signing payload for the given
+// image digest.
+func NewSimpleSigningPayload(digest name.Digest) *SimpleSigningPayload {
+	p := &SimpleSigningPayload{}
+	p.Critical.Identity.DockerReference = digest.Context().String()
+	p.Critical.Image.DockerManifestDigest = digest.DigestStr()
+	p.Critical.Type = simpleSigningType
+
+	return p
+}
+
+// SignatureTag returns the cosign signature tag for the given image digest,
+// i.e. `<repository>:sha256-<hex>.sig`.
+func SignatureTag(digest name.Digest) (name.Tag, error) {
+	h, err := v1.NewHash(digest.DigestStr())
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("could not parse digest '%s': %w", digest.DigestStr(), err)
+	}
+
+	return digest.Context().Tag(fmt.Sprintf("%s-%s.sig", h.Algorithm, h.Hex)), nil
+}
+
+// SignImage signs the given image digest with the given Signer and pushes the
+// signature next to it. Existing signatures for the digest are kept.
+func SignImage(ctx context.Context, digest name.Digest, signer Signer, opts ...remote.Option) (name.Tag, error) {
+	sigTag, err := SignatureTag(digest)
+	if err != nil {
+		return name.Tag{}, err
+	}
+
+	payload, err := json.Marshal(NewSimpleSigningPayload(digest))
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("could not marshal payload: %w", err)
+	}
+
+	sig, err := signer.Sign(ctx, payload)
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("could not sign '%s': %w", digest, err)
+	}
+
+	opts = append(opts, remote.WithContext(ctx))
+	sigImg, err := loadSignatureImage(sigTag, opts...)
+	if err != nil {
+		return name.Tag{}, err
+	}
+
+	sigImg, err = mutate.Append(sigImg, mutate.Addendum{
+		Layer: static.NewLayer(payload, SimpleSigningMediaType),
+		Annotations: map[string]string{
+			SignatureAnnotation: base64.StdEncoding.EncodeToString(sig),
+		},
+	})
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("could not append signature: %w", err)
+	}
+
+	if err := remote.Write(sigTag, sigImg, opts...); err != nil {
+		return name.Tag{}, fmt.Errorf("could not push signature '%s': %w", sigTag, err)
+	}
+
+	return sigTag, nil
+}
+
+// VerifyImageSignatures verifies the signatures of the given image reference
+// against the given public key and returns the verified payloads. An error is
+// returned if there are no valid signatures.
+func VerifyImageSignatures(ctx context.Context, ref name.Reference, publicKey crypto.PublicKey, opts ...remote.Option) ([]*SimpleSigningPayload, error) {
+	opts = append(opts, remote.WithContext(ctx))
+
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		desc, err := remote.Head(ref, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve '%s': %w", ref, err)
+		}
+		digest = ref.Context().Digest(desc.Digest.String())
+	}
+
+	sigTag, err := SignatureTag(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	sigImg, err := remote.Image(sigTag, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not get signatures '%s': %w", sigTag, err)
+	}
+
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("could not get signatures manifest '%s': %w", sigTag, err)
+	}
+
+	verified := []*SimpleSigningPayload{}
+	var errs error
+	for _, desc := range manifest.Layers {
+		payload, err := verifySignatureLayer(sigImg, desc, publicKey, digest)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("signature '%s': %w", desc.Digest, err))
+			continue
+		}
+		verified = append(verified, payload)
+	}
+
+	if len(verified) < 1 {
+		return nil, errors.Join(fmt.Errorf("'%s': %w", digest, ErrNoSignatures), errs)
+	}
+
+	return verified, nil
+}
+
+func verifySignatureLayer(sigImg v1.Image, desc v1.Descriptor, publicKey crypto.PublicKey, digest name.Digest) (*SimpleSigningPayload, error) {
+	if desc.MediaType != SimpleSigningMediaType {
+		return nil, fmt.Errorf("unexpected media type '%s'", desc.MediaType)
+	}
+
+	b64Sig, ok := desc.Annotations[SignatureAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing '%s' annotation", SignatureAnnotation)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(b64Sig)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode signature: %w", err)
+	}
+
+	layer, err := sigImg.LayerByDigest(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("could not get layer: %w", err)
+	}
+
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, fmt.Errorf("could not read layer: %w", err)
+	}
+	defer rc.Close()
+
+	payloadBytes, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("could not read layer: %w", err)
+	}
+
+	if err := VerifySignature(publicKey, payloadBytes, sig); err != nil {
+		return nil, err
+	}
+
+	payload := &SimpleSigningPayload{}
+	if err := json.Unmarshal(payloadBytes, payload); err != nil {
+		return nil, fmt.Errorf("could not decode payload: %w", err)
+	}
+
+	if payload.Critical.Image.DockerManifestDigest != digest.DigestStr() {
+		return nil, fmt.Errorf("payload digest '%s' does not match '%s'", payload.Critical.Image.DockerManifestDigest, digest.DigestStr())
+	}
+
+	return payload, nil
+}
+
+func loadSignatureImage(sigTag name.Tag, opts ...remote.Option) (v1.Image, error) {
+	sigImg, err := remote.Image(sigTag, opts...)
+	if err == nil {
+		return sigImg, nil
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+		return mutate.ConfigMediaType(
+			mutate.MediaType(empty.Image, types.OCIManifestSchema1),
+			types.OCIConfigJSON,
+		), nil
+	}
+
+	return nil, fmt.Errorf("could not get existing signatures '%s': %w", sigTag, err)
+}
@@ -0,0 +1,166 @@
+package image_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRegistry(t *testing.T, opts ...registry.Option) string {
+	t.Helper()
+
+	opts = append(opts, registry.Logger(log.New(io.Discard, "", 0)))
+	s := httptest.NewServer(registry.New(opts...))
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+
+	return u.Host
+}
+
+func pushRandomImage(t *testing.T, repoTag string) name.Digest {
+	t.Helper()
+
+	ref, err := name.ParseReference(repoTag)
+	require.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, img))
+
+	digest, err := img.Digest()
+	require.NoError(t, err)
+
+	return ref.Context().Digest(digest.String())
+}
+
+func newTestSigner(t *testing.T) *image.KeySigner {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	return image.NewKeySigner(key)
+}
+
+func TestSignatureTag(t *testing.T) {
+	digest, err := name.NewDigest("example.com/foo@sha256:11102cb670e913610f2e07875d28cceac87152e16daedc46a47201e537f682b4")
+	require.NoError(t, err)
+
+	sigTag, err := image.SignatureTag(digest)
+	require.NoError(t, err)
+
+	assert.Equal(t, "example.com/foo:sha256-11102cb670e913610f2e07875d28cceac87152e16daedc46a47201e537f682b4.sig", sigTag.String())
+}
+
+func TestSignAndVerifyImage(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t)
+	digest := pushRandomImage(t, reg+"/foo:bar")
+
+	signer := newTestSigner(t)
+	sigTag, err := image.SignImage(ctx, digest, signer)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", sigTag.RepositoryStr())
+
+	publicKey, err := signer.PublicKey(ctx)
+	require.NoError(t, err)
+
+	t.Run("verify by tag", func(t *testing.T) {
+		payloads, err := image.VerifyImageSignatures(ctx, mustParseReference(t, reg+"/foo:bar"), publicKey)
+		require.NoError(t, err)
+		require.Len(t, payloads, 1)
+		assert.Equal(t, digest.DigestStr(), payloads[0].Critical.Image.DockerManifestDigest)
+	})
+
+	t.Run("verify by digest", func(t *testing.T) {
+		payloads, err := image.VerifyImageSignatures(ctx, digest, publicKey)
+		require.NoError(t, err)
+		assert.Len(t, payloads, 1)
+	})
+
+	t.Run("wrong public key", func(t *testing.T) {
+		otherPublicKey, err := newTestSigner(t).PublicKey(ctx)
+		require.NoError(t, err)
+
+		_, err = image.VerifyImageSignatures(ctx, digest, otherPublicKey)
+		assert.ErrorIs(t, err, image.ErrNoSignatures)
+	})
+
+	t.Run("additional signatures are appended", func(t *testing.T) {
+		otherSigner := newTestSigner(t)
+		_, err := image.SignImage(ctx, digest, otherSigner)
+		require.NoError(t, err)
+
+		otherPublicKey, err := otherSigner.PublicKey(ctx)
+		require.NoError(t, err)
+
+		for _, k := range []any{publicKey, otherPublicKey} {
+			payloads, err := image.VerifyImageSignatures(ctx, digest, k)
+			require.NoError(t, err)
+			assert.Len(t, payloads, 1)
+		}
+	})
+}
+
+func TestVerifyImageSignaturesUnsigned(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t)
+	digest := pushRandomImage(t, reg+"/foo:bar")
+
+	publicKey, err := newTestSigner(t).PublicKey(ctx)
+	require.NoError(t, err)
+
+	_, err = image.VerifyImageSignatures(ctx, digest, publicKey)
+	assert.Error(t, err)
+}
+
+func TestVerifyImageSignaturesOtherDigest(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t)
+	digest := pushRandomImage(t, reg+"/foo:bar")
+	otherDigest := pushRandomImage(t, reg+"/foo:baz")
+
+	signer := newTestSigner(t)
+	_, err := image.SignImage(ctx, otherDigest, signer)
+	require.NoError(t, err)
+
+	// copy the signature of another image to this image's signature tag.
+	otherSigTag, err := image.SignatureTag(otherDigest)
+	require.NoError(t, err)
+	sigTag, err := image.SignatureTag(digest)
+	require.NoError(t, err)
+	sigImg, err := remote.Image(otherSigTag)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(sigTag, sigImg))
+
+	publicKey, err := signer.PublicKey(ctx)
+	require.NoError(t, err)
+
+	_, err = image.VerifyImageSignatures(ctx, digest, publicKey)
+	assert.ErrorIs(t, err, image.ErrNoSignatures)
+}
+
+func mustParseReference(t *testing.T, s string) name.Reference {
+	t.Helper()
+
+	ref, err := name.ParseReference(s)
+	require.NoError(t, err)
+
+	return ref
+}
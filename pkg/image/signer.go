@@ -0,0 +1,268 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("unsupported key")
+)
+
+// Signer abstracts the implementations which sign image signature payloads.
+type Signer interface {
+	// Sign returns the signature of the given payload.
+	Sign(ctx context.Context, payload []byte) ([]byte, error)
+	// PublicKey returns the public key which verifies signatures created by
+	// this Signer.
+	PublicKey(ctx context.Context) (crypto.PublicKey, error)
+}
+
+// KeySigner implements Signer via a local private key.
+type KeySigner struct {
+	key crypto.Signer
+}
+
+// NewKeySigner returns a new Signer for the given private key.
+func NewKeySigner(key crypto.Signer) *KeySigner {
+	return &KeySigner{
+		key: key,
+	}
+}
+
+// LoadKeySigner returns a new Signer for the PEM encoded private key at the
+// given path. Encrypted cosign private keys are decrypted with the given
+// password.
+func LoadKeySigner(keyPath string, password []byte) (*KeySigner, error) {
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read '%s': %w", keyPath, err)
+	}
+
+	key, err := ParsePrivateKey(keyBytes, password)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %w", keyPath, err)
+	}
+
+	return NewKeySigner(key), nil
+}
+
+// Sign implements Signer.Sign.
+func (s *KeySigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		return s.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(payload)
+
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// PublicKey implements Signer.PublicKey.
+func (s *KeySigner) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	return s.key.Public(), nil
+}
+
+// PluginSigner implements Signer via an external binary, e.g. one which
+// delegates to a KMS. The binary is invoked as:
+//
+//   - `<binary> sign`: the payload is given on stdin and the base64 encoded
+//     signature is expected on stdout.
+//   - `<binary> public-key`: the PEM encoded public key is expected on stdout.
+type PluginSigner struct {
+	binary string
+}
+
+// NewPluginSigner returns a new Signer implemented via the given binary.
+func NewPluginSigner(binary string) *PluginSigner {
+	return &PluginSigner{
+		binary: binary,
+	}
+}
+
+// Sign implements Signer.Sign.
+func (s *PluginSigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	out, err := s.run(ctx, payload, "sign")
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode signature from '%s': %w", s.binary, err)
+	}
+
+	return sig, nil
+}
+
+// PublicKey implements Signer.PublicKey.
+func (s *PluginSigner) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	out, err := s.run(ctx, nil, "public-key")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePublicKey(out)
+}
+
+func (s *PluginSigner) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, s.binary, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not run '%s': %w\n%s", strings.Join(cmd.Args, " "), err, stderr.String())
+	}
+
+	return out, nil
+}
+
+// ParsePrivateKey parses the given PEM encoded private key. This supports
+// PKCS#8, PKCS#1, SEC 1 and encrypted cosign private keys.
+func ParsePrivateKey(keyBytes []byte, password []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found: %w", ErrUnsupportedKey)
+	}
+
+	der := block.Bytes
+	switch block.Type {
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		decrypted, err := decryptCosignKey(der, password)
+		if err != nil {
+			return nil, err
+		}
+		der = decrypted
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%T: %w", key, ErrUnsupportedKey)
+	}
+
+	return signer, nil
+}
+
+// ParsePublicKey parses the given PEM encoded PKIX public key.
+func ParsePublicKey(keyBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found: %w", ErrUnsupportedKey)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// VerifySignature verifies the given signature of the payload against the
+// given public key.
+func VerifySignature(publicKey crypto.PublicKey, payload []byte, sig []byte) error {
+	digest := sha256.Sum256(payload)
+
+	switch k := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("invalid ecdsa signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			if err := rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil); err != nil {
+				return fmt.Errorf("invalid rsa signature: %w", err)
+			}
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("%T: %w", publicKey, ErrUnsupportedKey)
+	}
+
+	return nil
+}
+
+// encryptedCosignKey represents the JSON envelope of an encrypted cosign
+// private key.
+type encryptedCosignKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func decryptCosignKey(envelope []byte, password []byte) ([]byte, error) {
+	k := &encryptedCosignKey{}
+	if err := json.Unmarshal(envelope, k); err != nil {
+		return nil, fmt.Errorf("could not decode encrypted key: %w", err)
+	}
+
+	if k.KDF.Name != "scrypt" || k.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("%s/%s: %w", k.KDF.Name, k.Cipher.Name, ErrUnsupportedKey)
+	}
+
+	secret, err := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %w", err)
+	}
+
+	var (
+		secretKey [32]byte
+		nonce     [24]byte
+	)
+	copy(secretKey[:], secret)
+	copy(nonce[:], k.Cipher.Nonce)
+
+	decrypted, ok := secretbox.Open(nil, k.Ciphertext, &nonce, &secretKey)
+	if !ok {
+		return nil, errors.New("could not decrypt key: incorrect password")
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,157 @@
+package image_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func encryptCosignKey(t *testing.T, der []byte, password []byte) []byte {
+	t.Helper()
+
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	require.NoError(t, err)
+
+	secret, err := scrypt.Key(password, salt, 32768, 8, 1, 32)
+	require.NoError(t, err)
+	var secretKey [32]byte
+	copy(secretKey[:], secret)
+
+	envelope := map[string]any{
+		"kdf": map[string]any{
+			"name":   "scrypt",
+			"params": map[string]int{"N": 32768, "r": 8, "p": 1},
+			"salt":   salt,
+		},
+		"cipher": map[string]any{
+			"name":  "nacl/secretbox",
+			"nonce": nonce[:],
+		},
+		"ciphertext": secretbox.Seal(nil, der, &nonce, &secretKey),
+	}
+	envelopeBytes, err := json.Marshal(envelope)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: envelopeBytes})
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	var tests = []struct {
+		desc       string
+		inKey      []byte
+		inPassword []byte
+		outErr     bool
+	}{
+		{
+			"SEC 1 EC private key",
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}),
+			nil,
+			false,
+		},
+		{
+			"PKCS#8 private key",
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER}),
+			nil,
+			false,
+		},
+		{
+			"PKCS#1 RSA private key",
+			pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+			nil,
+			false,
+		},
+		{
+			"PKCS#8 ed25519 private key",
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}),
+			nil,
+			false,
+		},
+		{
+			"encrypted cosign private key",
+			encryptCosignKey(t, pkcs8DER, []byte("hunter2")),
+			[]byte("hunter2"),
+			false,
+		},
+		{
+			"encrypted cosign private key - incorrect password",
+			encryptCosignKey(t, pkcs8DER, []byte("hunter2")),
+			[]byte("hunter3"),
+			true,
+		},
+		{
+			"not PEM",
+			[]byte("foo"),
+			nil,
+			true,
+		},
+		{
+			"invalid SEC 1 EC private key",
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("foo")}),
+			nil,
+			true,
+		},
+		{
+			"invalid PKCS#1 RSA private key",
+			pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("foo")}),
+			nil,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			key, err := image.ParsePrivateKey(tt.inKey, tt.inPassword)
+			if tt.outErr {
+				assert.Error(t, err)
+				// the key must be an untyped nil so callers can compare it.
+				assert.True(t, key == nil, "expected nil key, got %T", key)
+				return
+			}
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			signer := image.NewKeySigner(key)
+			sig, err := signer.Sign(ctx, []byte("payload"))
+			require.NoError(t, err)
+
+			publicKey, err := signer.PublicKey(ctx)
+			require.NoError(t, err)
+
+			assert.NoError(t, image.VerifySignature(publicKey, []byte("payload"), sig))
+			assert.Error(t, image.VerifySignature(publicKey, []byte("other payload"), sig))
+		})
+	}
+}
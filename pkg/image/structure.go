@@ -0,0 +1,307 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// StructureTestSpec represents a set of assertions about the structure of an
+// image which can be checked without running a container.
+type StructureTestSpec struct {
+	FileExistenceTests []FileExistenceTest `json:"fileExistenceTests" yaml:"fileExistenceTests"`
+	FileContentTests   []FileContentTest   `json:"fileContentTests" yaml:"fileContentTests"`
+	MetadataTest       *MetadataTest       `json:"metadataTest" yaml:"metadataTest"`
+	// MaxSize is the maximum compressed size of the image's layers, e.g.
+	// `50MiB`.
+	MaxSize string `json:"maxSize" yaml:"maxSize"`
+}
+
+// FileExistenceTest asserts the presence, or absence, of a file and
+// optionally its permissions and owner.
+type FileExistenceTest struct {
+	Name        string `json:"name" yaml:"name"`
+	Path        string `json:"path" yaml:"path"`
+	ShouldExist *bool  `json:"shouldExist" yaml:"shouldExist"`
+	// Permissions are in the format of os.FileMode.String(), e.g.
+	// `-rwxr-xr-x`.
+	Permissions string `json:"permissions" yaml:"permissions"`
+	UID         *int   `json:"uid" yaml:"uid"`
+	GID         *int   `json:"gid" yaml:"gid"`
+}
+
+// FileContentTest asserts that the contents of a file match, or do not match,
+// the given regular expressions.
+type FileContentTest struct {
+	Name             string   `json:"name" yaml:"name"`
+	Path             string   `json:"path" yaml:"path"`
+	ExpectedContents []string `json:"expectedContents" yaml:"expectedContents"`
+	ExcludedContents []string `json:"excludedContents" yaml:"excludedContents"`
+}
+
+// MetadataTest asserts the runtime configuration of an image. Fields which
+// are not set are not checked.
+type MetadataTest struct {
+	Entrypoint   *[]string `json:"entrypoint" yaml:"entrypoint"`
+	Cmd          *[]string `json:"cmd" yaml:"cmd"`
+	User         *string   `json:"user" yaml:"user"`
+	WorkingDir   *string   `json:"workingDir" yaml:"workingDir"`
+	Env          []EnvVar  `json:"env" yaml:"env"`
+	ExposedPorts []string  `json:"exposedPorts" yaml:"exposedPorts"`
+}
+
+// EnvVar represents an expected environment variable. The value is treated as
+// a regular expression if IsRegex is set.
+type EnvVar struct {
+	Key     string `json:"key" yaml:"key"`
+	Value   string `json:"value" yaml:"value"`
+	IsRegex bool   `json:"isRegex" yaml:"isRegex"`
+}
+
+// StructureTestResult represents the result of a single structure test.
+type StructureTestResult struct {
+	Name   string   `json:"name"`
+	Errors []string `json:"errors"`
+}
+
+// Passed returns whether or not the test passed.
+func (r *StructureTestResult) Passed() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *StructureTestResult) errorf(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// LoadStructureTestSpec loads a StructureTestSpec from the given YAML or JSON
+// file.
+func LoadStructureTestSpec(path string) (*StructureTestSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// YAML is a superset of JSON so this handles both.
+	spec := &StructureTestSpec{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("could not parse '%s': %w", path, err)
+	}
+
+	return spec, nil
+}
+
+// RunStructureTests runs the tests in the given spec against the given image.
+func RunStructureTests(img v1.Image, spec *StructureTestSpec) ([]*StructureTestResult, error) {
+	fs, err := FlattenFilesystem(img)
+	if err != nil {
+		return nil, fmt.Errorf("could not read filesystem: %w", err)
+	}
+
+	inspection, err := Inspect(img, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect image: %w", err)
+	}
+
+	results := []*StructureTestResult{}
+
+	for _, t := range spec.FileExistenceTests {
+		results = append(results, runFileExistenceTest(fs, t))
+	}
+
+	for _, t := range spec.FileContentTests {
+		results = append(results, runFileContentTest(img, fs, t))
+	}
+
+	if spec.MetadataTest != nil {
+		results = append(results, runMetadataTest(inspection, spec.MetadataTest))
+	}
+
+	if spec.MaxSize != "" {
+		result := &StructureTestResult{Name: fmt.Sprintf("Size under %s", spec.MaxSize)}
+		maxSize, err := parseSizeThreshold(spec.MaxSize, 0)
+		switch {
+		case err != nil:
+			result.errorf("%s", err)
+		case inspection.Size > maxSize:
+			result.errorf("image size %s exceeds %s", HumanSize(inspection.Size), spec.MaxSize)
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func runFileExistenceTest(fs Filesystem, t FileExistenceTest) *StructureTestResult {
+	result := &StructureTestResult{Name: testName(t.Name, "File Existence", t.Path)}
+
+	shouldExist := t.ShouldExist == nil || *t.ShouldExist
+	f, ok := fs.Lookup(t.Path)
+	switch {
+	case !ok && shouldExist:
+		result.errorf("'%s' does not exist", t.Path)
+		return result
+	case ok && !shouldExist:
+		result.errorf("'%s' exists but should not", t.Path)
+		return result
+	case !ok:
+		return result
+	}
+
+	if t.Permissions != "" {
+		if mode := f.FileMode().String(); mode != t.Permissions {
+			result.errorf("'%s' has permissions %s, expected %s", t.Path, mode, t.Permissions)
+		}
+	}
+
+	if t.UID != nil && f.UID != *t.UID {
+		result.errorf("'%s' is owned by uid %d, expected %d", t.Path, f.UID, *t.UID)
+	}
+
+	if t.GID != nil && f.GID != *t.GID {
+		result.errorf("'%s' is owned by gid %d, expected %d", t.Path, f.GID, *t.GID)
+	}
+
+	return result
+}
+
+func runFileContentTest(img v1.Image, fs Filesystem, t FileContentTest) *StructureTestResult {
+	result := &StructureTestResult{Name: testName(t.Name, "File Content", t.Path)}
+
+	f, ok := fs.Lookup(t.Path)
+	if !ok {
+		result.errorf("'%s' does not exist", t.Path)
+		return result
+	}
+
+	contents, err := ReadFile(img, f.Path)
+	if err != nil {
+		result.errorf("could not read '%s': %s", t.Path, err)
+		return result
+	}
+
+	for _, expr := range t.ExpectedContents {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			result.errorf("invalid regex '%s': %s", expr, err)
+			continue
+		}
+		if !re.Match(contents) {
+			result.errorf("'%s' does not match '%s'", t.Path, expr)
+		}
+	}
+
+	for _, expr := range t.ExcludedContents {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			result.errorf("invalid regex '%s': %s", expr, err)
+			continue
+		}
+		if re.Match(contents) {
+			result.errorf("'%s' matches excluded '%s'", t.Path, expr)
+		}
+	}
+
+	return result
+}
+
+func runMetadataTest(inspection *Inspection, t *MetadataTest) *StructureTestResult {
+	result := &StructureTestResult{Name: "Metadata"}
+	config := inspection.Config
+
+	if t.Entrypoint != nil && formatList(config.Entrypoint) != formatList(*t.Entrypoint) {
+		result.errorf("entrypoint is %s, expected %s", formatList(config.Entrypoint), formatList(*t.Entrypoint))
+	}
+
+	if t.Cmd != nil && formatList(config.Cmd) != formatList(*t.Cmd) {
+		result.errorf("cmd is %s, expected %s", formatList(config.Cmd), formatList(*t.Cmd))
+	}
+
+	if t.User != nil && config.User != *t.User {
+		result.errorf("user is '%s', expected '%s'", config.User, *t.User)
+	}
+
+	if t.WorkingDir != nil && config.WorkingDir != *t.WorkingDir {
+		result.errorf("working dir is '%s', expected '%s'", config.WorkingDir, *t.WorkingDir)
+	}
+
+	env := map[string]string{}
+	for _, kv := range config.Env {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	for _, e := range t.Env {
+		v, ok := env[e.Key]
+		if !ok {
+			result.errorf("env var '%s' is not set", e.Key)
+			continue
+		}
+
+		if !e.IsRegex {
+			if v != e.Value {
+				result.errorf("env var '%s' is '%s', expected '%s'", e.Key, v, e.Value)
+			}
+			continue
+		}
+
+		re, err := regexp.Compile(e.Value)
+		if err != nil {
+			result.errorf("invalid regex '%s': %s", e.Value, err)
+			continue
+		}
+		if !re.MatchString(v) {
+			result.errorf("env var '%s' is '%s' which does not match '%s'", e.Key, v, e.Value)
+		}
+	}
+
+	if t.ExposedPorts != nil {
+		expected := append([]string{}, t.ExposedPorts...)
+		sort.Strings(expected)
+		if strings.Join(expected, ",") != strings.Join(config.ExposedPorts, ",") {
+			result.errorf("exposed ports are %v, expected %v", config.ExposedPorts, expected)
+		}
+	}
+
+	return result
+}
+
+func testName(name string, kind string, path string) string {
+	if name != "" {
+		return name
+	}
+
+	return fmt.Sprintf("%s: %s", kind, path)
+}
+
+// WriteStructureTestResults writes the given results as human-readable text
+// to the given writer.
+func WriteStructureTestResults(w io.Writer, results []*StructureTestResult) error {
+	passed := 0
+	for _, r := range results {
+		status := "FAIL"
+		if r.Passed() {
+			status = "PASS"
+			passed++
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", status, r.Name); err != nil {
+			return err
+		}
+		for _, e := range r.Errors {
+			if _, err := fmt.Fprintf(w, "    %s\n", e); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d/%d tests passed\n", passed, len(results))
+	return err
+}
@@ -0,0 +1,122 @@
+package image_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/image"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStructureTestImage(t *testing.T) v1.Image {
+	t.Helper()
+
+	img := newTestImage(t, newTestLayer(t,
+		testFile{name: "etc/"},
+		testFile{name: "etc/passwd", contents: "root:x:0:0:root:/root:/bin/sh\n"},
+		testFile{name: "app/"},
+		testFile{name: "app/config.yaml", contents: "debug: false\n"},
+	))
+
+	img, err := mutate.Config(img, v1.Config{
+		Entrypoint:   []string{"/app/server"},
+		User:         "65535",
+		Env:          []string{"PATH=/usr/local/bin:/usr/bin", "APP_ENV=production"},
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+	})
+	require.NoError(t, err)
+
+	return img
+}
+
+func writeSpec(t *testing.T, name string, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+
+	return path
+}
+
+func TestRunStructureTests(t *testing.T) {
+	img := newStructureTestImage(t)
+
+	specPath := writeSpec(t, "spec.yaml", `
+fileExistenceTests:
+  - path: /etc/passwd
+    permissions: -rw-r--r--
+    uid: 0
+    gid: 0
+  - name: no shell
+    path: /bin/sh
+    shouldExist: false
+fileContentTests:
+  - path: /etc/passwd
+    expectedContents: ["^root:"]
+  - path: /app/config.yaml
+    excludedContents: ["debug: true"]
+metadataTest:
+  entrypoint: ["/app/server"]
+  user: "65535"
+  env:
+    - key: APP_ENV
+      value: production
+    - key: PATH
+      value: ".*/usr/bin.*"
+      isRegex: true
+  exposedPorts: ["8080/tcp"]
+maxSize: 1MiB
+`)
+
+	spec, err := image.LoadStructureTestSpec(specPath)
+	require.NoError(t, err)
+
+	results, err := image.RunStructureTests(img, spec)
+	require.NoError(t, err)
+	require.Len(t, results, 6)
+	for _, r := range results {
+		assert.True(t, r.Passed(), "%s: %v", r.Name, r.Errors)
+	}
+	assert.Equal(t, "no shell", results[1].Name)
+}
+
+func TestRunStructureTestsFailures(t *testing.T) {
+	img := newStructureTestImage(t)
+
+	specPath := writeSpec(t, "spec.json", `{
+  "fileExistenceTests": [
+    {"path": "/etc/passwd", "permissions": "-rwxr-xr-x"},
+    {"path": "/etc/shadow"}
+  ],
+  "fileContentTests": [
+    {"path": "/app/config.yaml", "expectedContents": ["debug: true"]}
+  ],
+  "metadataTest": {
+    "user": "root",
+    "env": [{"key": "MISSING", "value": ""}]
+  },
+  "maxSize": "10B"
+}`)
+
+	spec, err := image.LoadStructureTestSpec(specPath)
+	require.NoError(t, err)
+
+	results, err := image.RunStructureTests(img, spec)
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+	for _, r := range results {
+		assert.False(t, r.Passed(), r.Name)
+	}
+	assert.Len(t, results[3].Errors, 2)
+}
+
+func TestLoadStructureTestSpecUnknownField(t *testing.T) {
+	specPath := writeSpec(t, "spec.yaml", "fileExistanceTests: []\n")
+
+	_, err := image.LoadStructureTestSpec(specPath)
+	assert.Error(t, err)
+}
@@ -0,0 +1,229 @@
+package progress
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Event types emitted by ConvertRawJSON.
+const (
+	EventVertexStarted   = "vertex.started"
+	EventVertexCompleted = "vertex.completed"
+	EventLog             = "log"
+)
+
+// Event represents a single build progress event.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Vertex   string    `json:"vertex"`
+	Name     string    `json:"name"`
+	Duration float64   `json:"durationSeconds,omitempty"`
+	Cached   bool      `json:"cached,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// solveStatus represents the parts of BuildKit's `rawjson` progress output
+// which are used.
+type solveStatus struct {
+	Vertexes []struct {
+		Digest    string     `json:"digest"`
+		Name      string     `json:"name"`
+		Started   *time.Time `json:"started"`
+		Completed *time.Time `json:"completed"`
+		Cached    bool       `json:"cached"`
+		Error     string     `json:"error"`
+	} `json:"vertexes"`
+	Logs []struct {
+		Vertex    string    `json:"vertex"`
+		Stream    int       `json:"stream"`
+		Data      []byte    `json:"data"`
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"logs"`
+}
+
+// Vertex represents the final state of a step of a BuildKit build.
+type Vertex struct {
+	Digest    string
+	Name      string
+	Started   *time.Time
+	Completed *time.Time
+	Cached    bool
+	Error     string
+}
+
+// ReadVertexes reads BuildKit's `rawjson` progress output, or a `buildctl
+// --trace` file which has the same format, from r and returns the final state
+// of each vertex in the order they were first seen.
+func ReadVertexes(r io.Reader) ([]*Vertex, error) {
+	dec := json.NewDecoder(r)
+	vertexes := []*Vertex{}
+	byDigest := map[string]*Vertex{}
+
+	for {
+		status := &solveStatus{}
+		err := dec.Decode(status)
+		if errors.Is(err, io.EOF) {
+			return vertexes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range status.Vertexes {
+			vertex, ok := byDigest[v.Digest]
+			if !ok {
+				vertex = &Vertex{Digest: v.Digest}
+				byDigest[v.Digest] = vertex
+				vertexes = append(vertexes, vertex)
+			}
+
+			vertex.Name = v.Name
+			vertex.Cached = v.Cached
+			if v.Started != nil {
+				vertex.Started = v.Started
+			}
+			if v.Completed != nil {
+				vertex.Completed = v.Completed
+			}
+			if v.Error != "" {
+				vertex.Error = v.Error
+			}
+		}
+	}
+}
+
+type vertexState struct {
+	index     int
+	name      string
+	started   bool
+	completed bool
+}
+
+// ConvertRawJSON reads BuildKit's `rawjson` progress output from r and writes
+// newline delimited Events to events. A human-readable log, similar to
+// BuildKit's `plain` progress output, is written to log. Any trailing output
+// which is not JSON, e.g. the error buildctl prints when a build fails, is
+// copied to log verbatim.
+func ConvertRawJSON(r io.Reader, events io.Writer, log io.Writer) error {
+	enc := json.NewEncoder(events)
+	dec := json.NewDecoder(r)
+	vertexes := map[string]*vertexState{}
+
+	for {
+		status := &solveStatus{}
+		err := dec.Decode(status)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if _, err := io.Copy(log, io.MultiReader(dec.Buffered(), r)); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		for _, v := range status.Vertexes {
+			state, ok := vertexes[v.Digest]
+			if !ok {
+				state = &vertexState{index: len(vertexes) + 1, name: v.Name}
+				vertexes[v.Digest] = state
+			}
+
+			if v.Started != nil && !state.started {
+				state.started = true
+				fmt.Fprintf(log, "#%d %s\n", state.index, v.Name)
+				if err := enc.Encode(&Event{
+					Type:   EventVertexStarted,
+					Time:   *v.Started,
+					Vertex: v.Digest,
+					Name:   v.Name,
+				}); err != nil {
+					return err
+				}
+			}
+
+			if v.Completed != nil && !state.completed {
+				state.completed = true
+				e := &Event{
+					Type:   EventVertexCompleted,
+					Time:   *v.Completed,
+					Vertex: v.Digest,
+					Name:   v.Name,
+					Cached: v.Cached,
+					Error:  v.Error,
+				}
+				if v.Started != nil {
+					e.Duration = v.Completed.Sub(*v.Started).Seconds()
+				}
+
+				switch {
+				case v.Error != "":
+					fmt.Fprintf(log, "#%d ERROR: %s\n", state.index, v.Error)
+				case v.Cached:
+					fmt.Fprintf(log, "#%d CACHED\n", state.index)
+				default:
+					fmt.Fprintf(log, "#%d DONE %.1fs\n", state.index, e.Duration)
+				}
+
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, l := range status.Logs {
+			state, ok := vertexes[l.Vertex]
+			if !ok {
+				state = &vertexState{index: len(vertexes) + 1}
+				vertexes[l.Vertex] = state
+			}
+
+			stream := "stdout"
+			if l.Stream == 2 {
+				stream = "stderr"
+			}
+
+			scanner := bufio.NewScanner(strings.NewReader(string(l.Data)))
+			// a line may be as long as the log data itself.
+			scanner.Buffer(nil, len(l.Data)+1)
+			for scanner.Scan() {
+				fmt.Fprintf(log, "#%d %s\n", state.index, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				return fmt.Errorf("could not read log of '%s': %w", state.name, err)
+			}
+
+			if err := enc.Encode(&Event{
+				Type:    EventLog,
+				Time:    l.Timestamp,
+				Vertex:  l.Vertex,
+				Name:    state.name,
+				Stream:  stream,
+				Message: string(l.Data),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Tail returns the last n lines of the given log. If lines are omitted, a
+// line noting how many is prepended.
+func Tail(log string, n int) string {
+	lines := strings.Split(strings.TrimRight(log, "\n"), "\n")
+	if len(lines) <= n {
+		return strings.Join(lines, "\n")
+	}
+
+	omitted := len(lines) - n
+
+	return fmt.Sprintf("... (%d lines omitted)\n%s", omitted, strings.Join(lines[omitted:], "\n"))
+}
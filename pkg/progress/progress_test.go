@@ -0,0 +1,107 @@
+package progress_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRawJSON = `{
+  "vertexes": [
+    {"digest": "sha256:a", "name": "[1/2] FROM docker.io/library/alpine", "started": "2023-01-01T00:00:00Z", "completed": "2023-01-01T00:00:00Z", "cached": true}
+  ]
+}
+{
+  "vertexes": [
+    {"digest": "sha256:b", "name": "[2/2] RUN echo hello", "started": "2023-01-01T00:00:01Z"}
+  ],
+  "logs": [
+    {"vertex": "sha256:b", "stream": 1, "data": "aGVsbG8K", "timestamp": "2023-01-01T00:00:02Z"}
+  ]
+}
+{
+  "vertexes": [
+    {"digest": "sha256:b", "name": "[2/2] RUN echo hello", "started": "2023-01-01T00:00:01Z", "completed": "2023-01-01T00:00:03.5Z", "error": "exit code: 1"}
+  ]
+}
+error: failed to solve: process "/bin/sh -c echo hello" did not complete successfully: exit code: 1
+`
+
+func TestConvertRawJSON(t *testing.T) {
+	var events, log bytes.Buffer
+	require.NoError(t, progress.ConvertRawJSON(strings.NewReader(testRawJSON), &events, &log))
+
+	parsed := []*progress.Event{}
+	scanner := bufio.NewScanner(&events)
+	for scanner.Scan() {
+		e := &progress.Event{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), e))
+		parsed = append(parsed, e)
+	}
+
+	require.Len(t, parsed, 5)
+	assert.Equal(t, progress.EventVertexStarted, parsed[0].Type)
+	assert.Equal(t, progress.EventVertexCompleted, parsed[1].Type)
+	assert.True(t, parsed[1].Cached)
+	assert.Equal(t, progress.EventVertexStarted, parsed[2].Type)
+	assert.Equal(t, progress.EventLog, parsed[3].Type)
+	assert.Equal(t, "hello\n", parsed[3].Message)
+	assert.Equal(t, "stdout", parsed[3].Stream)
+	assert.Equal(t, "[2/2] RUN echo hello", parsed[3].Name)
+	assert.Equal(t, progress.EventVertexCompleted, parsed[4].Type)
+	assert.Equal(t, 2.5, parsed[4].Duration)
+	assert.Equal(t, "exit code: 1", parsed[4].Error)
+
+	assert.Equal(t, `#1 [1/2] FROM docker.io/library/alpine
+#1 CACHED
+#2 [2/2] RUN echo hello
+#2 hello
+#2 ERROR: exit code: 1
+
+error: failed to solve: process "/bin/sh -c echo hello" did not complete successfully: exit code: 1
+`, log.String())
+}
+
+func TestConvertRawJSONLongLogLine(t *testing.T) {
+	line := strings.Repeat("a", 128*1024)
+	rawJSON, err := json.Marshal(map[string]any{
+		"vertexes": []map[string]any{
+			{"digest": "sha256:a", "name": "[1/1] RUN cat big.txt", "started": "2023-01-01T00:00:00Z"},
+		},
+		"logs": []map[string]any{
+			{"vertex": "sha256:a", "stream": 1, "data": []byte(line + "\nb\n"), "timestamp": "2023-01-01T00:00:01Z"},
+		},
+	})
+	require.NoError(t, err)
+
+	var events, log bytes.Buffer
+	require.NoError(t, progress.ConvertRawJSON(bytes.NewReader(rawJSON), &events, &log))
+	assert.Equal(t, "#1 [1/1] RUN cat big.txt\n#1 "+line+"\n#1 b\n", log.String())
+}
+
+func TestTail(t *testing.T) {
+	assert.Equal(t, "a\nb", progress.Tail("a\nb\n", 2))
+	assert.Equal(t, "... (2 lines omitted)\nc\nd", progress.Tail("a\nb\nc\nd\n", 2))
+}
+
+func TestReadVertexes(t *testing.T) {
+	rawJSON := testRawJSON[:strings.Index(testRawJSON, "error:")]
+
+	vertexes, err := progress.ReadVertexes(strings.NewReader(rawJSON))
+	require.NoError(t, err)
+	require.Len(t, vertexes, 2)
+
+	assert.Equal(t, "sha256:a", vertexes[0].Digest)
+	assert.True(t, vertexes[0].Cached)
+	assert.Equal(t, "[2/2] RUN echo hello", vertexes[1].Name)
+	require.NotNil(t, vertexes[1].Completed)
+	assert.Equal(t, 2500*time.Millisecond, vertexes[1].Completed.Sub(*vertexes[1].Started))
+	assert.Equal(t, "exit code: 1", vertexes[1].Error)
+}
@@ -0,0 +1,141 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ReportFileSuffix is the suffix of the names of report files.
+const ReportFileSuffix = ".stats.json"
+
+// FindReports loads all of the reports in the tree at the given root, e.g.
+// `plz-out`.
+func FindReports(root string) ([]*Report, error) {
+	reports := []*Report{}
+	if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ReportFileSuffix) {
+			return nil
+		}
+
+		r, err := LoadReport(path)
+		if err != nil {
+			return fmt.Errorf("could not load report '%s': %w", path, err)
+		}
+		reports = append(reports, r)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// Summary represents the aggregate of many reports.
+type Summary struct {
+	Builds   int                  `json:"builds"`
+	Duration Durations            `json:"durationSeconds"`
+	Phases   map[string]Durations `json:"phasesSeconds"`
+	Vertexes VertexCounts         `json:"vertexes"`
+	// CacheHitRatio is the ratio of vertexes which were cached.
+	CacheHitRatio float64      `json:"cacheHitRatio"`
+	Slowest       []*SlowBuild `json:"slowest"`
+}
+
+// Durations represents the aggregate of many durations in seconds.
+type Durations struct {
+	Total float64 `json:"total"`
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+}
+
+func (d *Durations) add(v float64) {
+	d.Total += v
+	if v > d.Max {
+		d.Max = v
+	}
+}
+
+// SlowBuild represents the total duration of the build of a report.
+type SlowBuild struct {
+	Path     string  `json:"path"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+// Aggregate summarises the given reports, including up to the given number
+// of the slowest builds.
+func Aggregate(reports []*Report, slowest int) *Summary {
+	s := &Summary{
+		Builds:  len(reports),
+		Phases:  map[string]Durations{},
+		Slowest: []*SlowBuild{},
+	}
+
+	for _, r := range reports {
+		s.Duration.add(r.Duration)
+		for phase, v := range r.Phases {
+			d := s.Phases[phase]
+			d.add(v)
+			s.Phases[phase] = d
+		}
+		s.Vertexes.Add(r.Vertexes)
+		s.Slowest = append(s.Slowest, &SlowBuild{Path: r.Path, Duration: r.Duration})
+	}
+
+	if s.Builds > 0 {
+		s.Duration.Mean = s.Duration.Total / float64(s.Builds)
+		for phase, d := range s.Phases {
+			d.Mean = d.Total / float64(s.Builds)
+			s.Phases[phase] = d
+		}
+	}
+
+	if s.Vertexes.Total > 0 {
+		s.CacheHitRatio = float64(s.Vertexes.Cached) / float64(s.Vertexes.Total)
+	}
+
+	sort.SliceStable(s.Slowest, func(i, j int) bool {
+		return s.Slowest[i].Duration > s.Slowest[j].Duration
+	})
+	if len(s.Slowest) > slowest {
+		s.Slowest = s.Slowest[:slowest]
+	}
+
+	return s
+}
+
+// WriteText writes a human-readable summary to the given writer.
+func (s *Summary) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Builds:\t%d\n", s.Builds)
+	fmt.Fprintf(tw, "Duration:\t%.1fs total, %.1fs mean, %.1fs max\n", s.Duration.Total, s.Duration.Mean, s.Duration.Max)
+	fmt.Fprintf(tw, "Vertexes:\t%d total, %d cached, %d uncached (%.1f%% cache hits)\n",
+		s.Vertexes.Total, s.Vertexes.Cached, s.Vertexes.Uncached, s.CacheHitRatio*100)
+
+	fmt.Fprintf(tw, "\nPhases:\n")
+	fmt.Fprintf(tw, "  PHASE\tTOTAL\tMEAN\tMAX\tSHARE\n")
+	for _, phase := range Phases {
+		d := s.Phases[phase]
+		share := 0.0
+		if s.Duration.Total > 0 {
+			share = d.Total * 100 / s.Duration.Total
+		}
+		fmt.Fprintf(tw, "  %s\t%.1fs\t%.1fs\t%.1fs\t%.1f%%\n", phase, d.Total, d.Mean, d.Max, share)
+	}
+
+	fmt.Fprintf(tw, "\nSlowest:\n")
+	for _, b := range s.Slowest {
+		fmt.Fprintf(tw, "  %s\t%.1fs\n", b.Path, b.Duration)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,61 @@
+package stats_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindReportsAndAggregate(t *testing.T) {
+	root := t.TempDir()
+	reports := map[string]*stats.Report{
+		"gen/pkg1/pkg1_a.stats.json": {
+			Duration: 10,
+			Phases:   map[string]float64{stats.PhaseImagePull: 4, stats.PhaseSolve: 5},
+			Vertexes: stats.VertexCounts{Total: 4, Cached: 3, Uncached: 1},
+		},
+		"gen/pkg2/pkg2_b.stats.json": {
+			Duration: 30,
+			Phases:   map[string]float64{stats.PhaseImagePull: 2, stats.PhaseSolve: 25},
+			Vertexes: stats.VertexCounts{Total: 4, Cached: 1, Uncached: 3},
+		},
+	}
+	for path, r := range reports {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, r.Write(path))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, "gen/pkg1/other.json"), []byte("{"), 0o644))
+
+	found, err := stats.FindReports(root)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+
+	s := stats.Aggregate(found, 1)
+	assert.Equal(t, 2, s.Builds)
+	assert.Equal(t, stats.Durations{Total: 40, Mean: 20, Max: 30}, s.Duration)
+	assert.Equal(t, stats.Durations{Total: 6, Mean: 3, Max: 4}, s.Phases[stats.PhaseImagePull])
+	assert.Equal(t, stats.Durations{Total: 30, Mean: 15, Max: 25}, s.Phases[stats.PhaseSolve])
+	assert.Equal(t, stats.VertexCounts{Total: 8, Cached: 4, Uncached: 4}, s.Vertexes)
+	assert.Equal(t, 0.5, s.CacheHitRatio)
+	assert.Equal(t, []*stats.SlowBuild{
+		{Path: filepath.Join(root, "gen/pkg2/pkg2_b.stats.json"), Duration: 30},
+	}, s.Slowest)
+
+	var out bytes.Buffer
+	require.NoError(t, s.WriteText(&out))
+	assert.Contains(t, out.String(), "4 cached, 4 uncached (50.0% cache hits)")
+	assert.Contains(t, out.String(), "solve")
+}
+
+func TestAggregateEmpty(t *testing.T) {
+	s := stats.Aggregate(nil, 10)
+	assert.Equal(t, 0, s.Builds)
+	assert.Equal(t, 0.0, s.CacheHitRatio)
+	assert.Empty(t, s.Slowest)
+}
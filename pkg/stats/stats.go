@@ -0,0 +1,215 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/progress"
+)
+
+// Phases of a build which are timed.
+const (
+	PhaseIsSupported    = "is_supported"
+	PhaseImagePull      = "image_pull"
+	PhaseContainerStart = "container_start"
+	PhaseWaitForWorkers = "wait_for_workers"
+	PhaseSolve          = "solve"
+	PhaseExport         = "export"
+)
+
+// Phases are all of the phases of a build, in the order they occur.
+var Phases = []string{
+	PhaseIsSupported,
+	PhaseImagePull,
+	PhaseContainerStart,
+	PhaseWaitForWorkers,
+	PhaseSolve,
+	PhaseExport,
+}
+
+// Report represents the timings and cache statistics of a build.
+type Report struct {
+	// Duration is the total duration of the build in seconds.
+	Duration float64 `json:"durationSeconds"`
+	// Phases are the durations of each phase of the build in seconds.
+	Phases   map[string]float64 `json:"phasesSeconds"`
+	Vertexes VertexCounts       `json:"vertexes"`
+
+	// Path is the path the report was loaded from, if any.
+	Path string `json:"-"`
+}
+
+// VertexCounts represents the number of steps of a build by whether they were
+// cached.
+type VertexCounts struct {
+	Total    int `json:"total"`
+	Cached   int `json:"cached"`
+	Uncached int `json:"uncached"`
+}
+
+// Add adds the given counts to c.
+func (c *VertexCounts) Add(o VertexCounts) {
+	c.Total += o.Total
+	c.Cached += o.Cached
+	c.Uncached += o.Uncached
+}
+
+// LoadReport loads the report at the given path.
+func LoadReport(path string) (*Report, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	r.Path = path
+
+	return r, nil
+}
+
+// Write writes the report as JSON to the given path.
+func (r *Report) Write(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// Recorder records the phase durations and vertexes of a build.
+type Recorder struct {
+	mu       sync.Mutex
+	started  time.Time
+	phases   map[string]time.Duration
+	vertexes VertexCounts
+}
+
+// NewRecorder returns a new Recorder for a build which starts now.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		started: time.Now(),
+		phases:  map[string]time.Duration{},
+	}
+}
+
+// Record adds the given duration to the given phase.
+func (r *Recorder) Record(phase string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.phases[phase] += d
+}
+
+// RecordVertexes records the solve and export phases, and the cache
+// statistics, from the given BuildKit vertexes, e.g. from a `buildctl
+// --trace` file.
+func (r *Recorder) RecordVertexes(vertexes []*progress.Vertex) {
+	solve, export := &window{}, &window{}
+	counts := VertexCounts{}
+
+	for _, v := range vertexes {
+		if isExportVertex(v.Name) {
+			export.add(v)
+			continue
+		}
+
+		solve.add(v)
+		counts.Total++
+		if v.Cached {
+			counts.Cached++
+		} else {
+			counts.Uncached++
+		}
+	}
+
+	r.Record(PhaseSolve, solve.duration())
+	r.Record(PhaseExport, export.duration())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.vertexes.Add(counts)
+}
+
+// Report returns the report of the build so far.
+func (r *Recorder) Report() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &Report{
+		Duration: time.Since(r.started).Seconds(),
+		Phases:   map[string]float64{},
+		Vertexes: r.vertexes,
+	}
+	for phase, d := range r.phases {
+		report.Phases[phase] = d.Seconds()
+	}
+
+	return report
+}
+
+// isExportVertex returns whether the vertex with the given name exports the
+// result of a build, rather than solving it.
+func isExportVertex(name string) bool {
+	return strings.HasPrefix(name, "exporting ") || name == "sending tarball"
+}
+
+// window is the time between the earliest start and latest completion of a set
+// of vertexes.
+type window struct {
+	start, end *time.Time
+}
+
+func (w *window) add(v *progress.Vertex) {
+	if v.Started == nil || v.Completed == nil {
+		return
+	}
+	if w.start == nil || v.Started.Before(*w.start) {
+		w.start = v.Started
+	}
+	if w.end == nil || v.Completed.After(*w.end) {
+		w.end = v.Completed
+	}
+}
+
+func (w *window) duration() time.Duration {
+	if w.start == nil {
+		return 0
+	}
+
+	return w.end.Sub(*w.start)
+}
+
+type recorderKey struct{}
+
+// WithRecorder returns a copy of ctx which carries the given Recorder.
+func WithRecorder(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+// FromContext returns the Recorder in ctx, or nil if there is none.
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return r
+}
+
+// Start starts timing the given phase and returns a function which records
+// its duration to the Recorder in ctx, if any.
+func Start(ctx context.Context, phase string) func() {
+	r := FromContext(ctx)
+	if r == nil {
+		return func() {}
+	}
+
+	started := time.Now()
+	return func() {
+		r.Record(phase, time.Since(started))
+	}
+}
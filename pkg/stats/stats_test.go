@@ -0,0 +1,67 @@
+package stats_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/VJftw/please-buildkit/pkg/progress"
+	"github.com/VJftw/please-buildkit/pkg/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func at(seconds float64) *time.Time {
+	t := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(seconds * float64(time.Second)))
+	return &t
+}
+
+func TestRecorderRecordVertexes(t *testing.T) {
+	r := stats.NewRecorder()
+	r.RecordVertexes([]*progress.Vertex{
+		{Name: "[internal] load build definition from Dockerfile", Started: at(0), Completed: at(0.5)},
+		{Name: "[1/2] FROM docker.io/library/alpine", Started: at(0.5), Completed: at(0.5), Cached: true},
+		{Name: "[2/2] RUN echo hello", Started: at(1), Completed: at(4)},
+		{Name: "exporting to docker image format", Started: at(4), Completed: at(6)},
+		{Name: "exporting layers", Started: at(4), Completed: at(5)},
+		{Name: "sending tarball", Started: at(5), Completed: at(6.5)},
+	})
+
+	report := r.Report()
+	assert.Equal(t, 4.0, report.Phases[stats.PhaseSolve])
+	assert.Equal(t, 2.5, report.Phases[stats.PhaseExport])
+	assert.Equal(t, stats.VertexCounts{Total: 3, Cached: 1, Uncached: 2}, report.Vertexes)
+}
+
+func TestStart(t *testing.T) {
+	// phases are not recorded without a Recorder.
+	stats.Start(context.Background(), stats.PhaseImagePull)()
+
+	r := stats.NewRecorder()
+	ctx := stats.WithRecorder(context.Background(), r)
+
+	done := stats.Start(ctx, stats.PhaseImagePull)
+	time.Sleep(10 * time.Millisecond)
+	done()
+	r.Record(stats.PhaseImagePull, time.Second)
+
+	report := r.Report()
+	assert.GreaterOrEqual(t, report.Phases[stats.PhaseImagePull], 1.01)
+	assert.Greater(t, report.Duration, 0.0)
+}
+
+func TestReportWriteAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image"+stats.ReportFileSuffix)
+	report := &stats.Report{
+		Duration: 10,
+		Phases:   map[string]float64{stats.PhaseSolve: 8},
+		Vertexes: stats.VertexCounts{Total: 2, Cached: 1, Uncached: 1},
+	}
+	require.NoError(t, report.Write(path))
+
+	loaded, err := stats.LoadReport(path)
+	require.NoError(t, err)
+	report.Path = path
+	assert.Equal(t, report, loaded)
+}
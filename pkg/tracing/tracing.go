@@ -0,0 +1,143 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/VJftw/please-buildkit/pkg/progress"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/VJftw/please-buildkit"
+	serviceName         = "please_buildkit"
+)
+
+// Tracer returns the tracer used to create please_buildkit's spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Enabled returns whether spans should be exported, i.e. whether an OTLP
+// endpoint is given, or configured via the standard OTEL_EXPORTER_OTLP_*
+// environment variables.
+func Enabled(endpoint string) bool {
+	return endpoint != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" ||
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Setup configures the global tracer provider to export spans via OTLP/HTTP
+// to the given endpoint URL, e.g. `http://localhost:4318`. If the endpoint is
+// empty, the standard OTEL_EXPORTER_OTLP_* environment variables are used. If
+// tracing is not enabled, spans are discarded. The returned function flushes
+// and shuts down the tracer provider.
+func Setup(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if !Enabled(endpoint) {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid OTLP endpoint '%s'", endpoint)
+		}
+		opts = append(opts, otlptracehttp.WithEndpoint(u.Host))
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if u.Path != "" && u.Path != "/" {
+			opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+		}
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn().Err(err).Msg("could not export traces")
+	}))
+
+	return tp.Shutdown, nil
+}
+
+// ContextWithTraceParent returns a copy of ctx which carries the remote span
+// described by the given W3C `traceparent` value, so that spans started from
+// it continue that trace, e.g. a CI pipeline's. An empty or invalid value
+// returns ctx unchanged.
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{
+		"traceparent": traceparent,
+	})
+}
+
+// End records the given error, if any, on the given span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// RecordVertexes creates a span, as a child of the span in ctx, for each
+// of the given BuildKit vertexes which has started, e.g. from a `buildctl
+// --trace` file.
+func RecordVertexes(ctx context.Context, vertexes []*progress.Vertex) {
+	tracer := Tracer()
+	for _, v := range vertexes {
+		if v.Started == nil {
+			continue
+		}
+
+		_, span := tracer.Start(ctx, v.Name,
+			trace.WithTimestamp(*v.Started),
+			trace.WithAttributes(
+				attribute.String("buildkit.vertex.digest", v.Digest),
+				attribute.Bool("buildkit.vertex.cached", v.Cached),
+			),
+		)
+		if v.Error != "" {
+			span.SetStatus(codes.Error, v.Error)
+		}
+
+		end := *v.Started
+		if v.Completed != nil {
+			end = *v.Completed
+		}
+		span.End(trace.WithTimestamp(end))
+	}
+}
@@ -0,0 +1,121 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/VJftw/please-buildkit/pkg/progress"
+	"github.com/VJftw/please-buildkit/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const testTrace = `{"vertexes": [{"digest": "sha256:a", "name": "[1/2] FROM docker.io/library/alpine", "started": "2023-01-01T00:00:00Z", "completed": "2023-01-01T00:00:00Z", "cached": true}]}
+{"vertexes": [{"digest": "sha256:b", "name": "[2/2] RUN echo hello", "started": "2023-01-01T00:00:01Z"}]}
+{"vertexes": [{"digest": "sha256:b", "name": "[2/2] RUN echo hello", "started": "2023-01-01T00:00:01Z", "completed": "2023-01-01T00:00:03.5Z", "error": "exit code: 1"}]}
+{"vertexes": [{"digest": "sha256:c", "name": "exporting to image"}]}
+`
+
+// collector is a stand-in for an OTLP/HTTP collector which records the spans
+// it receives.
+type collector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	_, _ = w.Write(resp)
+}
+
+func TestSetupAndRecordVertexes(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	vertexes, err := progress.ReadVertexes(strings.NewReader(testTrace))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	shutdown, err := tracing.Setup(ctx, srv.URL)
+	require.NoError(t, err)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx = tracing.ContextWithTraceParent(ctx, "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	ctx, root := tracing.Tracer().Start(ctx, "please_buildkit build")
+	buildCtx, build := tracing.Tracer().Start(ctx, "buildctl build")
+	tracing.RecordVertexes(buildCtx, vertexes)
+	tracing.End(build, nil)
+	tracing.End(root, nil)
+
+	require.NoError(t, shutdown(context.Background()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	spans := map[string]*tracepb.Span{}
+	for _, s := range c.spans {
+		spans[s.Name] = s
+		assert.Equal(t, traceID, hex.EncodeToString(s.TraceId), s.Name)
+	}
+	require.Len(t, spans, 4)
+
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(spans["please_buildkit build"].ParentSpanId))
+	assert.Equal(t, spans["please_buildkit build"].SpanId, spans["buildctl build"].ParentSpanId)
+
+	run := spans["[2/2] RUN echo hello"]
+	assert.Equal(t, spans["buildctl build"].SpanId, run.ParentSpanId)
+	assert.Equal(t, uint64(2_500_000_000), run.EndTimeUnixNano-run.StartTimeUnixNano)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, run.Status.Code)
+	assert.Equal(t, "exit code: 1", run.Status.Message)
+
+	from := spans["[1/2] FROM docker.io/library/alpine"]
+	assert.Equal(t, tracepb.Status_STATUS_CODE_UNSET, from.Status.Code)
+}
+
+func TestSetupDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+
+	assert.False(t, tracing.Enabled(""))
+
+	shutdown, err := tracing.Setup(context.Background(), "")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestSetupInvalidEndpoint(t *testing.T) {
+	_, err := tracing.Setup(context.Background(), "localhost")
+	assert.Error(t, err)
+}